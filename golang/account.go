@@ -0,0 +1,309 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// エクスポートするデータ。画像は images/ 以下に元のファイルのまま入れる
+type exportUser struct {
+	ID          int       `json:"id"`
+	AccountName string    `json:"account_name"`
+	Email       string    `json:"email,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type exportPost struct {
+	ID        int       `json:"id"`
+	Body      string    `json:"body"`
+	Mime      string    `json:"mime"`
+	Image     string    `json:"image"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type exportComment struct {
+	ID        int       `json:"id"`
+	PostID    int       `json:"post_id"`
+	Comment   string    `json:"comment"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type exportIdentity struct {
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type exportData struct {
+	ExportedAt time.Time        `json:"exported_at"`
+	User       exportUser       `json:"user"`
+	Posts      []exportPost     `json:"posts"`
+	Comments   []exportComment  `json:"comments"`
+	Identities []exportIdentity `json:"identities"`
+}
+
+func imageExt(mime string) string {
+	switch mime {
+	case "image/jpeg":
+		return "jpg"
+	case "image/png":
+		return "png"
+	case "image/gif":
+		return "gif"
+	}
+	return ""
+}
+
+func imageFilePath(pid int, mime string) string {
+	return fmt.Sprintf("%s/%d.%s", cfg.ImageDir, pid, imageExt(mime))
+}
+
+// writeExportImage は画像ファイルをアーカイブに書き込む
+// ファイルがまだ書き出されていない投稿はDBの imgdata を使う
+func writeExportImage(zw *zip.Writer, name string, p Post) error {
+	dst, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: p.CreatedAt})
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(imageFilePath(p.ID, p.Mime))
+	if err == nil {
+		defer f.Close()
+		_, err = io.Copy(dst, f)
+		return err
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	imgdata := []byte{}
+	if err := db.Get(&imgdata, "SELECT `imgdata` FROM `posts` WHERE `id` = ?", p.ID); err != nil {
+		return err
+	}
+	_, err = dst.Write(imgdata)
+	return err
+}
+
+// getSettingsExport は自分の投稿とコメント、画像をzipでダウンロードさせる
+func getSettingsExport(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	posts := []Post{}
+	err := db.SelectContext(r.Context(), &posts, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `user_id` = ? ORDER BY `created_at`", me.ID)
+	if err != nil {
+		return err
+	}
+	comments := []Comment{}
+	err = db.SelectContext(r.Context(), &comments, "SELECT `id`, `post_id`, `user_id`, `comment`, `created_at` FROM `comments` WHERE `user_id` = ? ORDER BY `created_at`", me.ID)
+	if err != nil {
+		return err
+	}
+
+	data := exportData{
+		ExportedAt: time.Now(),
+		User:       exportUser{ID: me.ID, AccountName: me.AccountName, Email: userEmail(me.ID), CreatedAt: me.CreatedAt},
+		Posts:      make([]exportPost, 0, len(posts)),
+		Comments:   make([]exportComment, 0, len(comments)),
+		Identities: []exportIdentity{},
+	}
+	for _, p := range posts {
+		data.Posts = append(data.Posts, exportPost{
+			ID:        p.ID,
+			Body:      p.Body,
+			Mime:      p.Mime,
+			Image:     path.Join("images", fmt.Sprintf("%d.%s", p.ID, imageExt(p.Mime))),
+			CreatedAt: p.CreatedAt,
+		})
+	}
+	for _, c := range comments {
+		data.Comments = append(data.Comments, exportComment{ID: c.ID, PostID: c.PostID, Comment: c.Comment, CreatedAt: c.CreatedAt})
+	}
+	for _, i := range userIdentities(me.ID) {
+		data.Identities = append(data.Identities, exportIdentity{Issuer: i.Issuer, Subject: i.Subject, CreatedAt: i.CreatedAt})
+	}
+
+	filename := fmt.Sprintf("iscogram-%s-%s.zip", me.AccountName, data.ExportedAt.Format("20060102"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.Header().Set("Cache-Control", "no-store")
+
+	// 画像が多くてもメモリに載せないよう、そのままレスポンスに書き込む
+	zw := zip.NewWriter(w)
+	jw, err := zw.Create("data.json")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(jw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(data); err != nil {
+		return err
+	}
+	for i, p := range posts {
+		if err := writeExportImage(zw, data.Posts[i].Image, p); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+type idCount struct {
+	ID    int `db:"id"`
+	Count int `db:"count"`
+}
+
+// deleteAccount はユーザーと、その投稿・コメント・画像を削除する
+// 他のユーザーが自分の投稿に付けたコメントも投稿と一緒に消える
+func deleteAccount(u User) error {
+	// コメントを消してからキャッシュを減らすまでに runReconcileCounts が割り込まないようにする
+	commentCountsMu.RLock()
+	defer commentCountsMu.RUnlock()
+
+	posts := []Post{}
+	err := db.Select(&posts, "SELECT `id`, `mime` FROM `posts` WHERE `user_id` = ?", u.ID)
+	if err != nil {
+		return err
+	}
+	postIDs := make([]int, 0, len(posts))
+	for _, p := range posts {
+		postIDs = append(postIDs, p.ID)
+	}
+
+	// キャッシュのコメント数を合わせるため、消えるコメントを数えておく
+	commentedPosts := []idCount{}
+	err = db.Select(&commentedPosts, "SELECT `post_id` AS `id`, COUNT(*) AS `count` FROM `comments` WHERE `user_id` = ? GROUP BY `post_id`", u.ID)
+	if err != nil {
+		return err
+	}
+	commenters := []idCount{}
+	if len(postIDs) > 0 {
+		query, args, err := sqlx.In("SELECT `user_id` AS `id`, COUNT(*) AS `count` FROM `comments` WHERE `post_id` IN (?) AND `user_id` != ? GROUP BY `user_id`", postIDs, u.ID)
+		if err != nil {
+			return err
+		}
+		if err := db.Select(&commenters, query, args...); err != nil {
+			return err
+		}
+	}
+
+	// 他の端末でログイン中のセッションも消す
+	if err := revokeUserSessions([]int{u.ID}, ""); err != nil {
+		return err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sqls := []string{
+		"DELETE FROM `comments` WHERE `user_id` = ?",
+		"DELETE `ap_likes` FROM `ap_likes` JOIN `posts` ON `ap_likes`.`post_id` = `posts`.`id` WHERE `posts`.`user_id` = ?",
+		"DELETE `comments` FROM `comments` JOIN `posts` ON `comments`.`post_id` = `posts`.`id` WHERE `posts`.`user_id` = ?",
+		"DELETE `ap_remote_comments` FROM `ap_remote_comments` JOIN `posts` ON `ap_remote_comments`.`post_id` = `posts`.`id` WHERE `posts`.`user_id` = ?",
+		"DELETE FROM `posts` WHERE `user_id` = ?",
+		"DELETE FROM `user_sessions` WHERE `user_id` = ?",
+		"DELETE FROM `user_upload_usage` WHERE `user_id` = ?",
+		"DELETE FROM `user_totp` WHERE `user_id` = ?",
+		"DELETE FROM `user_recovery_codes` WHERE `user_id` = ?",
+		"DELETE FROM `user_emails` WHERE `user_id` = ?",
+		"DELETE FROM `user_locales` WHERE `user_id` = ?",
+		"DELETE FROM `password_reset_tokens` WHERE `user_id` = ?",
+		"DELETE FROM `api_tokens` WHERE `user_id` = ?",
+		"DELETE FROM `user_identities` WHERE `user_id` = ?",
+		"DELETE FROM `ap_actor_keys` WHERE `user_id` = ?",
+		"DELETE FROM `ap_followers` WHERE `user_id` = ?",
+		"DELETE FROM `users` WHERE `id` = ?",
+	}
+	for _, sql := range sqls {
+		if _, err := tx.Exec(sql, u.ID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM `login_lockouts` WHERE `kind` = ? AND `target` = ?", lockoutKindAccount, u.AccountName); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, p := range posts {
+		if err := os.Remove(imageFilePath(p.ID, p.Mime)); err != nil && !os.IsNotExist(err) {
+			slog.Error("deleteAccount failed", slog.Any("err", err))
+		}
+		count.Delete(p.ID)
+		postMime.Delete(p.ID)
+	}
+	for _, c := range commentedPosts {
+		count.Add(c.ID, -c.Count)
+	}
+	for _, c := range commenters {
+		userCommentCache.Add(c.ID, -c.Count)
+	}
+	userCache.Delete(u.ID)
+	userCommentCache.Delete(u.ID)
+	apKeys.Delete(u.ID)
+	totpEnabled.Delete(u.ID)
+	userLocales.Delete(u.ID)
+
+	slog.Info("account deleted", slog.Int("user_id", u.ID), slog.Int("posts", len(posts)))
+	return nil
+}
+
+// postSettingsDelete は本人確認のうえでアカウントを削除する
+func postSettingsDelete(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	session := getSession(r)
+	if me.Authority != 0 {
+		session.Values["notice"] = tr(r, "flash.admin_cannot_delete")
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/settings", http.StatusFound)
+		return nil
+	}
+
+	// 外部アカウントで作ったユーザーはパスワードを知らないので、
+	// パスワードが空ならログインし直したばかりかどうかで本人確認する
+	password := r.FormValue("password")
+	if password == "" && r.FormValue("account_name") == me.AccountName && !recentlyAuthenticated(r) {
+		session.Values["notice"] = tr(r, "flash.reauth_required", int(reauthWindow.Minutes()))
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/settings", http.StatusFound)
+		return nil
+	}
+	if r.FormValue("account_name") != me.AccountName || (password != "" && tryLogin(me.AccountName, password) == nil) {
+		recordLoginFailure(me.AccountName, clientIP(r))
+		session.Values["notice"] = tr(r, "flash.wrong_credentials")
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/settings", http.StatusFound)
+		return nil
+	}
+
+	err := deleteAccount(me)
+	if err != nil {
+		return err
+	}
+
+	destroySession(w, r)
+
+	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
+}
@@ -0,0 +1,971 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"goji.io/pat"
+)
+
+const (
+	apContentType = "application/activity+json"
+	apPublic      = "https://www.w3.org/ns/activitystreams#Public"
+	apContext     = "https://www.w3.org/ns/activitystreams"
+	apSecContext  = "https://w3id.org/security/v1"
+
+	// 署名の Date ヘッダーとして許容するずれ
+	apSignatureSkew = 5 * time.Minute
+	// リモートのアクター情報を取得し直すまでの期間
+	apActorTTL = 24 * time.Hour
+	apMaxBody  = 1 << 20
+	// リモートのサーバーのリダイレクトを追う回数
+	apMaxRedirects = 3
+)
+
+// テストではプロセス内の偽のリモートサーバーに向けたクライアントや時計に差し替える
+var (
+	apHTTPClient = newAPHTTPClient()
+	apClock      = time.Now
+)
+
+// newAPHTTPClient はリモートのサーバーと通信するクライアントを作る
+// keyId や inbox は送り手が自由に書けるので、内部のアドレスには接続せず、https 以外へのリダイレクトも追わない
+func newAPHTTPClient() *http.Client {
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         externalDialer().DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= apMaxRedirects {
+				return fmt.Errorf("activitypub: stopped after %d redirects", apMaxRedirects)
+			}
+			if req.URL.Scheme != "https" {
+				return fmt.Errorf("activitypub: redirect to non-https URL %q", req.URL)
+			}
+			return nil
+		},
+	}
+}
+
+// externalDialer は内部のアドレスに接続しない Dialer。ActivityPub と Webhook の送信に使う
+func externalDialer() *net.Dialer {
+	return &net.Dialer{Timeout: 5 * time.Second, Control: denyInternalAddress}
+}
+
+// deniedPrefixes は IsPrivate などでは判定されない、内部に届くアドレスの範囲
+var deniedPrefixes = []netip.Prefix{
+	// キャリアグレードNAT
+	netip.MustParsePrefix("100.64.0.0/10"),
+	// IPv4射影アドレス。IPv4 としての判定をすり抜けないよう丸ごと拒否する
+	netip.MustParsePrefix("::ffff:0.0.0.0/96"),
+}
+
+// denyInternalAddress は名前解決した後の接続先がループバックやプライベート、リンクローカルなら接続させない
+// 名前解決の結果で判断するので、外部のホスト名が内部のアドレスを指していても防げる
+func denyInternalAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return fmt.Errorf("invalid address %q", address)
+	}
+	denied := addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified()
+	for _, p := range deniedPrefixes {
+		denied = denied || p.Contains(addr)
+	}
+	if denied {
+		return fmt.Errorf("connecting to internal address %s is not allowed", addr)
+	}
+	return nil
+}
+
+// isHTTPSURL はリモートのアクターやinboxとして使える絶対URLならtrue
+func isHTTPSURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme == "https" && u.Host != ""
+}
+
+var (
+	// ユーザーごとの署名鍵のキャッシュ
+	apKeys = cache{name: "ap_keys"}
+	// 配送中のリクエスト。終了時に待つ
+	apDeliveries sync.WaitGroup
+)
+
+// RemoteActor は他のサーバーのアカウント。コメントを付けられるよう users の行と対応させる
+type RemoteActor struct {
+	ActorID      string    `db:"actor_id"`
+	UserID       int       `db:"user_id"`
+	Username     string    `db:"username"`
+	Inbox        string    `db:"inbox"`
+	SharedInbox  string    `db:"shared_inbox"`
+	PublicKeyPEM string    `db:"public_key_pem"`
+	FetchedAt    time.Time `db:"fetched_at"`
+}
+
+type apPublicKey struct {
+	ID           string `json:"id"`
+	Owner        string `json:"owner"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
+
+type apActor struct {
+	Context           interface{}       `json:"@context,omitempty"`
+	ID                string            `json:"id"`
+	Type              string            `json:"type"`
+	PreferredUsername string            `json:"preferredUsername"`
+	Name              string            `json:"name,omitempty"`
+	URL               string            `json:"url,omitempty"`
+	Inbox             string            `json:"inbox"`
+	Outbox            string            `json:"outbox,omitempty"`
+	Followers         string            `json:"followers,omitempty"`
+	Endpoints         map[string]string `json:"endpoints,omitempty"`
+	PublicKey         apPublicKey       `json:"publicKey"`
+}
+
+type apAttachment struct {
+	Type      string `json:"type"`
+	MediaType string `json:"mediaType"`
+	URL       string `json:"url"`
+}
+
+type apCollection struct {
+	Context      interface{}   `json:"@context,omitempty"`
+	ID           string        `json:"id,omitempty"`
+	Type         string        `json:"type"`
+	TotalItems   int           `json:"totalItems"`
+	First        string        `json:"first,omitempty"`
+	OrderedItems []interface{} `json:"orderedItems,omitempty"`
+}
+
+type apCollectionPage struct {
+	Context      interface{}   `json:"@context,omitempty"`
+	ID           string        `json:"id"`
+	Type         string        `json:"type"`
+	PartOf       string        `json:"partOf"`
+	Next         string        `json:"next,omitempty"`
+	OrderedItems []interface{} `json:"orderedItems"`
+}
+
+type apNote struct {
+	Context      interface{}    `json:"@context,omitempty"`
+	ID           string         `json:"id"`
+	Type         string         `json:"type"`
+	AttributedTo string         `json:"attributedTo"`
+	Content      string         `json:"content"`
+	InReplyTo    string         `json:"inReplyTo,omitempty"`
+	Published    string         `json:"published,omitempty"`
+	URL          string         `json:"url,omitempty"`
+	To           []string       `json:"to,omitempty"`
+	Cc           []string       `json:"cc,omitempty"`
+	Attachment   []apAttachment `json:"attachment,omitempty"`
+	Likes        *apCollection  `json:"likes,omitempty"`
+}
+
+type apActivity struct {
+	Context   interface{}     `json:"@context,omitempty"`
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	Actor     string          `json:"actor"`
+	Object    json.RawMessage `json:"object"`
+	Published string          `json:"published,omitempty"`
+	To        []string        `json:"to,omitempty"`
+	Cc        []string        `json:"cc,omitempty"`
+}
+
+func wantsActivityJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, apContentType) ||
+		(strings.Contains(accept, "application/ld+json") && strings.Contains(accept, "activitystreams"))
+}
+
+func isActivityPubInbox(p string) bool {
+	return strings.HasPrefix(p, "/@") && strings.HasSuffix(p, "/inbox")
+}
+
+func actorURL(accountName string) string {
+	return absoluteURL("/@" + accountName)
+}
+
+func postURL(pid int) string {
+	return absoluteURL("/posts/" + strconv.Itoa(pid))
+}
+
+var postURLRegexp = regexp.MustCompile(`/posts/([0-9]+)$`)
+
+// localPostID は自分のサーバーの投稿のURLから投稿IDを取り出す
+func localPostID(u string) (int, bool) {
+	if !strings.HasPrefix(u, absoluteURL("/posts/")) {
+		return 0, false
+	}
+	m := postURLRegexp.FindStringSubmatch(u)
+	if m == nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(m[1])
+	return pid, err == nil
+}
+
+func writeActivityJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", apContentType+"; charset=utf-8")
+	w.Header().Set("Vary", "Accept")
+	json.NewEncoder(w).Encode(v)
+}
+
+func localActor(accountName string) (User, bool) {
+	u := User{}
+	err := db.Get(&u, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", accountName)
+	return u, err == nil
+}
+
+// actorKey はユーザーの署名用の鍵を返す。初めて使うときに作る
+func actorKey(uid int) (*rsa.PrivateKey, error) {
+	if value, ok := apKeys.Load(uid); ok {
+		return value.(*rsa.PrivateKey), nil
+	}
+
+	privatePEM := ""
+	err := db.Get(&privatePEM, "SELECT `private_key_pem` FROM `ap_actor_keys` WHERE `user_id` = ?", uid)
+	if errors.Is(err, sql.ErrNoRows) {
+		// 最後の SELECT の結果を外の err に入れるので、このブロックでは err を宣言し直さない
+		var key *rsa.PrivateKey
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		var publicDER []byte
+		publicDER, err = x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		privatePEM = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+		publicPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}))
+		_, err = db.Exec("INSERT IGNORE INTO `ap_actor_keys` (`user_id`, `private_key_pem`, `public_key_pem`) VALUES (?,?,?)", uid, privatePEM, publicPEM)
+		if err != nil {
+			return nil, err
+		}
+		// 同時に作られた場合は先に保存された方を使う
+		err = db.Get(&privatePEM, "SELECT `private_key_pem` FROM `ap_actor_keys` WHERE `user_id` = ?", uid)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode([]byte(privatePEM))
+	if block == nil {
+		return nil, fmt.Errorf("activitypub: invalid private key for user %d", uid)
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	apKeys.Store(uid, key)
+	return key, nil
+}
+
+func parsePublicKeyPEM(s string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("activitypub: invalid public key pem")
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("activitypub: only rsa keys are supported")
+	}
+	return rsaKey, nil
+}
+
+func bodyDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// signingString は draft-cavage-http-signatures の署名対象の文字列を作る
+func signingString(r *http.Request, headers []string) (string, error) {
+	lines := make([]string, 0, len(headers))
+	for _, h := range headers {
+		switch h {
+		case "(request-target)":
+			lines = append(lines, fmt.Sprintf("(request-target): %s %s", strings.ToLower(r.Method), r.URL.RequestURI()))
+		case "host":
+			host := r.Host
+			if host == "" {
+				host = r.URL.Host
+			}
+			lines = append(lines, "host: "+host)
+		default:
+			v := r.Header.Get(h)
+			if v == "" {
+				return "", fmt.Errorf("activitypub: signed header %q is missing", h)
+			}
+			lines = append(lines, h+": "+v)
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// signRequest はリクエストに rsa-sha256 の HTTP Signature を付ける
+func signRequest(r *http.Request, body []byte, keyID string, key *rsa.PrivateKey) error {
+	r.Header.Set("Date", apClock().UTC().Format(http.TimeFormat))
+	headers := []string{"(request-target)", "host", "date"}
+	if body != nil {
+		r.Header.Set("Digest", bodyDigest(body))
+		headers = append(headers, "digest")
+	}
+
+	s, err := signingString(r, headers)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256([]byte(s))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyID, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+var signatureParamRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// verifyRequest は受け取ったリクエストの署名を確認し、署名したアクターを返す
+func verifyRequest(r *http.Request, body []byte) (RemoteActor, error) {
+	params := map[string]string{}
+	for _, m := range signatureParamRegexp.FindAllStringSubmatch(r.Header.Get("Signature"), -1) {
+		params[m[1]] = m[2]
+	}
+	keyID := params["keyId"]
+	if keyID == "" || params["signature"] == "" {
+		return RemoteActor{}, errors.New("activitypub: request is not signed")
+	}
+	if alg := params["algorithm"]; alg != "" && alg != "rsa-sha256" && alg != "hs2019" {
+		return RemoteActor{}, fmt.Errorf("activitypub: unsupported algorithm %q", alg)
+	}
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	if len(headers) == 0 {
+		headers = []string{"date"}
+	}
+	for _, required := range []string{"(request-target)", "host", "date", "digest"} {
+		found := false
+		for _, h := range headers {
+			found = found || h == required
+		}
+		if !found {
+			return RemoteActor{}, fmt.Errorf("activitypub: %s is not signed", required)
+		}
+	}
+
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return RemoteActor{}, err
+	}
+	if d := apClock().Sub(date); d > apSignatureSkew || d < -apSignatureSkew {
+		return RemoteActor{}, errors.New("activitypub: date is out of range")
+	}
+	if r.Header.Get("Digest") != bodyDigest(body) {
+		return RemoteActor{}, errors.New("activitypub: digest mismatch")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return RemoteActor{}, err
+	}
+	s, err := signingString(r, headers)
+	if err != nil {
+		return RemoteActor{}, err
+	}
+	digest := sha256.Sum256([]byte(s))
+
+	actorID := strings.SplitN(keyID, "#", 2)[0]
+	actor, err := remoteActor(actorID, false)
+	if err != nil {
+		return RemoteActor{}, err
+	}
+	verify := func(a RemoteActor) error {
+		key, err := parsePublicKeyPEM(a.PublicKeyPEM)
+		if err != nil {
+			return err
+		}
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig)
+	}
+	if err := verify(actor); err != nil {
+		// 鍵が変わっている場合に備えて取得し直す
+		if actor, err = remoteActor(actorID, true); err != nil {
+			return RemoteActor{}, err
+		}
+		if err := verify(actor); err != nil {
+			return RemoteActor{}, errors.New("activitypub: invalid signature")
+		}
+	}
+	return actor, nil
+}
+
+// remoteActor はリモートのアクターを返す。保存済みで新しければ取得しない
+func remoteActor(actorID string, refresh bool) (RemoteActor, error) {
+	actor := RemoteActor{}
+	err := db.Get(&actor, "SELECT * FROM `ap_remote_actors` WHERE `actor_id` = ?", actorID)
+	if err == nil && !refresh && apClock().Sub(actor.FetchedAt) < apActorTTL {
+		return actor, nil
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return RemoteActor{}, err
+	}
+
+	if !isHTTPSURL(actorID) {
+		return RemoteActor{}, fmt.Errorf("activitypub: invalid actor id %q", actorID)
+	}
+	req, err := http.NewRequest(http.MethodGet, actorID, nil)
+	if err != nil {
+		return RemoteActor{}, err
+	}
+	req.Header.Set("Accept", apContentType)
+	res, err := apHTTPClient.Do(req)
+	if err != nil {
+		return RemoteActor{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return RemoteActor{}, fmt.Errorf("activitypub: GET %s: %s", actorID, res.Status)
+	}
+	doc := apActor{}
+	if err := json.NewDecoder(io.LimitReader(res.Body, apMaxBody)).Decode(&doc); err != nil {
+		return RemoteActor{}, err
+	}
+	if doc.ID != actorID || doc.PublicKey.Owner != actorID || !isHTTPSURL(doc.Inbox) {
+		return RemoteActor{}, fmt.Errorf("activitypub: actor document for %q is inconsistent", actorID)
+	}
+	if _, err := parsePublicKeyPEM(doc.PublicKey.PublicKeyPem); err != nil {
+		return RemoteActor{}, err
+	}
+
+	actor.ActorID = actorID
+	actor.Username = truncate(doc.PreferredUsername, 64)
+	actor.Inbox = doc.Inbox
+	if sharedInbox := doc.Endpoints["sharedInbox"]; isHTTPSURL(sharedInbox) {
+		actor.SharedInbox = sharedInbox
+	}
+	actor.PublicKeyPEM = doc.PublicKey.PublicKeyPem
+	actor.FetchedAt = apClock()
+	query := "INSERT INTO `ap_remote_actors` (`actor_id`, `username`, `inbox`, `shared_inbox`, `public_key_pem`, `fetched_at`) VALUES (?,?,?,?,?,?) " +
+		"ON DUPLICATE KEY UPDATE `username` = VALUES(`username`), `inbox` = VALUES(`inbox`), `shared_inbox` = VALUES(`shared_inbox`), " +
+		"`public_key_pem` = VALUES(`public_key_pem`), `fetched_at` = VALUES(`fetched_at`)"
+	_, err = db.Exec(query, actor.ActorID, actor.Username, actor.Inbox, actor.SharedInbox, actor.PublicKeyPEM, actor.FetchedAt)
+	return actor, err
+}
+
+// remoteActorUser はリモートのアクターに対応する users の行を返す。なければ作る
+// アカウント名は name@host にするので、ローカルのユーザーとは重ならずログインもできない
+func remoteActorUser(actor RemoteActor) (User, error) {
+	if actor.UserID != 0 {
+		if value, ok := userCache.Load(actor.UserID); ok {
+			return value.(User), nil
+		}
+	}
+
+	u, _ := url.Parse(actor.ActorID)
+	accountName := truncate(actor.Username+"@"+u.Host, 64)
+	passhash := calculatePasshash(accountName, secureRandomStr(32))
+	result, err := db.Exec("INSERT INTO `users` (`account_name`, `passhash`) VALUES (?,?)", accountName, passhash)
+	if err != nil {
+		// 同じ名前が使われていれば別名にする
+		accountName = truncate(actor.Username, 48) + "@" + secureRandomStr(4)
+		result, err = db.Exec("INSERT INTO `users` (`account_name`, `passhash`) VALUES (?,?)", accountName, passhash)
+		if err != nil {
+			return User{}, err
+		}
+	}
+	uid, err := result.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+	_, err = db.Exec("UPDATE `ap_remote_actors` SET `user_id` = ? WHERE `actor_id` = ?", uid, actor.ActorID)
+	if err != nil {
+		return User{}, err
+	}
+
+	user := User{ID: int(uid), AccountName: accountName, Passhash: passhash, CreatedAt: time.Now()}
+	userCache.Store(user.ID, user)
+	userCommentCache.Store(user.ID, 0)
+	return user, nil
+}
+
+// deliver は署名したアクティビティをリモートの inbox に送る
+func deliver(from User, inbox string, activity interface{}) error {
+	if !isHTTPSURL(inbox) {
+		return fmt.Errorf("activitypub: invalid inbox %q", inbox)
+	}
+	body, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+	key, err := actorKey(from.ID)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ActivityPub.DeliveryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, inbox, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", apContentType)
+	if err := signRequest(req, body, actorURL(from.AccountName)+"#main-key", key); err != nil {
+		return err
+	}
+
+	res, err := apHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, apMaxBody))
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("activitypub: POST %s: %s", inbox, res.Status)
+	}
+	return nil
+}
+
+// deliverAsync はリクエストを待たせないよう別のgoroutineで配送する
+func deliverAsync(from User, inboxes []string, activity interface{}) {
+	apDeliveries.Add(1)
+	go func() {
+		defer apDeliveries.Done()
+		for _, inbox := range inboxes {
+			if err := deliver(from, inbox, activity); err != nil {
+				slog.Error("deliverAsync failed", slog.Any("err", err))
+			}
+		}
+	}()
+}
+
+// waitDeliveries は終了時に配送中のリクエストを待つ
+func waitDeliveries(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		apDeliveries.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func noteContent(body string) string {
+	return "<p>" + strings.Replace(html.EscapeString(body), "\n", "<br>", -1) + "</p>"
+}
+
+var (
+	htmlBreakRegexp = regexp.MustCompile(`(?i)<br\s*/?>|</p>`)
+	htmlTagRegexp   = regexp.MustCompile(`<[^>]*>`)
+)
+
+// plainText はリモートの投稿のHTMLをコメント用のテキストにする
+func plainText(s string) string {
+	s = htmlBreakRegexp.ReplaceAllString(s, "\n")
+	s = htmlTagRegexp.ReplaceAllString(s, "")
+	return strings.TrimSpace(html.UnescapeString(s))
+}
+
+func postNote(p Post, author User) apNote {
+	likes := 0
+	// 失敗しても0件として扱う
+	db.Get(&likes, "SELECT COUNT(*) FROM `ap_likes` WHERE `post_id` = ?", p.ID)
+
+	actor := actorURL(author.AccountName)
+	return apNote{
+		ID:           postURL(p.ID),
+		Type:         "Note",
+		AttributedTo: actor,
+		Content:      noteContent(p.Body),
+		Published:    p.CreatedAt.UTC().Format(time.RFC3339),
+		URL:          postURL(p.ID),
+		To:           []string{apPublic},
+		Cc:           []string{actor + "/followers"},
+		Attachment:   []apAttachment{{Type: "Image", MediaType: p.Mime, URL: absoluteURL(imageURL(p))}},
+		Likes:        &apCollection{Type: "Collection", TotalItems: likes},
+	}
+}
+
+func createActivity(p Post, author User) apActivity {
+	note := postNote(p, author)
+	object, _ := json.Marshal(note)
+	return apActivity{
+		ID:        note.ID + "/activity",
+		Type:      "Create",
+		Actor:     note.AttributedTo,
+		Object:    object,
+		Published: note.Published,
+		To:        note.To,
+		Cc:        note.Cc,
+	}
+}
+
+// federatePost は新しい投稿をフォロワーのサーバーに配送する
+func federatePost(author User, p Post) {
+	if !cfg.ActivityPub.Enabled {
+		return
+	}
+
+	inboxes := []string{}
+	query := "SELECT DISTINCT IF(`ap_remote_actors`.`shared_inbox` != '', `ap_remote_actors`.`shared_inbox`, `ap_remote_actors`.`inbox`) " +
+		"FROM `ap_followers` JOIN `ap_remote_actors` ON `ap_followers`.`actor_id` = `ap_remote_actors`.`actor_id` WHERE `ap_followers`.`user_id` = ?"
+	err := db.Select(&inboxes, query, author.ID)
+	if err != nil {
+		slog.Error("federatePost failed", slog.Any("err", err))
+		return
+	}
+	if len(inboxes) == 0 {
+		return
+	}
+
+	activity := createActivity(p, author)
+	activity.Context = apContext
+	deliverAsync(author, inboxes, activity)
+}
+
+func getWebFinger(w http.ResponseWriter, r *http.Request) error {
+	if !cfg.ActivityPub.Enabled {
+		return notFound("error.not_found")
+	}
+
+	resource := r.URL.Query().Get("resource")
+	base, _ := url.Parse(cfg.BaseURL)
+	accountName := ""
+	if strings.HasPrefix(resource, "acct:") {
+		parts := strings.SplitN(strings.TrimPrefix(resource, "acct:"), "@", 2)
+		if len(parts) == 2 && strings.EqualFold(parts[1], base.Host) {
+			accountName = parts[0]
+		}
+	} else if strings.HasPrefix(resource, actorURL("")) {
+		accountName = strings.TrimPrefix(resource, actorURL(""))
+	}
+
+	u, ok := localActor(accountName)
+	if accountName == "" || !ok {
+		return notFound("error.not_found")
+	}
+
+	w.Header().Set("Content-Type", "application/jrd+json; charset=utf-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"subject": "acct:" + u.AccountName + "@" + base.Host,
+		"aliases": []string{actorURL(u.AccountName)},
+		"links": []map[string]string{
+			{"rel": "self", "type": apContentType, "href": actorURL(u.AccountName)},
+			{"rel": "http://webfinger.net/rel/profile-page", "type": "text/html", "href": actorURL(u.AccountName)},
+		},
+	})
+	return nil
+}
+
+// serveActor は /@accountName を ActivityPub のアクターとして返す
+func serveActor(w http.ResponseWriter, u User) {
+	key, err := actorKey(u.ID)
+	if err != nil {
+		slog.Error("serveActor failed", slog.Any("err", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		slog.Error("serveActor failed", slog.Any("err", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	id := actorURL(u.AccountName)
+	writeActivityJSON(w, apActor{
+		Context:           []string{apContext, apSecContext},
+		ID:                id,
+		Type:              "Person",
+		PreferredUsername: u.AccountName,
+		Name:              u.AccountName,
+		URL:               id,
+		Inbox:             id + "/inbox",
+		Outbox:            id + "/outbox",
+		Followers:         id + "/followers",
+		PublicKey: apPublicKey{
+			ID:           id + "#main-key",
+			Owner:        id,
+			PublicKeyPem: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})),
+		},
+	})
+}
+
+// servePostNote は /posts/:id を ActivityPub の Note として返す
+func servePostNote(w http.ResponseWriter, p Post) {
+	value, ok := userCache.Load(p.UserID)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	note := postNote(p, value.(User))
+	note.Context = apContext
+	writeActivityJSON(w, note)
+}
+
+// getActorOutbox はコレクションには件数と最初のページだけを載せ、投稿は ?page=true のページで返す
+// ページの続きはタイムラインと同じ cursor で辿る
+func getActorOutbox(w http.ResponseWriter, r *http.Request) error {
+	u, ok := localActor(pat.Param(r, "accountName"))
+	if !cfg.ActivityPub.Enabled || !ok {
+		return notFound("error.not_found")
+	}
+	outbox := actorURL(u.AccountName) + "/outbox"
+
+	if r.URL.Query().Get("page") == "" {
+		total := 0
+		err := db.GetContext(r.Context(), &total, "SELECT COUNT(*) FROM `posts` WHERE `user_id` = ?", u.ID)
+		if err != nil {
+			return err
+		}
+		writeActivityJSON(w, apCollection{
+			Context:    apContext,
+			ID:         outbox,
+			Type:       "OrderedCollection",
+			TotalItems: total,
+			First:      outbox + "?page=true",
+		})
+		return nil
+	}
+
+	c, err := requestCursor(r)
+	if err != nil {
+		return badRequest("error.bad_request")
+	}
+	posts, next, err := accountPostsPage(r.Context(), u.ID, c)
+	if err != nil {
+		return err
+	}
+
+	items := make([]interface{}, 0, len(posts))
+	for _, p := range posts {
+		items = append(items, createActivity(p, u))
+	}
+	page := apCollectionPage{
+		Context:      apContext,
+		ID:           outbox + "?page=true",
+		Type:         "OrderedCollectionPage",
+		PartOf:       outbox,
+		OrderedItems: items,
+	}
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		page.ID += "&cursor=" + url.QueryEscape(cursor)
+	}
+	if next != "" {
+		page.Next = outbox + "?page=true&cursor=" + next
+	}
+	writeActivityJSON(w, page)
+	return nil
+}
+
+// フォロワーの一覧は公開せず、人数だけ返す
+func getActorFollowers(w http.ResponseWriter, r *http.Request) error {
+	u, ok := localActor(pat.Param(r, "accountName"))
+	if !cfg.ActivityPub.Enabled || !ok {
+		return notFound("error.not_found")
+	}
+
+	total := 0
+	err := db.GetContext(r.Context(), &total, "SELECT COUNT(*) FROM `ap_followers` WHERE `user_id` = ?", u.ID)
+	if err != nil {
+		return err
+	}
+	writeActivityJSON(w, apCollection{
+		Context:    apContext,
+		ID:         actorURL(u.AccountName) + "/followers",
+		Type:       "OrderedCollection",
+		TotalItems: total,
+	})
+	return nil
+}
+
+// objectID はオブジェクトがIDの文字列でも埋め込みでもIDを返す
+func objectID(raw json.RawMessage) string {
+	id := ""
+	if err := json.Unmarshal(raw, &id); err == nil {
+		return id
+	}
+	var object struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(raw, &object)
+	return object.ID
+}
+
+// postActorInbox は Follow, Undo, Like と投稿への返信の Create を受け付ける
+func postActorInbox(w http.ResponseWriter, r *http.Request) error {
+	u, ok := localActor(pat.Param(r, "accountName"))
+	if !cfg.ActivityPub.Enabled || !ok {
+		return notFound("error.not_found")
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, apMaxBody))
+	if err != nil {
+		return badRequest("error.bad_request")
+	}
+	signer, err := verifyRequest(r, body)
+	if err != nil {
+		return &httpError{Code: http.StatusUnauthorized, Message: "error.invalid_signature", Err: err}
+	}
+
+	activity := apActivity{}
+	if err := json.Unmarshal(body, &activity); err != nil {
+		return &httpError{Code: http.StatusBadRequest, Message: "error.bad_request", Err: err}
+	}
+	if activity.Actor != signer.ActorID {
+		err := fmt.Errorf("activitypub: actor %s does not match signer %s", activity.Actor, signer.ActorID)
+		return &httpError{Code: http.StatusUnauthorized, Message: "error.invalid_signature", Err: err}
+	}
+
+	err = handleActivity(u, signer, activity)
+	if err != nil {
+		return &httpError{Code: http.StatusBadRequest, Message: "error.bad_request", Err: err}
+	}
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+func handleActivity(u User, actor RemoteActor, activity apActivity) error {
+	switch activity.Type {
+	case "Follow":
+		if objectID(activity.Object) != actorURL(u.AccountName) {
+			return fmt.Errorf("activitypub: follow for unknown actor %q", objectID(activity.Object))
+		}
+		_, err := db.Exec("INSERT IGNORE INTO `ap_followers` (`user_id`, `actor_id`) VALUES (?,?)", u.ID, actor.ActorID)
+		if err != nil {
+			return err
+		}
+		follow, _ := json.Marshal(activity)
+		deliverAsync(u, []string{actor.Inbox}, apActivity{
+			Context: apContext,
+			ID:      actorURL(u.AccountName) + "#accepts/" + secureRandomStr(8),
+			Type:    "Accept",
+			Actor:   actorURL(u.AccountName),
+			Object:  follow,
+		})
+		return nil
+
+	case "Undo":
+		var inner apActivity
+		if err := json.Unmarshal(activity.Object, &inner); err != nil {
+			// IDだけの場合は Like の取り消しとして扱う
+			_, err := db.Exec("DELETE FROM `ap_likes` WHERE `actor_id` = ? AND `activity_id` = ?", actor.ActorID, objectID(activity.Object))
+			return err
+		}
+		if inner.Actor != "" && inner.Actor != actor.ActorID {
+			return errors.New("activitypub: cannot undo an activity of another actor")
+		}
+		switch inner.Type {
+		case "Follow":
+			_, err := db.Exec("DELETE FROM `ap_followers` WHERE `user_id` = ? AND `actor_id` = ?", u.ID, actor.ActorID)
+			return err
+		case "Like":
+			pid, _ := localPostID(objectID(inner.Object))
+			_, err := db.Exec("DELETE FROM `ap_likes` WHERE `actor_id` = ? AND (`activity_id` = ? OR `post_id` = ?)", actor.ActorID, inner.ID, pid)
+			return err
+		}
+		return nil
+
+	case "Like":
+		pid, ok := localPostID(objectID(activity.Object))
+		if !ok {
+			return nil
+		}
+		if _, ok := postMime.Load(pid); !ok {
+			return nil
+		}
+		_, err := db.Exec("INSERT IGNORE INTO `ap_likes` (`post_id`, `actor_id`, `activity_id`) VALUES (?,?,?)", pid, actor.ActorID, truncate(activity.ID, 512))
+		return err
+
+	case "Create":
+		note := apNote{}
+		if err := json.Unmarshal(activity.Object, &note); err != nil {
+			return err
+		}
+		pid, ok := localPostID(note.InReplyTo)
+		if note.Type != "Note" || !ok {
+			// 自分の投稿への返信以外は受け取らない
+			return nil
+		}
+		if note.AttributedTo != actor.ActorID {
+			return errors.New("activitypub: note is not attributed to the sender")
+		}
+		return addRemoteComment(actor, pid, note)
+	}
+	return nil
+}
+
+// addRemoteComment はリモートからの返信をコメントとして保存する
+func addRemoteComment(actor RemoteActor, pid int, note apNote) error {
+	if _, ok := count.Load(pid); !ok {
+		return nil
+	}
+	commenter, err := remoteActorUser(actor)
+	if err != nil {
+		return err
+	}
+	if commenter.DelFlg != 0 {
+		return nil
+	}
+
+	// 同じ返信が何度届いても1回だけ保存する
+	result, err := db.Exec("INSERT IGNORE INTO `ap_remote_comments` (`note_id`, `post_id`) VALUES (?,?)", truncate(note.ID, 512), pid)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil
+	}
+
+	comment := plainText(note.Content)
+	if comment == "" {
+		return nil
+	}
+	_, err = insertComment(context.Background(), pid, commenter.ID, comment)
+	return err
+}
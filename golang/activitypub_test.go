@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	goji "goji.io"
+)
+
+var apTestNow = time.Unix(1700000000, 0)
+
+// fakeRemoteServer は他のサーバーのふりをする
+// アクターの文書を返し、inbox に届いたリクエストを記録する
+type fakeRemoteServer struct {
+	srv     *httptest.Server
+	key     *rsa.PrivateKey
+	actorID string
+
+	mu       sync.Mutex
+	received []receivedDelivery
+}
+
+type receivedDelivery struct {
+	r    *http.Request
+	body []byte
+}
+
+func newFakeRemoteServer(t *testing.T) *fakeRemoteServer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}))
+	f := &fakeRemoteServer{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users/alice", func(w http.ResponseWriter, r *http.Request) {
+		writeActivityJSON(w, apActor{
+			Context:           []string{apContext, apSecContext},
+			ID:                f.actorID,
+			Type:              "Person",
+			PreferredUsername: "alice",
+			Inbox:             f.actorID + "/inbox",
+			PublicKey:         apPublicKey{ID: f.actorID + "#main-key", Owner: f.actorID, PublicKeyPem: publicPEM},
+		})
+	})
+	mux.HandleFunc("/users/alice/inbox", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		f.mu.Lock()
+		f.received = append(f.received, receivedDelivery{r: r.Clone(context.Background()), body: body})
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	})
+	// 既定のクライアントはループバックや https 以外に繋がないので TLS のサーバーとそのクライアントを使う
+	f.srv = httptest.NewTLSServer(mux)
+	f.actorID = f.srv.URL + "/users/alice"
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+// inboxRequest は key で署名した mary の inbox へのリクエストを作る。Date は signedAt にする
+func (f *fakeRemoteServer) inboxRequest(t *testing.T, activity interface{}, key *rsa.PrivateKey, signedAt time.Time) *http.Request {
+	t.Helper()
+	body, err := json.Marshal(activity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/@mary/inbox", bytes.NewReader(body))
+	r.Host = "iscogram.example"
+	r.Header.Set("Content-Type", apContentType)
+
+	clock := apClock
+	apClock = func() time.Time { return signedAt }
+	err = signRequest(r, body, f.actorID+"#main-key", key)
+	apClock = clock
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// activity は alice が送るアクティビティを作る
+func (f *fakeRemoteServer) activity(typ, id string, object interface{}) apActivity {
+	raw, err := json.Marshal(object)
+	if err != nil {
+		panic(err)
+	}
+	return apActivity{Context: apContext, ID: f.actorID + id, Type: typ, Actor: f.actorID, Object: raw}
+}
+
+func (f *fakeRemoteServer) deliveries() []receivedDelivery {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]receivedDelivery(nil), f.received...)
+}
+
+// fakeAPStore は ActivityPub の受信で使うテーブルの行
+type fakeAPStore struct {
+	mu         sync.Mutex
+	privateKey string
+	actors     map[string]RemoteActor
+	nextUserID int64
+	createdIDs []int
+	followers  map[string]bool
+	likes      map[string]int64
+	noteIDs    map[string]bool
+	comments   []fakeComment
+	// mary の投稿。新しい順
+	posts []Post
+}
+
+type fakeComment struct {
+	postID, userID int64
+	comment        string
+}
+
+func (s *fakeAPStore) query(query string, args []driver.Value) (fakeRows, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case strings.HasPrefix(query, "SELECT * FROM `users` WHERE `account_name` = ?"):
+		rows := fakeRows{Columns: []string{"id", "account_name", "passhash", "authority", "del_flg", "created_at"}}
+		if args[0] == "mary" {
+			rows.Rows = [][]driver.Value{{int64(1), "mary", "", int64(0), int64(0), time.Unix(0, 0)}}
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "SELECT `private_key_pem` FROM `ap_actor_keys`"):
+		rows := fakeRows{Columns: []string{"private_key_pem"}}
+		if s.privateKey != "" {
+			rows.Rows = [][]driver.Value{{s.privateKey}}
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "INSERT IGNORE INTO `ap_actor_keys`"):
+		if s.privateKey == "" {
+			s.privateKey = args[1].(string)
+		}
+		return fakeRows{RowsAffected: 1}, nil
+	case strings.HasPrefix(query, "SELECT * FROM `ap_remote_actors`"):
+		rows := fakeRows{Columns: []string{"actor_id", "user_id", "username", "inbox", "shared_inbox", "public_key_pem", "fetched_at"}}
+		if a, ok := s.actors[args[0].(string)]; ok {
+			rows.Rows = [][]driver.Value{{a.ActorID, int64(a.UserID), a.Username, a.Inbox, a.SharedInbox, a.PublicKeyPEM, a.FetchedAt}}
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "INSERT INTO `ap_remote_actors`"):
+		a := s.actors[args[0].(string)]
+		a.ActorID, a.Username, a.Inbox, a.SharedInbox, a.PublicKeyPEM = args[0].(string), args[1].(string), args[2].(string), args[3].(string), args[4].(string)
+		a.FetchedAt = args[5].(time.Time)
+		s.actors[a.ActorID] = a
+		return fakeRows{RowsAffected: 1}, nil
+	case strings.HasPrefix(query, "UPDATE `ap_remote_actors` SET `user_id`"):
+		a := s.actors[args[1].(string)]
+		a.UserID = int(args[0].(int64))
+		s.actors[a.ActorID] = a
+		return fakeRows{RowsAffected: 1}, nil
+	case strings.HasPrefix(query, "INSERT INTO `users`"):
+		s.nextUserID++
+		s.createdIDs = append(s.createdIDs, int(s.nextUserID))
+		return fakeRows{RowsAffected: 1, LastInsertID: s.nextUserID}, nil
+	case strings.HasPrefix(query, "INSERT IGNORE INTO `ap_followers`"):
+		s.followers[args[1].(string)] = true
+		return fakeRows{RowsAffected: 1}, nil
+	case strings.HasPrefix(query, "DELETE FROM `ap_followers`"):
+		delete(s.followers, args[1].(string))
+		return fakeRows{RowsAffected: 1}, nil
+	case strings.HasPrefix(query, "INSERT IGNORE INTO `ap_likes`"):
+		s.likes[args[2].(string)] = args[0].(int64)
+		return fakeRows{RowsAffected: 1}, nil
+	case strings.HasPrefix(query, "DELETE FROM `ap_likes`"):
+		for id, pid := range s.likes {
+			if id == args[1] || (len(args) > 2 && pid == args[2]) {
+				delete(s.likes, id)
+			}
+		}
+		return fakeRows{RowsAffected: 1}, nil
+	case strings.HasPrefix(query, "INSERT IGNORE INTO `ap_remote_comments`"):
+		if s.noteIDs[args[0].(string)] {
+			return fakeRows{}, nil
+		}
+		s.noteIDs[args[0].(string)] = true
+		return fakeRows{RowsAffected: 1}, nil
+	case strings.HasPrefix(query, "SELECT COUNT(*) FROM `posts` WHERE `user_id` = ?"):
+		return fakeRows{Columns: []string{"COUNT(*)"}, Rows: [][]driver.Value{{int64(len(s.posts))}}}, nil
+	case query == accountPostsQuery:
+		createdAt, id, limit := args[1].(time.Time), args[3].(int64), int(args[4].(int64))
+		rows := fakeRows{Columns: []string{"id", "user_id", "body", "mime", "created_at"}}
+		for _, p := range s.posts {
+			if len(rows.Rows) < limit && (p.CreatedAt.Before(createdAt) || (p.CreatedAt.Equal(createdAt) && int64(p.ID) < id)) {
+				rows.Rows = append(rows.Rows, []driver.Value{int64(p.ID), int64(p.UserID), p.Body, p.Mime, p.CreatedAt})
+			}
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "SELECT COUNT(*) FROM `ap_likes`"):
+		return fakeRows{Columns: []string{"COUNT(*)"}, Rows: [][]driver.Value{{int64(0)}}}, nil
+	case strings.HasPrefix(query, "INSERT INTO `comments`"):
+		s.comments = append(s.comments, fakeComment{args[0].(int64), args[1].(int64), args[2].(string)})
+		return fakeRows{RowsAffected: 1, LastInsertID: int64(len(s.comments))}, nil
+	}
+	return unknownQuery(query)
+}
+
+func setupActivityPub(t *testing.T) (*fakeRemoteServer, *fakeAPStore, http.Handler) {
+	t.Helper()
+	remote := newFakeRemoteServer(t)
+
+	oldConfig, oldBaseURL, oldClient, oldClock, oldBroker := cfg.ActivityPub, cfg.BaseURL, apHTTPClient, apClock, streamBroker
+	cfg.ActivityPub.Enabled = true
+	cfg.BaseURL = "https://iscogram.example"
+	apHTTPClient = remote.srv.Client()
+	apClock = func() time.Time { return apTestNow }
+	streamBroker = newMemoryBroker(cfg.Stream.Buffer)
+
+	s := &fakeAPStore{
+		actors:     map[string]RemoteActor{},
+		nextUserID: 2000,
+		followers:  map[string]bool{},
+		likes:      map[string]int64{},
+		noteIDs:    map[string]bool{},
+	}
+	useFakeDB(t, s.query)
+	t.Cleanup(func() {
+		// 配送が終わってから差し替えたものを戻す
+		apDeliveries.Wait()
+		cfg.ActivityPub, cfg.BaseURL, apHTTPClient, apClock, streamBroker = oldConfig, oldBaseURL, oldClient, oldClock, oldBroker
+		apKeys.Delete(1)
+		for _, id := range s.createdIDs {
+			userCache.Delete(id)
+			userCommentCache.Delete(id)
+		}
+	})
+
+	mux := goji.NewMux()
+	mux.Handle(Regexp(regexp.MustCompile(`^/@(?P<accountName>[a-zA-Z]+)/outbox$`)), handler(getActorOutbox))
+	mux.Handle(Regexp(regexp.MustCompile(`^/@(?P<accountName>[a-zA-Z]+)/inbox$`)), handler(postActorInbox))
+	return remote, s, mux
+}
+
+func postInbox(t *testing.T, h http.Handler, r *http.Request, want int) {
+	t.Helper()
+	w := doRequest(t, h, r, nil)
+	if w.Code != want {
+		t.Fatalf("POST %s: status %d, want %d: %s", r.URL, w.Code, want, w.Body)
+	}
+}
+
+// verifyDelivery は mary の鍵で署名された配送かを確かめる
+func verifyDelivery(t *testing.T, d receivedDelivery) {
+	t.Helper()
+	key, err := actorKey(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := map[string]string{}
+	for _, m := range signatureParamRegexp.FindAllStringSubmatch(d.r.Header.Get("Signature"), -1) {
+		params[m[1]] = m[2]
+	}
+	if params["keyId"] != actorURL("mary")+"#main-key" {
+		t.Errorf("keyId = %q", params["keyId"])
+	}
+	if d.r.Header.Get("Digest") != bodyDigest(d.body) {
+		t.Error("digest does not match the body")
+	}
+	if d.r.Header.Get("Date") != apTestNow.UTC().Format(http.TimeFormat) {
+		t.Errorf("Date = %q", d.r.Header.Get("Date"))
+	}
+	s, err := signingString(d.r, strings.Fields(params["headers"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(s))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+		t.Errorf("invalid signature: %v", err)
+	}
+}
+
+func TestInboxFollowDeliversAccept(t *testing.T) {
+	remote, s, h := setupActivityPub(t)
+
+	follow := remote.activity("Follow", "#follows/1", actorURL("mary"))
+	postInbox(t, h, remote.inboxRequest(t, follow, remote.key, apTestNow), http.StatusAccepted)
+	if !s.followers[remote.actorID] {
+		t.Fatal("follower was not stored")
+	}
+
+	if err := waitDeliveries(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	deliveries := remote.deliveries()
+	if len(deliveries) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(deliveries))
+	}
+	verifyDelivery(t, deliveries[0])
+	accept := apActivity{}
+	if err := json.Unmarshal(deliveries[0].body, &accept); err != nil {
+		t.Fatal(err)
+	}
+	if accept.Type != "Accept" || accept.Actor != actorURL("mary") || objectID(accept.Object) != follow.ID {
+		t.Errorf("unexpected accept %s", deliveries[0].body)
+	}
+
+	undo := remote.activity("Undo", "#follows/1/undo", follow)
+	postInbox(t, h, remote.inboxRequest(t, undo, remote.key, apTestNow), http.StatusAccepted)
+	if s.followers[remote.actorID] {
+		t.Error("follower was not removed by Undo")
+	}
+}
+
+func TestInboxLike(t *testing.T) {
+	remote, s, h := setupActivityPub(t)
+	postMime.Store(10, "image/jpeg")
+	t.Cleanup(func() { postMime.Delete(10) })
+
+	like := remote.activity("Like", "#likes/1", postURL(10))
+	postInbox(t, h, remote.inboxRequest(t, like, remote.key, apTestNow), http.StatusAccepted)
+	if s.likes[like.ID] != 10 {
+		t.Fatalf("likes = %v", s.likes)
+	}
+
+	// 知らない投稿への Like は受け取るだけで保存しない
+	postInbox(t, h, remote.inboxRequest(t, remote.activity("Like", "#likes/2", postURL(11)), remote.key, apTestNow), http.StatusAccepted)
+	if len(s.likes) != 1 {
+		t.Errorf("likes = %v", s.likes)
+	}
+
+	undo := remote.activity("Undo", "#likes/1/undo", like)
+	postInbox(t, h, remote.inboxRequest(t, undo, remote.key, apTestNow), http.StatusAccepted)
+	if len(s.likes) != 0 {
+		t.Errorf("like was not removed by Undo: %v", s.likes)
+	}
+}
+
+func TestInboxReplyCreatesComment(t *testing.T) {
+	remote, s, h := setupActivityPub(t)
+	count.Store(10, 2)
+	t.Cleanup(func() { count.Delete(10) })
+
+	note := apNote{
+		ID:           remote.actorID + "/notes/1",
+		Type:         "Note",
+		AttributedTo: remote.actorID,
+		Content:      "<p>nice &amp; <b>shiny</b></p>",
+		InReplyTo:    postURL(10),
+	}
+	create := remote.activity("Create", "/notes/1/activity", note)
+	// 同じ返信が2回届いてもコメントは1件
+	for i := 0; i < 2; i++ {
+		postInbox(t, h, remote.inboxRequest(t, create, remote.key, apTestNow), http.StatusAccepted)
+	}
+
+	if len(s.comments) != 1 {
+		t.Fatalf("got %d comments, want 1", len(s.comments))
+	}
+	if c := s.comments[0]; c.postID != 10 || c.comment != "nice & shiny" {
+		t.Errorf("unexpected comment %+v", c)
+	}
+	if len(s.createdIDs) != 1 || s.comments[0].userID != int64(s.createdIDs[0]) {
+		t.Errorf("comment by user %d, created users %v", s.comments[0].userID, s.createdIDs)
+	}
+	if n, _ := count.Load(10); n != 3 {
+		t.Errorf("comment count = %v, want 3", n)
+	}
+
+	// 他人の名前で書かれた返信は受け取らない
+	note.ID, note.AttributedTo = remote.actorID+"/notes/2", "https://elsewhere.example/users/eve"
+	forged := remote.activity("Create", "/notes/2/activity", note)
+	postInbox(t, h, remote.inboxRequest(t, forged, remote.key, apTestNow), http.StatusBadRequest)
+	if len(s.comments) != 1 {
+		t.Errorf("got %d comments, want 1", len(s.comments))
+	}
+}
+
+func TestInboxRejects(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		// 送る前にリクエストやアクティビティを書き換える
+		edit     func(r *http.Request)
+		actor    string
+		key      *rsa.PrivateKey
+		signedAt time.Time
+	}{
+		{name: "bad signature", key: otherKey},
+		{name: "stale date", signedAt: apTestNow.Add(-apSignatureSkew - time.Minute)},
+		{name: "future date", signedAt: apTestNow.Add(apSignatureSkew + time.Minute)},
+		{name: "digest mismatch", edit: func(r *http.Request) {
+			r.Body = ioutil.NopCloser(strings.NewReader(`{"type":"Follow"}`))
+		}},
+		{name: "unsigned", edit: func(r *http.Request) { r.Header.Del("Signature") }},
+		{name: "actor is not the signer", actor: "https://elsewhere.example/users/eve"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote, s, h := setupActivityPub(t)
+			follow := remote.activity("Follow", "#follows/1", actorURL("mary"))
+			if tt.actor != "" {
+				follow.Actor = tt.actor
+			}
+			key, signedAt := remote.key, apTestNow
+			if tt.key != nil {
+				key = tt.key
+			}
+			if !tt.signedAt.IsZero() {
+				signedAt = tt.signedAt
+			}
+			r := remote.inboxRequest(t, follow, key, signedAt)
+			if tt.edit != nil {
+				tt.edit(r)
+			}
+
+			postInbox(t, h, r, http.StatusUnauthorized)
+			if len(s.followers) != 0 {
+				t.Errorf("followers = %v", s.followers)
+			}
+			if err := waitDeliveries(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if n := len(remote.deliveries()); n != 0 {
+				t.Errorf("got %d deliveries, want 0", n)
+			}
+		})
+	}
+}
+
+func getOutbox(t *testing.T, h http.Handler, u string, v interface{}) {
+	t.Helper()
+	path := strings.TrimPrefix(u, cfg.BaseURL)
+	w := doRequest(t, h, httptest.NewRequest(http.MethodGet, path, nil), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s: status %d: %s", path, w.Code, w.Body)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// outbox は最初のページから next を辿ると全ての投稿を1回ずつ返す
+func TestOutboxPages(t *testing.T) {
+	_, s, h := setupActivityPub(t)
+	oldPerPage := cfg.PostsPerPage
+	cfg.PostsPerPage = 2
+	t.Cleanup(func() { cfg.PostsPerPage = oldPerPage })
+	for i := 0; i < 5; i++ {
+		// 2件ずつ同じ秒に投稿されたものとして、id で順序が決まることも確かめる
+		s.posts = append(s.posts, Post{ID: 10 - i, UserID: 1, Body: "post", Mime: "image/jpeg", CreatedAt: apTestNow.Add(-time.Duration(i/2) * time.Second)})
+	}
+
+	collection := apCollection{}
+	getOutbox(t, h, actorURL("mary")+"/outbox", &collection)
+	if collection.Type != "OrderedCollection" || collection.TotalItems != 5 || len(collection.OrderedItems) != 0 {
+		t.Fatalf("unexpected collection %+v", collection)
+	}
+
+	seen := []string{}
+	next := collection.First
+	for pages := 0; next != ""; pages++ {
+		if pages >= 5 {
+			t.Fatal("too many pages")
+		}
+		page := struct {
+			apCollectionPage
+			OrderedItems []apActivity `json:"orderedItems"`
+		}{}
+		getOutbox(t, h, next, &page)
+		if page.Type != "OrderedCollectionPage" || page.PartOf != actorURL("mary")+"/outbox" || page.ID != next {
+			t.Fatalf("unexpected page %+v", page.apCollectionPage)
+		}
+		for _, item := range page.OrderedItems {
+			seen = append(seen, objectID(item.Object))
+		}
+		next = page.Next
+	}
+
+	want := []string{postURL(10), postURL(9), postURL(8), postURL(7), postURL(6)}
+	if strings.Join(seen, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v, want %v", seen, want)
+	}
+}
+
+func TestDenyInternalAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		denied  bool
+	}{
+		{"127.0.0.1:443", true},
+		{"10.1.2.3:443", true},
+		{"169.254.169.254:80", true},
+		{"100.64.0.1:443", true},
+		{"100.127.255.254:443", true},
+		{"[::1]:443", true},
+		{"[fd00::1]:443", true},
+		{"[::ffff:127.0.0.1]:443", true},
+		{"[::ffff:8.8.8.8]:443", true},
+		{"8.8.8.8:443", false},
+		{"100.128.0.1:443", false},
+		{"[2001:4860:4860::8888]:443", false},
+	}
+	for _, tt := range tests {
+		err := denyInternalAddress("tcp", tt.address, nil)
+		if denied := err != nil; denied != tt.denied {
+			t.Errorf("denyInternalAddress(%s) = %v, want denied %v", tt.address, err, tt.denied)
+		}
+	}
+}
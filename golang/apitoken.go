@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	scopeRead    = "read"
+	scopePost    = "post"
+	scopeComment = "comment"
+	scopeAdmin   = "admin"
+
+	apiTokenPrefix = "isu_"
+)
+
+var apiTokenScopes = []string{scopeRead, scopePost, scopeComment, scopeAdmin}
+
+type APIToken struct {
+	ID         int            `db:"id"`
+	UserID     int            `db:"user_id"`
+	Name       string         `db:"name"`
+	TokenHash  string         `db:"token_hash"`
+	Scopes     string         `db:"scopes"`
+	CreatedAt  time.Time      `db:"created_at"`
+	LastUsedAt sql.NullTime   `db:"last_used_at"`
+	LastUsedIP sql.NullString `db:"last_used_ip"`
+	RevokedAt  sql.NullTime   `db:"revoked_at"`
+}
+
+func (t APIToken) ScopeList() []string {
+	return strings.Split(t.Scopes, ",")
+}
+
+func (t APIToken) HasScope(scope string) bool {
+	for _, s := range t.ScopeList() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type tokenAuthKey struct{}
+
+// tokenAuth は Authorization: Bearer で認証されたリクエストの情報
+type tokenAuth struct {
+	User  User
+	Token APIToken
+}
+
+func tokenAuthFrom(r *http.Request) (tokenAuth, bool) {
+	auth, ok := r.Context().Value(tokenAuthKey{}).(tokenAuth)
+	return auth, ok
+}
+
+func hashAPIToken(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(h[7:]), true
+}
+
+// requiredScope はトークンでアクセスするときに必要なスコープを返す
+// 設定画面などトークンから操作させたくないものは空文字を返す
+func requiredScope(r *http.Request) string {
+	p := r.URL.Path
+	switch {
+	case strings.HasPrefix(p, "/admin/"):
+		return scopeAdmin
+	case strings.HasPrefix(p, "/settings") || strings.HasPrefix(p, "/login") ||
+		strings.HasPrefix(p, "/register") || strings.HasPrefix(p, "/logout") ||
+		strings.HasPrefix(p, "/password"):
+		return ""
+	case isSafeMethod(r.Method):
+		return scopeRead
+	case p == "/":
+		return scopePost
+	case p == "/comment":
+		return scopeComment
+	}
+	return ""
+}
+
+func writeTokenError(w http.ResponseWriter, code int, errCode, description string) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error=%q, error_description=%q`, errCode, description))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": errCode, "error_description": description})
+}
+
+// bearerAuth は Authorization: Bearer のトークンを検証し、トークンの持ち主としてリクエストを処理させる
+// トークンにはスコープがあり、足りない操作は403を返す
+func bearerAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := bearerToken(r)
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		t := APIToken{}
+		err := db.Get(&t, "SELECT * FROM `api_tokens` WHERE `token_hash` = ? AND `revoked_at` IS NULL", hashAPIToken(token))
+		if err != nil {
+			writeTokenError(w, http.StatusUnauthorized, "invalid_token", "the access token is invalid or revoked")
+			return
+		}
+		value, ok := userCache.Load(t.UserID)
+		if !ok {
+			writeTokenError(w, http.StatusUnauthorized, "invalid_token", "the access token is invalid or revoked")
+			return
+		}
+		u := value.(User)
+		if u.DelFlg != 0 {
+			writeTokenError(w, http.StatusUnauthorized, "invalid_token", "the access token is invalid or revoked")
+			return
+		}
+
+		scope := requiredScope(r)
+		if scope == "" || !t.HasScope(scope) || (scope == scopeAdmin && u.Authority == 0) {
+			writeTokenError(w, http.StatusForbidden, "insufficient_scope", "the access token does not allow this request")
+			return
+		}
+
+		// 最終利用日時は1分に1回だけ更新する
+		_, err = db.Exec(
+			"UPDATE `api_tokens` SET `last_used_at` = NOW(), `last_used_ip` = ? WHERE `id` = ? AND (`last_used_at` IS NULL OR `last_used_at` < NOW() - INTERVAL 1 MINUTE)",
+			truncate(clientIP(r), 64), t.ID,
+		)
+		if err != nil {
+			logError(r, err)
+		}
+
+		ctx := context.WithValue(r.Context(), tokenAuthKey{}, tokenAuth{User: u, Token: t})
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func getSettingsTokens(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	return renderTokensPage(w, r, me, "", getFlash(w, r, "notice"))
+}
+
+func renderTokensPage(w http.ResponseWriter, r *http.Request, me User, newToken, flash string) error {
+	tokens := []APIToken{}
+	err := db.SelectContext(r.Context(), &tokens, "SELECT * FROM `api_tokens` WHERE `user_id` = ? AND `revoked_at` IS NULL ORDER BY `created_at` DESC", me.ID)
+	if err != nil {
+		return err
+	}
+
+	scopes := apiTokenScopes
+	if me.Authority == 0 {
+		scopes = scopes[:len(scopes)-1]
+	}
+
+	return renderTemplate(r.Context(), w, "tokens", struct {
+		Tokens    []APIToken
+		Scopes    []string
+		NewToken  string
+		Me        User
+		CSRFToken string
+		Flash     string
+	}{tokens, scopes, newToken, me, getCSRFToken(r), flash})
+}
+
+// 新しいトークンを発行する。平文のトークンはこのときに一度だけ表示する
+func postSettingsTokens(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		return badRequest("error.bad_request")
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	scopes := []string{}
+	for _, s := range r.Form["scopes[]"] {
+		for _, allowed := range apiTokenScopes {
+			if s == allowed && (s != scopeAdmin || me.Authority != 0) {
+				scopes = append(scopes, s)
+			}
+		}
+	}
+	if name == "" || len(name) > 64 || len(scopes) == 0 {
+		session := getSession(r)
+		session.Values["notice"] = tr(r, "flash.invalid_token_request")
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/settings/tokens", http.StatusFound)
+		return nil
+	}
+
+	token := apiTokenPrefix + secureRandomStr(20)
+	_, err = db.ExecContext(
+		r.Context(),
+		"INSERT INTO `api_tokens` (`user_id`, `name`, `token_hash`, `scopes`) VALUES (?,?,?,?)",
+		me.ID, name, hashAPIToken(token), strings.Join(scopes, ","),
+	)
+	if err != nil {
+		return err
+	}
+
+	return renderTokensPage(w, r, me, token, tr(r, "flash.token_created"))
+}
+
+func postSettingsTokensRevoke(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		return badRequest("error.bad_request")
+	}
+
+	_, err = db.ExecContext(r.Context(), "UPDATE `api_tokens` SET `revoked_at` = NOW() WHERE `id` = ? AND `user_id` = ? AND `revoked_at` IS NULL", id, me.ID)
+	if err != nil {
+		return err
+	}
+
+	session := getSession(r)
+	session.Values["notice"] = tr(r, "flash.token_revoked")
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/settings/tokens", http.StatusFound)
+	return nil
+}
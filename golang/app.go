@@ -9,11 +9,10 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
-	"path"
 	"regexp"
 	"strconv"
 	"strings"
@@ -23,30 +22,41 @@ import (
 	_ "net/http/pprof"
 
 	"github.com/bradfitz/gomemcache/memcache"
-	gsm "github.com/bradleypeabody/gorilla-sessions-memcache"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/sessions"
 	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	goji "goji.io"
 	"goji.io/pat"
 	"goji.io/pattern"
 )
 
 var (
-	db               *sqlx.DB
-	store            *gsm.MemcacheStore
-	count            sync.Map
-	postMime         sync.Map
-	tplCache         sync.Map
-	userCache        sync.Map
-	userCommentCache sync.Map
-	fmap             = template.FuncMap{"imageURL": imageURL}
+	cfg              Config
+	db               *instrumentedDB
+	memcacheClient   *memcache.Client
+	store            *sessionStore
+	count            = cache{name: "post_comment_count"}
+	postMime         = cache{name: "post_mime"}
+	userCache        = cache{name: "users"}
+	userCommentCache = cache{name: "user_comment_count"}
+	// コメントの書き込みとコメント数のキャッシュの更新は RLock で並行に行い、
+	// DBの値でキャッシュを直す runReconcileCounts は Lock で割り込ませない
+	commentCountsMu sync.RWMutex
+	fmap            = template.FuncMap{"imageURL": imageURL}
+)
+
+// タイムラインとユーザーページの投稿一覧。フィードも同じ一覧を返す
+const (
+	// created_at が同じ投稿は id で並べる。カーソルより後ろだけを返す
+	indexPostsQuery   = "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `user_del_flg` = 0 AND (`created_at` < ? OR (`created_at` = ? AND `id` < ?)) ORDER BY `created_at` DESC, `id` DESC LIMIT ?"
+	accountPostsQuery = "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `user_id` = ? AND (`created_at` < ? OR (`created_at` = ? AND `id` < ?)) ORDER BY `created_at` DESC, `id` DESC LIMIT ?"
 )
 
 const (
-	postsPerPage  = 20
 	ISO8601Format = "2006-01-02T15:04:05-07:00"
-	UploadLimit   = 10 * 1024 * 1024 // 10mb
 )
 
 type User struct {
@@ -81,12 +91,6 @@ type Comment struct {
 }
 
 func init() {
-	memdAddr := os.Getenv("ISUCONP_MEMCACHED_ADDRESS")
-	if memdAddr == "" {
-		memdAddr = "localhost:11211"
-	}
-	memcacheClient := memcache.New(memdAddr)
-	store = gsm.NewMemcacheStore(memcacheClient, "iscogram_", []byte("sendagaya"))
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 }
 
@@ -95,6 +99,20 @@ func dbInitialize() {
 		"DELETE FROM users WHERE id > 1000",
 		"DELETE FROM posts WHERE id > 10000",
 		"DELETE FROM comments WHERE id > 100000",
+		"DELETE FROM user_sessions WHERE user_id > 1000",
+		"DELETE FROM user_upload_usage",
+		"DELETE FROM user_emails WHERE user_id > 1000",
+		"DELETE FROM user_locales WHERE user_id > 1000",
+		"DELETE FROM password_reset_tokens WHERE user_id > 1000",
+		"DELETE FROM api_tokens WHERE user_id > 1000",
+		"DELETE FROM user_identities WHERE user_id > 1000",
+		"DELETE FROM ap_actor_keys WHERE user_id > 1000",
+		"DELETE FROM ap_remote_actors",
+		"DELETE FROM ap_followers",
+		"DELETE FROM ap_likes",
+		"DELETE FROM ap_remote_comments",
+		"DELETE FROM webhook_deliveries",
+		"DELETE FROM jobs",
 		"UPDATE users SET del_flg = 0",
 		"UPDATE users SET del_flg = 1 WHERE id % 50 = 0",
 		"UPDATE posts SET user_del_flg = 0",
@@ -122,7 +140,7 @@ func tryLogin(accountName, password string) *User {
 
 func validateUser(accountName, password string) bool {
 	return regexp.MustCompile(`\A[0-9a-zA-Z_]{3,}\z`).MatchString(accountName) &&
-		regexp.MustCompile(`\A[0-9a-zA-Z_]{6,}\z`).MatchString(password)
+		validatePassword(password)
 }
 
 // 今回のGo実装では言語側のエスケープの仕組みが使えないのでOSコマンドインジェクション対策できない
@@ -136,7 +154,7 @@ func digest(src string) string {
 	// opensslのバージョンによっては (stdin)= というのがつくので取る
 	out, err := exec.Command("/bin/bash", "-c", `printf "%s" `+escapeshellarg(src)+` | openssl dgst -sha512 | sed 's/^.*= //'`).Output()
 	if err != nil {
-		log.Print(err)
+		slog.Error("digest failed", slog.Any("err", err))
 		return ""
 	}
 
@@ -152,12 +170,17 @@ func calculatePasshash(accountName, password string) string {
 }
 
 func getSession(r *http.Request) *sessions.Session {
-	session, _ := store.Get(r, "isuconp-go.session")
+	session, _ := store.Get(r, sessionName)
 
 	return session
 }
 
 func getSessionUser(r *http.Request) User {
+	if auth, ok := tokenAuthFrom(r); ok {
+		requestInfoFrom(r).UserID = auth.User.ID
+		return auth.User
+	}
+
 	session := getSession(r)
 	uid, ok := session.Values["user_id"]
 	if !ok || uid == nil {
@@ -169,6 +192,7 @@ func getSessionUser(r *http.Request) User {
 		return User{}
 	}
 	u := value.(User)
+	requestInfoFrom(r).UserID = u.ID
 
 	// u := User{}
 
@@ -193,60 +217,18 @@ func getFlash(w http.ResponseWriter, r *http.Request, key string) string {
 	}
 }
 
-func makePosts(results []Post, csrfToken string) ([]Post, error) {
-	posts := make([]Post, 0, postsPerPage)
+func makePosts(ctx context.Context, results []Post, csrfToken string) ([]Post, error) {
+	ctx, span := tracer.Start(ctx, "makePosts", trace.WithAttributes(attribute.Int("posts", len(results))))
+	defer span.End()
 
-	for _, p := range results {
-		// TODO: キャッシュする
-		// err := db.Get(&p.CommentCount, "SELECT COUNT(*) AS `count` FROM `comments` WHERE `post_id` = ?", p.ID)
-		// if err != nil {
-		// 	return nil, err
-		// }
-		value, ok := count.Load(p.ID)
-		if !ok {
-			return nil, errors.New("cannot load post's comment count")
-		}
-		p.CommentCount, ok = value.(int)
-		if !ok {
-			return nil, errors.New("failed to type assertion of comment count")
-		}
+	posts := make([]Post, 0, cfg.PostsPerPage)
 
-		query := "SELECT `comment`, `user_id` FROM `comments` WHERE `post_id` = ? ORDER BY `created_at` DESC LIMIT 3"
-		var comments []Comment
-		err := db.Select(&comments, query, p.ID)
+	for _, p := range results {
+		p, err := makePost(ctx, p, csrfToken)
 		if err != nil {
 			return nil, err
 		}
 
-		for _, comment := range comments {
-			value, ok := userCache.Load(comment.UserID)
-			if !ok {
-				return nil, errors.New("cannot load comment's user")
-			}
-			comment.User = value.(User)
-		}
-
-		// for i := 0; i < len(comments); i++ {
-		// 	err := db.Get(&comments[i].User, "SELECT * FROM `users` WHERE `id` = ?", comments[i].UserID)
-		// 	if err != nil {
-		// 		return nil, err
-		// 	}
-		// }
-
-		// reverse
-		for i, j := 0, len(comments)-1; i < j; i, j = i+1, j-1 {
-			comments[i], comments[j] = comments[j], comments[i]
-		}
-
-		p.Comments = comments
-
-		// err = db.Get(&p.User, "SELECT * FROM `users` WHERE `id` = ?", p.UserID)
-		// if err != nil {
-		// 	return nil, err
-		// }
-
-		p.CSRFToken = csrfToken
-
 		posts = append(posts, p)
 		// if p.User.DelFlg == 0 {
 		// 	posts = append(posts, p)
@@ -259,6 +241,64 @@ func makePosts(results []Post, csrfToken string) ([]Post, error) {
 	return posts, nil
 }
 
+// makePost は投稿1件分のコメント数と最新のコメントを埋める。1件ごとにスパンを作る
+func makePost(ctx context.Context, p Post, csrfToken string) (Post, error) {
+	ctx, span := tracer.Start(ctx, "makePost", trace.WithAttributes(attribute.Int("post.id", p.ID)))
+	defer span.End()
+
+	// TODO: キャッシュする
+	// err := db.Get(&p.CommentCount, "SELECT COUNT(*) AS `count` FROM `comments` WHERE `post_id` = ?", p.ID)
+	// if err != nil {
+	// 	return nil, err
+	// }
+	value, ok := count.Load(p.ID)
+	if !ok {
+		return p, errors.New("cannot load post's comment count")
+	}
+	p.CommentCount, ok = value.(int)
+	if !ok {
+		return p, errors.New("failed to type assertion of comment count")
+	}
+
+	query := "SELECT `comment`, `user_id` FROM `comments` WHERE `post_id` = ? ORDER BY `created_at` DESC LIMIT 3"
+	var comments []Comment
+	err := db.SelectContext(ctx, &comments, query, p.ID)
+	if err != nil {
+		return p, err
+	}
+
+	for _, comment := range comments {
+		value, ok := userCache.Load(comment.UserID)
+		if !ok {
+			return p, errors.New("cannot load comment's user")
+		}
+		comment.User = value.(User)
+	}
+
+	// for i := 0; i < len(comments); i++ {
+	// 	err := db.Get(&comments[i].User, "SELECT * FROM `users` WHERE `id` = ?", comments[i].UserID)
+	// 	if err != nil {
+	// 		return nil, err
+	// 	}
+	// }
+
+	// reverse
+	for i, j := 0, len(comments)-1; i < j; i, j = i+1, j-1 {
+		comments[i], comments[j] = comments[j], comments[i]
+	}
+
+	p.Comments = comments
+
+	// err = db.Get(&p.User, "SELECT * FROM `users` WHERE `id` = ?", p.UserID)
+	// if err != nil {
+	// 	return nil, err
+	// }
+
+	p.CSRFToken = csrfToken
+
+	return p, nil
+}
+
 func imageURL(p Post) string {
 	ext := ""
 	if p.Mime == "image/jpeg" {
@@ -276,13 +316,14 @@ func isLogin(u User) bool {
 	return u.ID != 0
 }
 
+// getCSRFToken はフォームに埋め込むためのマスクしたCSRFトークンを返す
+// 検証は csrfProtection がまとめて行う
 func getCSRFToken(r *http.Request) string {
-	session := getSession(r)
-	csrfToken, ok := session.Values["csrf_token"]
-	if !ok {
+	secret := csrfSecret(r)
+	if secret == "" {
 		return ""
 	}
-	return csrfToken.(string)
+	return maskCSRFToken(secret)
 }
 
 func secureRandomStr(b int) string {
@@ -293,75 +334,105 @@ func secureRandomStr(b int) string {
 	return fmt.Sprintf("%x", k)
 }
 
-func getTemplPath(filename string) string {
-	return path.Join("templates", filename)
-}
-
-func getInitialize(w http.ResponseWriter, r *http.Request) {
+func getInitialize(w http.ResponseWriter, r *http.Request) error {
 	dbInitialize()
 	w.WriteHeader(http.StatusOK)
+	return nil
 }
 
-func getLogin(w http.ResponseWriter, r *http.Request) {
+func getLogin(w http.ResponseWriter, r *http.Request) error {
 	me := getSessionUser(r)
 
 	if isLogin(me) {
 		http.Redirect(w, r, "/", http.StatusFound)
-		return
+		return nil
 	}
 
-	template.Must(template.ParseFiles(
-		getTemplPath("layout.html"),
-		getTemplPath("login.html")),
-	).Execute(w, struct {
-		Me    User
-		Flash string
-	}{me, getFlash(w, r, "notice")})
+	return renderTemplate(r.Context(), w, "login", struct {
+		Me        User
+		CSRFToken string
+		Flash     string
+		Captcha   template.HTML
+		OIDC      OIDCConfig
+	}{me, getCSRFToken(r), getFlash(w, r, "notice"), captchaWidget(r), cfg.OIDC})
 }
 
-func postLogin(w http.ResponseWriter, r *http.Request) {
+func postLogin(w http.ResponseWriter, r *http.Request) error {
 	if isLogin(getSessionUser(r)) {
 		http.Redirect(w, r, "/", http.StatusFound)
-		return
+		return nil
 	}
 
-	u := tryLogin(r.FormValue("account_name"), r.FormValue("password"))
+	accountName, ip := r.FormValue("account_name"), clientIP(r)
 
-	if u != nil {
+	if _, locked := loginLockedUntil(accountName, ip); locked || !allowLoginAttempt(accountName, ip) {
+		requestLogger(r).Warn("login rejected", slog.String("account", accountName), slog.String("ip", ip))
 		session := getSession(r)
-		session.Values["user_id"] = u.ID
-		session.Values["csrf_token"] = secureRandomStr(16)
+		session.Values["notice"] = tr(r, "flash.too_many_logins")
 		session.Save(r, w)
 
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	if captcha.Required(loginFailures(accountName)) && !captcha.Verify(r) {
+		session := getSession(r)
+		session.Values["notice"] = tr(r, "flash.captcha_failed")
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	u := tryLogin(accountName, r.FormValue("password"))
+
+	if u != nil {
+		resetLoginFailures(accountName)
+		if isTOTPEnabled(u.ID) {
+			err := beginPending2FA(w, r, u.ID)
+			if err != nil {
+				return err
+			}
+
+			http.Redirect(w, r, "/login/2fa", http.StatusFound)
+			return nil
+		}
+
+		err := startUserSession(w, r, u.ID)
+		if err != nil {
+			return err
+		}
+
 		http.Redirect(w, r, "/", http.StatusFound)
 	} else {
+		recordLoginFailure(accountName, ip)
+
 		session := getSession(r)
-		session.Values["notice"] = "アカウント名かパスワードが間違っています"
+		session.Values["notice"] = tr(r, "flash.wrong_credentials")
 		session.Save(r, w)
 
 		http.Redirect(w, r, "/login", http.StatusFound)
 	}
+	return nil
 }
 
-func getRegister(w http.ResponseWriter, r *http.Request) {
+func getRegister(w http.ResponseWriter, r *http.Request) error {
 	if isLogin(getSessionUser(r)) {
 		http.Redirect(w, r, "/", http.StatusFound)
-		return
+		return nil
 	}
 
-	template.Must(template.ParseFiles(
-		getTemplPath("layout.html"),
-		getTemplPath("register.html")),
-	).Execute(w, struct {
-		Me    User
-		Flash string
-	}{User{}, getFlash(w, r, "notice")})
+	return renderTemplate(r.Context(), w, "register", struct {
+		Me        User
+		CSRFToken string
+		Flash     string
+	}{User{}, getCSRFToken(r), getFlash(w, r, "notice")})
 }
 
-func postRegister(w http.ResponseWriter, r *http.Request) {
+func postRegister(w http.ResponseWriter, r *http.Request) error {
 	if isLogin(getSessionUser(r)) {
 		http.Redirect(w, r, "/", http.StatusFound)
-		return
+		return nil
 	}
 
 	accountName, password := r.FormValue("account_name"), r.FormValue("password")
@@ -369,42 +440,41 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 	validated := validateUser(accountName, password)
 	if !validated {
 		session := getSession(r)
-		session.Values["notice"] = "アカウント名は3文字以上、パスワードは6文字以上である必要があります"
+		session.Values["notice"] = tr(r, "flash.invalid_registration")
 		session.Save(r, w)
 
 		http.Redirect(w, r, "/register", http.StatusFound)
-		return
+		return nil
 	}
 
 	exists := 0
 	// ユーザーが存在しない場合はエラーになるのでエラーチェックはしない
-	db.Get(&exists, "SELECT 1 FROM users WHERE `account_name` = ?", accountName)
+	db.GetContext(r.Context(), &exists, "SELECT 1 FROM users WHERE `account_name` = ?", accountName)
 
 	if exists == 1 {
 		session := getSession(r)
-		session.Values["notice"] = "アカウント名がすでに使われています"
+		session.Values["notice"] = tr(r, "flash.account_name_taken")
 		session.Save(r, w)
 
 		http.Redirect(w, r, "/register", http.StatusFound)
-		return
+		return nil
 	}
 
+	// 書き込んだのにキャッシュに載らないことがないよう、クライアントが切断しても止めない
 	query := "INSERT INTO `users` (`account_name`, `passhash`) VALUES (?,?)"
-	result, err := db.Exec(query, accountName, calculatePasshash(accountName, password))
+	result, err := db.ExecContext(context.WithoutCancel(r.Context()), query, accountName, calculatePasshash(accountName, password))
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 
-	session := getSession(r)
 	uid, err := result.LastInsertId()
 	if err != nil {
-		log.Print(err)
-		return
+		return err
+	}
+	err = startUserSession(w, r, int(uid))
+	if err != nil {
+		return err
 	}
-	session.Values["user_id"] = int(uid)
-	session.Values["csrf_token"] = secureRandomStr(16)
-	session.Save(r, w)
 
 	userCache.Store(int(uid), User{
 		ID:          int(uid),
@@ -415,98 +485,83 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 	userCommentCache.Store(int(uid), 0)
 
 	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
 }
 
-func getLogout(w http.ResponseWriter, r *http.Request) {
-	session := getSession(r)
-	delete(session.Values, "user_id")
-	session.Options = &sessions.Options{MaxAge: -1}
-	session.Save(r, w)
+func getLogout(w http.ResponseWriter, r *http.Request) error {
+	destroySession(w, r)
 
 	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
 }
 
-func getIndex(w http.ResponseWriter, r *http.Request) {
+func getIndex(w http.ResponseWriter, r *http.Request) error {
 	me := getSessionUser(r)
 
-	posts := []Post{}
-
-	err := db.Select(&posts, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `user_del_flg` = 0 ORDER BY `created_at` DESC LIMIT ?", postsPerPage)
+	c, err := requestCursor(r)
 	if err != nil {
-		log.Print(err)
-		return
+		return badRequest("error.bad_request")
 	}
+	posts, next, err := timelinePage(r.Context(), c)
+	if err != nil {
+		return err
+	}
+	setNextLink(w, "/posts", next)
 
-	posts, err = makePosts(posts, getCSRFToken(r))
+	posts, err = makePosts(r.Context(), posts, getCSRFToken(r))
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 
 	for i := range posts {
 		value, ok := userCache.Load(posts[i].UserID)
 		if !ok {
-			log.Print(err)
-			return
+			return fmt.Errorf("user %d is not in the cache", posts[i].UserID)
 		}
 		user := value.(User)
 		posts[i].User = user
 	}
 
-	value, ok := tplCache.Load("getIndex")
-	if ok {
-		tpl := value.(*template.Template)
-		tpl.Execute(w, struct {
-			Posts     []Post
-			Me        User
-			CSRFToken string
-			Flash     string
-		}{posts, me, getCSRFToken(r), getFlash(w, r, "notice")})
-		return
-	}
-
-	tpl := template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
-		getTemplPath("layout.html"),
-		getTemplPath("index.html"),
-		getTemplPath("posts.html"),
-		getTemplPath("post.html"),
-	))
-	tpl.Execute(w, struct {
-		Posts     []Post
-		Me        User
-		CSRFToken string
-		Flash     string
-	}{posts, me, getCSRFToken(r), getFlash(w, r, "notice")})
-	tplCache.Store("getIndex", tpl)
+	return renderTemplate(r.Context(), w, "index", struct {
+		Posts      []Post
+		NextCursor string
+		Me         User
+		CSRFToken  string
+		Flash      string
+	}{posts, next, me, getCSRFToken(r), getFlash(w, r, "notice")})
 }
 
-func getAccountName(w http.ResponseWriter, r *http.Request) {
+func getAccountName(w http.ResponseWriter, r *http.Request) error {
 	accountName := pat.Param(r, "accountName")
 	user := User{}
 
-	err := db.Get(&user, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", accountName)
+	err := db.GetContext(r.Context(), &user, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", accountName)
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 
 	if user.ID == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		return
+		return notFound("error.not_found")
 	}
 
-	results := []Post{}
+	if cfg.ActivityPub.Enabled && wantsActivityJSON(r) {
+		serveActor(w, user)
+		return nil
+	}
 
-	err = db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `user_id` = ? ORDER BY `created_at` DESC LIMIT ?", user.ID, postsPerPage)
+	c, err := requestCursor(r)
 	if err != nil {
-		log.Print(err)
-		return
+		return badRequest("error.bad_request")
 	}
+	results, next, err := accountPostsPage(r.Context(), user.ID, c)
+	if err != nil {
+		return err
+	}
+	setNextLink(w, "/@"+user.AccountName+"/posts", next)
 
-	posts, err := makePosts(results, getCSRFToken(r))
+	posts, err := makePosts(r.Context(), results, getCSRFToken(r))
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 	for i := range posts {
 		posts[i].User = user
@@ -514,8 +569,7 @@ func getAccountName(w http.ResponseWriter, r *http.Request) {
 
 	value, ok := userCommentCache.Load(user.ID)
 	if !ok {
-		log.Print(err)
-		return
+		return fmt.Errorf("comment count of user %d is not in the cache", user.ID)
 	}
 	commentCount := value.(int)
 
@@ -527,10 +581,9 @@ func getAccountName(w http.ResponseWriter, r *http.Request) {
 	// }
 
 	postIDs := []int{}
-	err = db.Select(&postIDs, "SELECT `id` FROM `posts` WHERE `user_id` = ?", user.ID)
+	err = db.SelectContext(r.Context(), &postIDs, "SELECT `id` FROM `posts` WHERE `user_id` = ?", user.ID)
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 	postCount := len(postIDs)
 
@@ -538,8 +591,7 @@ func getAccountName(w http.ResponseWriter, r *http.Request) {
 	for _, postID := range postIDs {
 		value, ok := count.Load(postID)
 		if !ok {
-			log.Print(err)
-			return
+			return fmt.Errorf("comment count of post %d is not in the cache", postID)
 		}
 		commentCount += value.(int)
 	}
@@ -565,129 +617,120 @@ func getAccountName(w http.ResponseWriter, r *http.Request) {
 
 	me := getSessionUser(r)
 
-	value, ok = tplCache.Load("getAccountName")
-	if ok {
-		tpl := value.(*template.Template)
-		tpl.Execute(w, struct {
-			Posts          []Post
-			User           User
-			PostCount      int
-			CommentCount   int
-			CommentedCount int
-			Me             User
-		}{posts, user, postCount, commentCount, commentedCount, me})
-		return
-	}
-
-	tpl := template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
-		getTemplPath("layout.html"),
-		getTemplPath("user.html"),
-		getTemplPath("posts.html"),
-		getTemplPath("post.html"),
-	))
-	tpl.Execute(w, struct {
+	return renderTemplate(r.Context(), w, "user", struct {
 		Posts          []Post
+		NextCursor     string
 		User           User
 		PostCount      int
 		CommentCount   int
 		CommentedCount int
 		Me             User
-	}{posts, user, postCount, commentCount, commentedCount, me})
-	tplCache.Store("getAccountName", tpl)
+	}{posts, next, user, postCount, commentCount, commentedCount, me})
 }
 
-func getPosts(w http.ResponseWriter, r *http.Request) {
-	m, err := url.ParseQuery(r.URL.RawQuery)
+func getPosts(w http.ResponseWriter, r *http.Request) error {
+	c, err := requestCursor(r)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Print(err)
-		return
-	}
-	maxCreatedAt := m.Get("max_created_at")
-	if maxCreatedAt == "" {
-		return
+		return badRequest("error.bad_request")
 	}
 
-	t, err := time.Parse(ISO8601Format, maxCreatedAt)
-	if err != nil {
-		log.Print(err)
-		return
-	}
-
-	results := []Post{}
-	err = db.Select(&results, "SELECT `id`, `body`, `mime`, `created_at`, `user_id` FROM `posts` WHERE `created_at` <= ? AND `user_del_flg` = 0 ORDER BY `created_at` DESC  LIMIT ?", t.Format(ISO8601Format), postsPerPage)
+	results, next, err := timelinePage(r.Context(), c)
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 
-	posts, err := makePosts(results, getCSRFToken(r))
+	posts, err := makePosts(r.Context(), results, getCSRFToken(r))
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 
 	for i := range posts {
 		value, ok := userCache.Load(posts[i].UserID)
 		if !ok {
-			log.Print(err)
-			return
+			return fmt.Errorf("user %d is not in the cache", posts[i].UserID)
 		}
 		user := value.(User)
 		posts[i].User = user
 	}
 
 	if len(posts) == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		return
+		return notFound("error.not_found")
 	}
 
-	value, ok := tplCache.Load("getPosts")
-	if ok {
-		tpl := value.(*template.Template)
-		tpl.Execute(w, posts)
-		return
+	setNextLink(w, "/posts", next)
+	return renderPosts(r.Context(), w, posts)
+}
+
+// getAccountNamePosts はユーザーページの続きを返す
+func getAccountNamePosts(w http.ResponseWriter, r *http.Request) error {
+	user := User{}
+	err := db.GetContext(r.Context(), &user, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", pat.Param(r, "accountName"))
+	if err != nil {
+		return notFound("error.not_found")
 	}
 
-	tpl := template.Must(template.New("posts.html").Funcs(fmap).ParseFiles(
-		getTemplPath("posts.html"),
-		getTemplPath("post.html"),
-	))
-	tpl.Execute(w, posts)
-	tplCache.Store("getPosts", tpl)
+	c, err := requestCursor(r)
+	if err != nil {
+		return badRequest("error.bad_request")
+	}
+
+	results, next, err := accountPostsPage(r.Context(), user.ID, c)
+	if err != nil {
+		return err
+	}
+
+	posts, err := makePosts(r.Context(), results, getCSRFToken(r))
+	if err != nil {
+		return err
+	}
+	for i := range posts {
+		posts[i].User = user
+	}
+
+	if len(posts) == 0 {
+		return notFound("error.not_found")
+	}
+
+	setNextLink(w, "/@"+user.AccountName+"/posts", next)
+	return renderPosts(r.Context(), w, posts)
 }
 
-func getPostsID(w http.ResponseWriter, r *http.Request) {
+// renderPosts は「もっと見る」で追加する投稿だけのHTMLを書き出す
+func renderPosts(ctx context.Context, w http.ResponseWriter, posts []Post) error {
+	return renderTemplate(ctx, w, "posts", posts)
+}
+
+func getPostsID(w http.ResponseWriter, r *http.Request) error {
 	pidStr := pat.Param(r, "id")
 	pid, err := strconv.Atoi(pidStr)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		return
+		return notFound("error.not_found")
 	}
 
 	results := []Post{}
-	err = db.Select(&results, "SELECT `id`, `body`, `mime`, `created_at`, `user_id` FROM `posts` WHERE `id` = ? AND `user_del_flg` = 0 LIMIT 1", pid)
+	err = db.SelectContext(r.Context(), &results, "SELECT `id`, `body`, `mime`, `created_at`, `user_id` FROM `posts` WHERE `id` = ? AND `user_del_flg` = 0 LIMIT 1", pid)
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 
 	if len(results) == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		return
+		return notFound("error.not_found")
 	}
 
-	posts, err := makePosts(results, getCSRFToken(r))
+	if cfg.ActivityPub.Enabled && wantsActivityJSON(r) {
+		servePostNote(w, results[0])
+		return nil
+	}
+
+	posts, err := makePosts(r.Context(), results, getCSRFToken(r))
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 
 	for i := range posts {
 		value, ok := userCache.Load(posts[i].UserID)
 		if !ok {
-			log.Print(err)
-			return
+			return fmt.Errorf("user %d is not in the cache", posts[i].UserID)
 		}
 		user := value.(User)
 		posts[i].User = user
@@ -702,36 +745,28 @@ func getPostsID(w http.ResponseWriter, r *http.Request) {
 
 	me := getSessionUser(r)
 
-	template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
-		getTemplPath("layout.html"),
-		getTemplPath("post_id.html"),
-		getTemplPath("post.html"),
-	)).Execute(w, struct {
-		Post Post
-		Me   User
-	}{p, me})
+	return renderTemplate(r.Context(), w, "post_id", struct {
+		Post  Post
+		Me    User
+		Flash string
+	}{p, me, getFlash(w, r, "notice")})
 }
 
-func postIndex(w http.ResponseWriter, r *http.Request) {
+func postIndex(w http.ResponseWriter, r *http.Request) error {
 	me := getSessionUser(r)
 	if !isLogin(me) {
 		http.Redirect(w, r, "/login", http.StatusFound)
-		return
-	}
-
-	if r.FormValue("csrf_token") != getCSRFToken(r) {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		return
+		return nil
 	}
 
 	file, header, err := r.FormFile("file")
 	if err != nil {
 		session := getSession(r)
-		session.Values["notice"] = "画像が必須です"
+		session.Values["notice"] = tr(r, "flash.image_required")
 		session.Save(r, w)
 
 		http.Redirect(w, r, "/", http.StatusFound)
-		return
+		return nil
 	}
 
 	mime := ""
@@ -746,76 +781,114 @@ func postIndex(w http.ResponseWriter, r *http.Request) {
 			mime = "image/gif"
 		} else {
 			session := getSession(r)
-			session.Values["notice"] = "投稿できる画像形式はjpgとpngとgifだけです"
+			session.Values["notice"] = tr(r, "flash.invalid_image_type")
 			session.Save(r, w)
 
 			http.Redirect(w, r, "/", http.StatusFound)
-			return
+			return nil
 		}
 	}
 
 	filedata, err := io.ReadAll(file)
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 
-	if len(filedata) > UploadLimit {
+	if int64(len(filedata)) > cfg.UploadLimit {
+		session := getSession(r)
+		session.Values["notice"] = tr(r, "flash.file_too_large")
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+
+	// 投稿の回数とアップロード量は、受け付けられる投稿だと分かってから数える
+	size := int64(len(filedata))
+	ok, err := reserveUpload(me, size)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		session := getSession(r)
+		session.Values["notice"] = tr(r, "flash.upload_quota_exceeded")
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+	if !allowUserAction(w, me, userActionPost) {
+		if err := releaseUpload(me.ID, size); err != nil {
+			logError(r, err)
+		}
 		session := getSession(r)
-		session.Values["notice"] = "ファイルサイズが大きすぎます"
+		session.Values["notice"] = tr(r, "flash.too_many_posts")
 		session.Save(r, w)
 
 		http.Redirect(w, r, "/", http.StatusFound)
-		return
+		return nil
 	}
 
 	query := "INSERT INTO `posts` (`user_id`, `mime`, `imgdata`, `body`, `user_del_flg`) VALUES (?,?,?,?,?)"
-	result, err := db.Exec(
+	// 画像はいったんDBに入れ、ファイルへの書き出しはジョブで行う
+	// 書き込んだのにキャッシュやジョブが抜けないよう、クライアントが切断しても止めない
+	result, err := db.ExecContext(
+		context.WithoutCancel(r.Context()),
 		query,
 		me.ID,
 		mime,
-		"",
+		filedata,
 		r.FormValue("body"),
 		me.DelFlg,
 	)
 	if err != nil {
-		log.Print(err)
-		return
+		if err := releaseUpload(me.ID, size); err != nil {
+			logError(r, err)
+		}
+		return err
 	}
 
 	pid, err := result.LastInsertId()
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 
 	count.Store(int(pid), 0)
 	postMime.Store(int(pid), mime)
 
-	ext := ""
-	if mime == "image/jpeg" {
-		ext = "jpg"
-	} else if mime == "image/png" {
-		ext = "png"
-	} else if mime == "image/gif" {
-		ext = "gif"
-	}
-	err = ioutil.WriteFile(fmt.Sprintf("../public/image/%d.%s", pid, ext), filedata, 0644)
+	uploadBytes.Observe(float64(size))
+
+	err = enqueueJob(jobWriteImage, imageJob{PostID: int(pid)})
 	if err != nil {
-		log.Print(err)
-		return
+		// キューに入れられなければその場で書き出す
+		logError(r, err)
+		if err := writeImageFile(int(pid), mime, filedata); err != nil {
+			return err
+		}
 	}
 
+	p := Post{ID: int(pid), UserID: me.ID, Body: r.FormValue("body"), Mime: mime, CreatedAt: time.Now(), User: me}
+	publishPost(p)
+	federatePost(me, p)
+	enqueueWebhook(eventPostCreated, map[string]interface{}{
+		"post_id":      p.ID,
+		"user_id":      me.ID,
+		"account_name": me.AccountName,
+		"body":         p.Body,
+		"mime":         p.Mime,
+		"url":          absoluteURL("/posts/" + strconv.Itoa(p.ID)),
+		"image_url":    absoluteURL(imageURL(p)),
+	})
+
 	http.Redirect(w, r, "/posts/"+strconv.FormatInt(pid, 10), http.StatusFound)
+	return nil
 }
 
-func getImage(w http.ResponseWriter, r *http.Request) {
-	log.Print("check get image")
+func getImage(w http.ResponseWriter, r *http.Request) error {
 	pidStr := pat.Param(r, "id")
 	pid, err := strconv.Atoi(pidStr)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		return
+		return notFound("error.image_not_found")
 	}
 
 	// mime := ""
@@ -826,13 +899,11 @@ func getImage(w http.ResponseWriter, r *http.Request) {
 	// }
 	value, ok := postMime.Load(pid)
 	if !ok {
-		log.Print(err)
-		return
+		return notFound("error.image_not_found")
 	}
 	mime, ok := value.(string)
 	if !ok {
-		log.Print(err)
-		return
+		return fmt.Errorf("mime of post %d is %T", pid, value)
 	}
 
 	ext := pat.Param(r, "ext")
@@ -842,120 +913,132 @@ func getImage(w http.ResponseWriter, r *http.Request) {
 		ext == "gif" && mime == "image/gif" {
 		w.Header().Set("Content-Type", mime)
 
-		filedata, err := ioutil.ReadFile(fmt.Sprintf("../public/image/%d.%s", pid, ext))
+		filedata, err := ioutil.ReadFile(fmt.Sprintf("%s/%d.%s", cfg.ImageDir, pid, ext))
+		if os.IsNotExist(err) {
+			// ジョブがまだファイルに書き出していない
+			err = db.GetContext(r.Context(), &filedata, "SELECT `imgdata` FROM `posts` WHERE `id` = ?", pid)
+			if err == nil && len(filedata) == 0 {
+				// 読む間に書き出しが終わった
+				filedata, err = ioutil.ReadFile(fmt.Sprintf("%s/%d.%s", cfg.ImageDir, pid, ext))
+			}
+		}
 		if err != nil {
-			log.Print(err)
-			return
+			return err
 		}
 		_, err = w.Write(filedata)
 		if err != nil {
-			log.Print(err)
-			return
+			return err
 		}
-		return
+		return nil
 	}
 
-	w.WriteHeader(http.StatusNotFound)
+	return notFound("error.image_not_found")
 }
 
-func postComment(w http.ResponseWriter, r *http.Request) {
+// insertComment はコメントを保存し、投稿とユーザーのコメント数のキャッシュを増やす
+func insertComment(ctx context.Context, postID, userID int, comment string) (int64, error) {
+	commentCountsMu.RLock()
+	defer commentCountsMu.RUnlock()
+
+	query := "INSERT INTO `comments` (`post_id`, `user_id`, `comment`) VALUES (?,?,?)"
+	result, err := db.ExecContext(ctx, query, postID, userID, comment)
+	if err != nil {
+		return 0, err
+	}
+	commentID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	n, ok := count.Add(postID, 1)
+	if !ok {
+		return 0, fmt.Errorf("comment count of post %d is not in the cache", postID)
+	}
+	publishCommentCount(postID, n)
+	userCommentCache.Add(userID, 1)
+	return commentID, nil
+}
+
+func postComment(w http.ResponseWriter, r *http.Request) error {
 	me := getSessionUser(r)
 	if !isLogin(me) {
 		http.Redirect(w, r, "/login", http.StatusFound)
-		return
-	}
-
-	if r.FormValue("csrf_token") != getCSRFToken(r) {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		return
+		return nil
 	}
 
 	postID, err := strconv.Atoi(r.FormValue("post_id"))
 	if err != nil {
-		log.Print("post_idは整数のみです")
-		return
+		return badRequest("error.invalid_post_id")
 	}
-
-	query := "INSERT INTO `comments` (`post_id`, `user_id`, `comment`) VALUES (?,?,?)"
-	_, err = db.Exec(query, postID, me.ID, r.FormValue("comment"))
-	if err != nil {
-		log.Print(err)
-		return
+	if _, ok := count.Load(postID); !ok {
+		return notFound("error.post_not_found")
 	}
 
-	value, ok := count.Load(postID)
-	if !ok {
-		log.Print("cannot load comment count")
-		return
-	}
-	commentCount, ok := value.(int)
-	if !ok {
-		log.Print("failed to type assertion")
-		return
-	}
-	count.Store(postID, commentCount+1)
+	if !allowUserAction(w, me, userActionComment) {
+		session := getSession(r)
+		session.Values["notice"] = tr(r, "flash.too_many_comments")
+		session.Save(r, w)
 
-	value, ok = count.Load(me.ID)
-	if !ok {
-		log.Print("cannot load user comment count")
-		return
+		http.Redirect(w, r, fmt.Sprintf("/posts/%d", postID), http.StatusFound)
+		return nil
 	}
-	commentCount = value.(int)
-	count.Store(me.ID, commentCount+1)
+
+	// 書き込んだのにコメント数のキャッシュが増えないことがないよう、クライアントが切断しても止めない
+	commentID, err := insertComment(context.WithoutCancel(r.Context()), postID, me.ID, r.FormValue("comment"))
+	if err != nil {
+		return err
+	}
+	enqueueWebhook(eventCommentCreated, map[string]interface{}{
+		"comment_id":   commentID,
+		"post_id":      postID,
+		"user_id":      me.ID,
+		"account_name": me.AccountName,
+		"comment":      r.FormValue("comment"),
+		"url":          absoluteURL(fmt.Sprintf("/posts/%d", postID)),
+	})
 
 	http.Redirect(w, r, fmt.Sprintf("/posts/%d", postID), http.StatusFound)
+	return nil
 }
 
-func getAdminBanned(w http.ResponseWriter, r *http.Request) {
+func getAdminBanned(w http.ResponseWriter, r *http.Request) error {
 	me := getSessionUser(r)
 	if !isLogin(me) {
 		http.Redirect(w, r, "/", http.StatusFound)
-		return
+		return nil
 	}
 
 	if me.Authority == 0 {
-		w.WriteHeader(http.StatusForbidden)
-		return
+		return forbidden("error.forbidden")
 	}
 
 	users := []User{}
-	err := db.Select(&users, "SELECT `id`, `account_name` FROM `users` WHERE `authority` = 0 AND `del_flg` = 0 ORDER BY `created_at` DESC")
+	err := db.SelectContext(r.Context(), &users, "SELECT `id`, `account_name` FROM `users` WHERE `authority` = 0 AND `del_flg` = 0 ORDER BY `created_at` DESC")
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 
-	template.Must(template.ParseFiles(
-		getTemplPath("layout.html"),
-		getTemplPath("banned.html")),
-	).Execute(w, struct {
+	return renderTemplate(r.Context(), w, "banned", struct {
 		Users     []User
 		Me        User
 		CSRFToken string
 	}{users, me, getCSRFToken(r)})
 }
 
-func postAdminBanned(w http.ResponseWriter, r *http.Request) {
+func postAdminBanned(w http.ResponseWriter, r *http.Request) error {
 	me := getSessionUser(r)
 	if !isLogin(me) {
 		http.Redirect(w, r, "/", http.StatusFound)
-		return
+		return nil
 	}
 
 	if me.Authority == 0 {
-		w.WriteHeader(http.StatusForbidden)
-		return
-	}
-
-	if r.FormValue("csrf_token") != getCSRFToken(r) {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		return
+		return forbidden("error.forbidden")
 	}
 
 	err := r.ParseForm()
 	if err != nil {
-		log.Print(err)
-		return
+		return badRequest("error.bad_request")
 	}
 
 	if len(r.Form["uid[]"]) > 0 {
@@ -970,30 +1053,42 @@ func postAdminBanned(w http.ResponseWriter, r *http.Request) {
 			args[i] = v
 		}
 		query := "UPDATE `users` SET `del_flg` = 1 WHERE `id` IN (" + placeholder + ")"
-		db.Exec(query, args...)
+		db.ExecContext(r.Context(), query, args...)
 
 		query = "UPDATE `posts` SET `user_del_flg` = 1 WHERE `user_id` IN (" + placeholder + ")"
-		db.Exec(query, args...)
+		db.ExecContext(r.Context(), query, args...)
 	}
 
+	bannedIDs := make([]int, 0, len(r.Form["uid[]"]))
 	for _, id := range r.Form["uid[]"] {
 		// db.Exec(query, 1, id)
 		id, err := strconv.Atoi(id)
 		if err != nil {
-			log.Print(err)
-			return
+			return badRequest("error.invalid_user_id")
 		}
 		value, ok := userCache.Load(id)
 		if !ok {
-			log.Print(err)
-			return
+			return unprocessable("error.ban_unknown_user")
 		}
 		user := value.(User)
 		user.DelFlg = 1
 		userCache.Store(id, user)
+		bannedIDs = append(bannedIDs, id)
+		enqueueWebhook(eventUserBanned, map[string]interface{}{
+			"user_id":      user.ID,
+			"account_name": user.AccountName,
+			"banned_by":    me.AccountName,
+		})
+	}
+
+	// BANしたユーザーのログイン中のセッションは即座に破棄する
+	err = revokeUserSessions(bannedIDs, "")
+	if err != nil {
+		return err
 	}
 
 	http.Redirect(w, r, "/admin/banned", http.StatusFound)
+	return nil
 }
 
 type RegexpPattern struct {
@@ -1004,6 +1099,15 @@ func Regexp(reg *regexp.Regexp) *RegexpPattern {
 	return &RegexpPattern{regexp: reg}
 }
 
+var namedGroupRegexp = regexp.MustCompile(`\(\?P<(\w+)>[^)]*\)`)
+
+// String は pat と同じ /@:accountName の形にする。メトリクスのラベルに使う
+func (reg *RegexpPattern) String() string {
+	s := strings.Trim(reg.regexp.String(), "^$")
+	s = namedGroupRegexp.ReplaceAllString(s, ":$1")
+	return strings.Replace(s, `\`, "", -1)
+}
+
 func (reg *RegexpPattern) Match(r *http.Request) *http.Request {
 	ctx := r.Context()
 	uPath := pattern.Path(ctx)
@@ -1021,49 +1125,13 @@ func (reg *RegexpPattern) Match(r *http.Request) *http.Request {
 	return nil
 }
 
-func main() {
-	host := os.Getenv("ISUCONP_DB_HOST")
-	if host == "" {
-		host = "localhost"
-	}
-	port := os.Getenv("ISUCONP_DB_PORT")
-	if port == "" {
-		port = "3306"
-	}
-	_, err := strconv.Atoi(port)
-	if err != nil {
-		log.Fatalf("Failed to read DB port number from an environment variable ISUCONP_DB_PORT.\nError: %s", err.Error())
-	}
-	user := os.Getenv("ISUCONP_DB_USER")
-	if user == "" {
-		user = "root"
-	}
-	password := os.Getenv("ISUCONP_DB_PASSWORD")
-	dbname := os.Getenv("ISUCONP_DB_NAME")
-	if dbname == "" {
-		dbname = "isuconp"
-	}
-
-	dsn := fmt.Sprintf(
-		"%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=true&interpolateParams=true&loc=Local",
-		user,
-		password,
-		host,
-		port,
-		dbname,
-	)
-
-	db, err = sqlx.Open("mysql", dsn)
-	if err != nil {
-		log.Fatalf("Failed to connect to DB: %s.", err.Error())
-	}
-	defer db.Close()
-
+// 起動時にDBからオンメモリのキャッシュを作成する
+func warmCaches() error {
 	// Postのキャッシュ作成
 	posts := []Post{}
-	err = db.Select(&posts, "SELECT `posts`.`id` AS `id`, COUNT(`comments`.`id`) AS `count`, `posts`.`mime` AS `mime`, `posts`.`imgdata` AS `imgdata` FROM `posts` LEFT JOIN `comments` ON `posts`.`id` = `comments`.`post_id` GROUP BY `posts`.`id`")
+	err := db.Select(&posts, "SELECT `posts`.`id` AS `id`, COUNT(`comments`.`id`) AS `count`, `posts`.`mime` AS `mime`, `posts`.`imgdata` AS `imgdata` FROM `posts` LEFT JOIN `comments` ON `posts`.`id` = `comments`.`post_id` GROUP BY `posts`.`id`")
 	if err != nil {
-		log.Fatalf("Failed to connect to DB: %s.", err.Error())
+		return err
 	}
 	for _, p := range posts {
 		ext := ""
@@ -1074,11 +1142,11 @@ func main() {
 		} else if p.Mime == "image/gif" {
 			ext = "gif"
 		}
-		filename := fmt.Sprintf("../public/image/%d.%s", p.ID, ext)
+		filename := fmt.Sprintf("%s/%d.%s", cfg.ImageDir, p.ID, ext)
 		if _, err := os.Stat(filename); os.IsNotExist(err) {
 			err = ioutil.WriteFile(filename, p.Imgdata, 0644)
 			if err != nil {
-				log.Fatalf("Failed to write image data to file: %s.", err.Error())
+				return err
 			}
 		}
 		count.Store(p.ID, p.CommentCount)
@@ -1089,7 +1157,7 @@ func main() {
 	users := []User{}
 	err = db.Select(&users, "SELECT * FROM `users`")
 	if err != nil {
-		log.Fatalf("Failed to connect to DB: %s.", err.Error())
+		return err
 	}
 	for _, user := range users {
 		userCache.Store(user.ID, user)
@@ -1102,35 +1170,207 @@ func main() {
 	}{}
 	err = db.Select(&commentCounts, "SELECT `user_id`, COUNT(id) AS count FROM `comments` GROUP BY `user_id`")
 	if err != nil {
-		log.Fatalf("Failed to connect to DB: %s.", err.Error())
+		return err
 	}
 	for _, commentCount := range commentCounts {
 		userCommentCache.Store(commentCount.UserID, commentCount.CommentCount)
 	}
 
+	// 2段階認証を有効にしているユーザーのキャッシュ作成
+	totpUserIDs := []int{}
+	err = db.Select(&totpUserIDs, "SELECT `user_id` FROM `user_totp`")
+	if err != nil {
+		return err
+	}
+	for _, uid := range totpUserIDs {
+		totpEnabled.Store(uid, true)
+	}
+
+	// 言語を設定しているユーザーのキャッシュ作成
+	userLocaleRows := []struct {
+		UserID int    `db:"user_id"`
+		Locale string `db:"locale"`
+	}{}
+	err = db.Select(&userLocaleRows, "SELECT `user_id`, `locale` FROM `user_locales`")
+	if err != nil {
+		return err
+	}
+	for _, row := range userLocaleRows {
+		userLocales.Store(row.UserID, row.Locale)
+	}
+
+	return nil
+}
+
+// サブコマンド。引数なしで起動した場合はサーバーとして動く
+var commands = map[string]func(args []string) error{
+	"config":  runConfigCommand,
+	"session": runSessionCommand,
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
+	var err error
+	cfg, err = loadConfig(os.Args[0], os.Args[1:])
+	if err != nil {
+		log.Fatalf("Failed to load config: %s.", err.Error())
+	}
+	err = setupLogging(cfg.Log)
+	if err != nil {
+		log.Fatalf("Failed to set up logging: %s.", err.Error())
+	}
+	err = loadLocales(cfg.DefaultLocale)
+	if err != nil {
+		log.Fatalf("Failed to load locales: %s.", err.Error())
+	}
+	err = loadTemplates(cfg.TemplateDir)
+	if err != nil {
+		log.Fatalf("Failed to load templates: %s.", err.Error())
+	}
+
+	// 終了時に最後に送り切るよう、他より先に登録する
+	err = setupTracing(cfg.Tracing)
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %s.", err.Error())
+	}
+
+	memcacheClient = memcache.New(cfg.Memcached.Address)
+	store, err = newSessionStore(memcacheClient, cfg.Session)
+	if err != nil {
+		log.Fatalf("Failed to create session store: %s.", err.Error())
+	}
+	limitStore, err = newRateStore(cfg.RateLimit.Store)
+	if err != nil {
+		log.Fatalf("Failed to create rate limit store: %s.", err.Error())
+	}
+	mailer, err = newMailer(cfg.Mail)
+	if err != nil {
+		log.Fatalf("Failed to create mailer: %s.", err.Error())
+	}
+	streamBroker, err = newBroker(cfg.Stream)
+	if err != nil {
+		log.Fatalf("Failed to create stream broker: %s.", err.Error())
+	}
+	jobQueue, err = newJobQueue(cfg.Jobs)
+	if err != nil {
+		log.Fatalf("Failed to create job queue: %s.", err.Error())
+	}
+
+	sqlxDB, err := sqlx.Open("mysql", cfg.dsn())
+	if err != nil {
+		log.Fatalf("Failed to connect to DB: %s.", err.Error())
+	}
+	db = &instrumentedDB{sqlxDB}
+	onShutdown(func(ctx context.Context) error {
+		return db.Close()
+	})
+	// DBを閉じる前に配送中のアクティビティや送信中のメール、実行中のジョブを待つ
+	onShutdown(waitDeliveries)
+	onShutdown(waitMails)
+	startJobWorkers()
+
+	mux := goji.NewMux()
+	mux.Use(traceRoutes)
+	mux.Use(instrumentRoutes)
+	mux.Use(accessLog)
+	mux.Use(recoverPanic)
+	mux.Use(readiness)
+	mux.Use(bearerAuth)
+	mux.Use(sessionLifecycle)
+	mux.Use(localize)
+	mux.Use(csrfProtection)
+	mux.Use(requireAdmin2FA)
+
+	mux.Handle(pat.Get("/healthz"), handler(getHealthz))
+	mux.Handle(pat.Get("/readyz"), handler(getReadyz))
+	mux.Handle(pat.Get("/.well-known/webfinger"), handler(getWebFinger))
+	mux.Handle(pat.Get("/initialize"), handler(getInitialize))
+	mux.Handle(pat.Get("/login"), handler(getLogin))
+	mux.Handle(pat.Post("/login"), handler(postLogin))
+	mux.Handle(pat.Get("/login/2fa"), handler(getLogin2FA))
+	mux.Handle(pat.Post("/login/2fa"), handler(postLogin2FA))
+	mux.Handle(pat.Get("/login/oidc"), handler(getLoginOIDC))
+	mux.Handle(pat.Get("/login/oidc/callback"), handler(getLoginOIDCCallback))
+	mux.Handle(pat.Get("/register"), handler(getRegister))
+	mux.Handle(pat.Post("/register"), handler(postRegister))
+	mux.Handle(pat.Get("/logout"), handler(getLogout))
+	mux.Handle(pat.Get("/locale"), handler(getLocale))
+	mux.Handle(pat.Get("/"), handler(getIndex))
+	mux.Handle(pat.Get("/posts"), handler(getPosts))
+	mux.Handle(pat.Get("/stream"), handler(getStream))
+	mux.Handle(Regexp(regexp.MustCompile(`^/feed\.(?P<format>atom|rss)$`)), handler(getFeed))
+	mux.Handle(pat.Get("/posts/:id"), handler(getPostsID))
+	mux.Handle(pat.Post("/"), handler(postIndex))
+	mux.Handle(pat.Get("/image/:id.:ext"), handler(getImage))
+	mux.Handle(pat.Post("/comment"), handler(postComment))
+	mux.Handle(pat.Get("/api/limits"), handler(getAPILimits))
+	mux.Handle(pat.Get("/password/reset"), handler(getPasswordReset))
+	mux.Handle(pat.Post("/password/reset"), handler(postPasswordReset))
+	mux.Handle(pat.Get("/password/reset/:token"), handler(getPasswordResetToken))
+	mux.Handle(pat.Post("/password/reset/:token"), handler(postPasswordResetToken))
+	mux.Handle(pat.Get("/settings"), handler(getSettings))
+	mux.Handle(pat.Post("/settings/password"), handler(postSettingsPassword))
+	mux.Handle(pat.Post("/settings/email"), handler(postSettingsEmail))
+	mux.Handle(pat.Post("/settings/locale"), handler(postSettingsLocale))
+	mux.Handle(pat.Post("/settings/oidc/unlink"), handler(postSettingsOIDCUnlink))
+	mux.Handle(pat.Get("/settings/export"), handler(getSettingsExport))
+	mux.Handle(pat.Post("/settings/delete"), handler(postSettingsDelete))
+	mux.Handle(pat.Get("/settings/sessions"), handler(getSettingsSessions))
+	mux.Handle(pat.Post("/settings/sessions/revoke"), handler(postSettingsSessionsRevoke))
+	mux.Handle(pat.Get("/settings/2fa"), handler(getSettings2FA))
+	mux.Handle(pat.Post("/settings/2fa/enable"), handler(postSettings2FAEnable))
+	mux.Handle(pat.Post("/settings/2fa/disable"), handler(postSettings2FADisable))
+	mux.Handle(pat.Post("/settings/2fa/recovery_codes"), handler(postSettings2FARecoveryCodes))
+	mux.Handle(pat.Get("/settings/tokens"), handler(getSettingsTokens))
+	mux.Handle(pat.Post("/settings/tokens"), handler(postSettingsTokens))
+	mux.Handle(pat.Post("/settings/tokens/revoke"), handler(postSettingsTokensRevoke))
+	mux.Handle(pat.Get("/admin/banned"), handler(getAdminBanned))
+	mux.Handle(pat.Post("/admin/banned"), handler(postAdminBanned))
+	mux.Handle(pat.Get("/admin/lockouts"), handler(getAdminLockouts))
+	mux.Handle(pat.Post("/admin/lockouts/unlock"), handler(postAdminLockoutsUnlock))
+	mux.Handle(pat.Get("/admin/webhooks"), handler(getAdminWebhooks))
+	mux.Handle(pat.Post("/admin/webhooks"), handler(postAdminWebhooks))
+	mux.Handle(pat.Post("/admin/webhooks/update"), handler(postAdminWebhooksUpdate))
+	mux.Handle(pat.Post("/admin/webhooks/redeliver"), handler(postAdminWebhooksRedeliver))
+	mux.Handle(pat.Get("/admin/jobs"), handler(getAdminJobs))
+	mux.Handle(pat.Post("/admin/jobs/retry"), handler(postAdminJobsRetry))
+	mux.Handle(Regexp(regexp.MustCompile(`^/@(?P<accountName>[a-zA-Z]+)$`)), handler(getAccountName))
+	mux.Handle(Regexp(regexp.MustCompile(`^/@(?P<accountName>[a-zA-Z]+)/posts$`)), handler(getAccountNamePosts))
+	mux.Handle(Regexp(regexp.MustCompile(`^/@(?P<accountName>[a-zA-Z]+)/feed\.(?P<format>atom|rss)$`)), handler(getAccountNameFeed))
+	mux.Handle(Regexp(regexp.MustCompile(`^/@(?P<accountName>[a-zA-Z]+)/outbox$`)), handler(getActorOutbox))
+	mux.Handle(Regexp(regexp.MustCompile(`^/@(?P<accountName>[a-zA-Z]+)/followers$`)), handler(getActorFollowers))
+	mux.Handle(Regexp(regexp.MustCompile(`^/@(?P<accountName>[a-zA-Z]+)/inbox$`)), handler(postActorInbox))
+	mux.Handle(pat.Get("/*"), http.FileServer(http.Dir(cfg.PublicDir)))
+
+	// キャッシュの構築が終わるまでは/readyzが503を返す
 	go func() {
-		log.Println(http.ListenAndServe(":6060", nil))
+		err := warmCaches()
+		if err != nil {
+			log.Fatalf("Failed to warm caches: %s.", err.Error())
+		}
+		markReady()
+		slog.Info("caches warmed")
 	}()
 
-	mux := goji.NewMux()
+	// pprof と同じ内部向けのポートで公開する
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/debug/loglevel", serveLogLevel)
 
-	mux.HandleFunc(pat.Get("/initialize"), getInitialize)
-	mux.HandleFunc(pat.Get("/login"), getLogin)
-	mux.HandleFunc(pat.Post("/login"), postLogin)
-	mux.HandleFunc(pat.Get("/register"), getRegister)
-	mux.HandleFunc(pat.Post("/register"), postRegister)
-	mux.HandleFunc(pat.Get("/logout"), getLogout)
-	mux.HandleFunc(pat.Get("/"), getIndex)
-	mux.HandleFunc(pat.Get("/posts"), getPosts)
-	mux.HandleFunc(pat.Get("/posts/:id"), getPostsID)
-	mux.HandleFunc(pat.Post("/"), postIndex)
-	mux.HandleFunc(pat.Get("/image/:id.:ext"), getImage)
-	mux.HandleFunc(pat.Post("/comment"), postComment)
-	mux.HandleFunc(pat.Get("/admin/banned"), getAdminBanned)
-	mux.HandleFunc(pat.Post("/admin/banned"), postAdminBanned)
-	mux.HandleFunc(Regexp(regexp.MustCompile(`^/@(?P<accountName>[a-zA-Z]+)$`)), getAccountName)
-	mux.Handle(pat.Get("/*"), http.FileServer(http.Dir("../public")))
-
-	log.Print("ready for running server")
-	log.Fatal(http.ListenAndServe(":8080", mux))
+	slog.Info("ready for running server", slog.String("listen", cfg.Listen), slog.String("pprof_listen", cfg.PprofListen))
+	servers := []*http.Server{newServer(cfg.Listen, mux)}
+	if cfg.PprofListen != pprofDisabled {
+		servers = append(servers, newServer(cfg.PprofListen, http.DefaultServeMux))
+	}
+	err = serve(servers...)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
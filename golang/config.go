@@ -0,0 +1,675 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/mail"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/language"
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "********"
+
+// pprof_listen をこの値にすると pprof と /metrics を公開する内部向けのポートを開かない
+const pprofDisabled = "off"
+
+// Config はアプリケーションの設定
+// 優先順位は デフォルト値 < 設定ファイル < 環境変数 < コマンドラインフラグ
+// フラグ名は yaml のキーを "-" でつないだもの (例: db.host -> -db-host)
+// secret:"true" の項目は config print で伏せ字になる
+type Config struct {
+	Listen       string `yaml:"listen" env:"ISUCONP_LISTEN"`
+	PprofListen  string `yaml:"pprof_listen" env:"ISUCONP_PPROF_LISTEN"`
+	PublicDir    string `yaml:"public_dir" env:"ISUCONP_PUBLIC_DIR"`
+	ImageDir     string `yaml:"image_dir" env:"ISUCONP_IMAGE_DIR"`
+	PostsPerPage int    `yaml:"posts_per_page" env:"ISUCONP_POSTS_PER_PAGE"`
+	UploadLimit  int64  `yaml:"upload_limit" env:"ISUCONP_UPLOAD_LIMIT"`
+	// メールなどに載せるリンクの起点になるURL
+	BaseURL string `yaml:"base_url" env:"ISUCONP_BASE_URL"`
+	// 空ならバイナリに埋め込んだテンプレートを使う
+	// 指定するとそのディレクトリから読み、ファイルが変わるたびに読み直す (開発用)
+	TemplateDir string `yaml:"template_dir" env:"ISUCONP_TEMPLATE_DIR"`
+	// 利用者の言語が分からないときや、翻訳が足りないときに使う言語 (locales/ のファイル名)
+	DefaultLocale string `yaml:"default_locale" env:"ISUCONP_DEFAULT_LOCALE"`
+	// 開発用。session.hash_keys が無くても起動し、鍵を起動ごとに生成する
+	Dev bool `yaml:"dev" env:"ISUCONP_DEV"`
+
+	DB            DBConfig            `yaml:"db"`
+	Memcached     MemcachedConfig     `yaml:"memcached"`
+	Session       SessionConfig       `yaml:"session"`
+	CSRF          CSRFConfig          `yaml:"csrf"`
+	RateLimit     RateLimitConfig     `yaml:"rate_limit"`
+	LoginLimit    LoginLimitConfig    `yaml:"login_limit"`
+	UserLimit     UserLimitConfig     `yaml:"user_limit"`
+	Mail          MailConfig          `yaml:"mail"`
+	PasswordReset PasswordResetConfig `yaml:"password_reset"`
+	OIDC          OIDCConfig          `yaml:"oidc"`
+	ActivityPub   ActivityPubConfig   `yaml:"activitypub"`
+	Webhook       WebhookConfig       `yaml:"webhook"`
+	Stream        StreamConfig        `yaml:"stream"`
+	Jobs          JobsConfig          `yaml:"jobs"`
+	Tracing       TracingConfig       `yaml:"tracing"`
+	Log           LogConfig           `yaml:"log"`
+	Server        ServerConfig        `yaml:"server"`
+}
+
+type DBConfig struct {
+	Host     string `yaml:"host" env:"ISUCONP_DB_HOST"`
+	Port     int    `yaml:"port" env:"ISUCONP_DB_PORT"`
+	User     string `yaml:"user" env:"ISUCONP_DB_USER"`
+	Password string `yaml:"password" env:"ISUCONP_DB_PASSWORD" secret:"true"`
+	Name     string `yaml:"name" env:"ISUCONP_DB_NAME"`
+}
+
+type MemcachedConfig struct {
+	Address string `yaml:"address" env:"ISUCONP_MEMCACHED_ADDRESS"`
+}
+
+// HashKeys と BlockKeys は base64 でエンコードした鍵を新しい順に並べる
+// 環境変数ではカンマ区切りで指定する
+type SessionConfig struct {
+	HashKeys  []string `yaml:"hash_keys" env:"ISUCONP_SESSION_HASH_KEYS" secret:"true"`
+	BlockKeys []string `yaml:"block_keys" env:"ISUCONP_SESSION_BLOCK_KEYS" secret:"true"`
+	Secret    string   `yaml:"secret" env:"ISUCONP_SESSION_SECRET" secret:"true"`
+	// 旧来の secret で署名されたセッションも受け付ける。hash_keys へ移行して1リリースの間は有効にしておく
+	AcceptLegacySecret bool `yaml:"accept_legacy_secret" env:"ISUCONP_SESSION_ACCEPT_LEGACY_SECRET"`
+
+	IdleTimeout     time.Duration `yaml:"idle_timeout" env:"ISUCONP_SESSION_IDLE_TIMEOUT"`
+	AbsoluteTimeout time.Duration `yaml:"absolute_timeout" env:"ISUCONP_SESSION_ABSOLUTE_TIMEOUT"`
+	CookieSecure    bool          `yaml:"cookie_secure" env:"ISUCONP_SESSION_COOKIE_SECURE"`
+	CookieSameSite  string        `yaml:"cookie_same_site" env:"ISUCONP_SESSION_COOKIE_SAME_SITE"`
+}
+
+// TrustedOrigins は自サイト以外にPOSTを許可するオリジン (https://example.com の形式)
+type CSRFConfig struct {
+	TrustedOrigins []string `yaml:"trusted_origins" env:"ISUCONP_CSRF_TRUSTED_ORIGINS"`
+}
+
+// Store は memory か memcached。複数台で動かす場合は memcached にする
+type RateLimitConfig struct {
+	Store string `yaml:"store" env:"ISUCONP_RATE_LIMIT_STORE"`
+}
+
+// IPRate と AccountRate は1分あたりのログイン試行回数の上限 (0なら無制限)
+// MaxAccountFailures と MaxIPFailures 回失敗するとロックし、それ以降の失敗ごとにロック時間が倍になる
+type LoginLimitConfig struct {
+	IPRate             int           `yaml:"ip_rate" env:"ISUCONP_LOGIN_LIMIT_IP_RATE"`
+	AccountRate        int           `yaml:"account_rate" env:"ISUCONP_LOGIN_LIMIT_ACCOUNT_RATE"`
+	MaxAccountFailures int           `yaml:"max_account_failures" env:"ISUCONP_LOGIN_LIMIT_MAX_ACCOUNT_FAILURES"`
+	MaxIPFailures      int           `yaml:"max_ip_failures" env:"ISUCONP_LOGIN_LIMIT_MAX_IP_FAILURES"`
+	FailureWindow      time.Duration `yaml:"failure_window" env:"ISUCONP_LOGIN_LIMIT_FAILURE_WINDOW"`
+	LockoutBase        time.Duration `yaml:"lockout_base" env:"ISUCONP_LOGIN_LIMIT_LOCKOUT_BASE"`
+	LockoutMax         time.Duration `yaml:"lockout_max" env:"ISUCONP_LOGIN_LIMIT_LOCKOUT_MAX"`
+}
+
+// PostRate と CommentRate はそれぞれのウィンドウの間に投稿できる回数 (0なら無制限)
+// DailyUploadQuota は1日にアップロードできる画像のバイト数 (0なら無制限)
+// 管理者はこれらの制限を受けない
+type UserLimitConfig struct {
+	PostRate         int           `yaml:"post_rate" env:"ISUCONP_USER_LIMIT_POST_RATE"`
+	PostWindow       time.Duration `yaml:"post_window" env:"ISUCONP_USER_LIMIT_POST_WINDOW"`
+	CommentRate      int           `yaml:"comment_rate" env:"ISUCONP_USER_LIMIT_COMMENT_RATE"`
+	CommentWindow    time.Duration `yaml:"comment_window" env:"ISUCONP_USER_LIMIT_COMMENT_WINDOW"`
+	DailyUploadQuota int64         `yaml:"daily_upload_quota" env:"ISUCONP_USER_LIMIT_DAILY_UPLOAD_QUOTA"`
+}
+
+// Driver は smtp か、開発用の log (ログに出力) と file (FileDir に.emlとして保存)
+type MailConfig struct {
+	Driver       string `yaml:"driver" env:"ISUCONP_MAIL_DRIVER"`
+	From         string `yaml:"from" env:"ISUCONP_MAIL_FROM"`
+	FileDir      string `yaml:"file_dir" env:"ISUCONP_MAIL_FILE_DIR"`
+	SMTPHost     string `yaml:"smtp_host" env:"ISUCONP_MAIL_SMTP_HOST"`
+	SMTPPort     int    `yaml:"smtp_port" env:"ISUCONP_MAIL_SMTP_PORT"`
+	SMTPUsername string `yaml:"smtp_username" env:"ISUCONP_MAIL_SMTP_USERNAME"`
+	SMTPPassword string `yaml:"smtp_password" env:"ISUCONP_MAIL_SMTP_PASSWORD" secret:"true"`
+}
+
+// Rate は1つのIPアドレスから1時間に再設定メールを送れる回数
+type PasswordResetConfig struct {
+	TokenTTL time.Duration `yaml:"token_ttl" env:"ISUCONP_PASSWORD_RESET_TOKEN_TTL"`
+	Rate     int           `yaml:"rate" env:"ISUCONP_PASSWORD_RESET_RATE"`
+}
+
+// OIDCConfig は外部のOpenID Connectプロバイダでのログインの設定
+// Issuer が空のときは無効。RedirectURL が空なら BaseURL から組み立てる
+type OIDCConfig struct {
+	Name         string   `yaml:"name" env:"ISUCONP_OIDC_NAME"`
+	Issuer       string   `yaml:"issuer" env:"ISUCONP_OIDC_ISSUER"`
+	ClientID     string   `yaml:"client_id" env:"ISUCONP_OIDC_CLIENT_ID"`
+	ClientSecret string   `yaml:"client_secret" env:"ISUCONP_OIDC_CLIENT_SECRET" secret:"true"`
+	RedirectURL  string   `yaml:"redirect_url" env:"ISUCONP_OIDC_REDIRECT_URL"`
+	Scopes       []string `yaml:"scopes" env:"ISUCONP_OIDC_SCOPES"`
+}
+
+func (c OIDCConfig) enabled() bool {
+	return c.Issuer != ""
+}
+
+// ActivityPubConfig はMastodonなど他のサーバーからのフォローを受け付ける設定
+// アクターのIDなどは BaseURL から作るので、公開するURLを BaseURL に設定しておく
+type ActivityPubConfig struct {
+	Enabled         bool          `yaml:"enabled" env:"ISUCONP_ACTIVITYPUB_ENABLED"`
+	DeliveryTimeout time.Duration `yaml:"delivery_timeout" env:"ISUCONP_ACTIVITYPUB_DELIVERY_TIMEOUT"`
+}
+
+// WebhookConfig はWebhookの送信の設定
+// 送信はジョブとして行うので、再送の回数や間隔は JobsConfig に従う
+type WebhookConfig struct {
+	Timeout time.Duration `yaml:"timeout" env:"ISUCONP_WEBHOOK_TIMEOUT"`
+}
+
+// StreamConfig はSSEでタイムラインを配信する設定
+// Buffer は接続ごとに溜められるイベント数で、溢れた接続は切断して再接続させる
+type StreamConfig struct {
+	Broker         string        `yaml:"broker" env:"ISUCONP_STREAM_BROKER"`
+	Heartbeat      time.Duration `yaml:"heartbeat" env:"ISUCONP_STREAM_HEARTBEAT"`
+	Buffer         int           `yaml:"buffer" env:"ISUCONP_STREAM_BUFFER"`
+	MaxConnections int           `yaml:"max_connections" env:"ISUCONP_STREAM_MAX_CONNECTIONS"`
+}
+
+// JobsConfig はバックグラウンドジョブの設定
+// 失敗したジョブは BackoffBase * 2^(n-1) 後 (最大 BackoffMax) に再実行し、MaxAttempts 回で諦める
+type JobsConfig struct {
+	Driver            string        `yaml:"driver" env:"ISUCONP_JOBS_DRIVER"`
+	Workers           int           `yaml:"workers" env:"ISUCONP_JOBS_WORKERS"`
+	PollInterval      time.Duration `yaml:"poll_interval" env:"ISUCONP_JOBS_POLL_INTERVAL"`
+	Timeout           time.Duration `yaml:"timeout" env:"ISUCONP_JOBS_TIMEOUT"`
+	MaxAttempts       int           `yaml:"max_attempts" env:"ISUCONP_JOBS_MAX_ATTEMPTS"`
+	BackoffBase       time.Duration `yaml:"backoff_base" env:"ISUCONP_JOBS_BACKOFF_BASE"`
+	BackoffMax        time.Duration `yaml:"backoff_max" env:"ISUCONP_JOBS_BACKOFF_MAX"`
+	ReconcileInterval time.Duration `yaml:"reconcile_interval" env:"ISUCONP_JOBS_RECONCILE_INTERVAL"`
+}
+
+// TracingConfig はOpenTelemetryのスパンの送り先
+// Exporter が none なら何も送らない。otlp なら Endpoint (http://localhost:4318 など) にOTLP/HTTPで送る
+type TracingConfig struct {
+	Exporter    string   `yaml:"exporter" env:"ISUCONP_TRACING_EXPORTER"`
+	Endpoint    string   `yaml:"endpoint" env:"ISUCONP_TRACING_ENDPOINT"`
+	Headers     []string `yaml:"headers" env:"ISUCONP_TRACING_HEADERS" secret:"true"`
+	ServiceName string   `yaml:"service_name" env:"ISUCONP_TRACING_SERVICE_NAME"`
+	SampleRatio float64  `yaml:"sample_ratio" env:"ISUCONP_TRACING_SAMPLE_RATIO"`
+}
+
+// LogConfig はログの出力形式
+// Level は debug, info, warn, error のいずれか。起動後も /debug/loglevel で変えられる
+type LogConfig struct {
+	Level     string `yaml:"level" env:"ISUCONP_LOG_LEVEL"`
+	Format    string `yaml:"format" env:"ISUCONP_LOG_FORMAT"`
+	AccessLog bool   `yaml:"access_log" env:"ISUCONP_ACCESS_LOG"`
+}
+
+type ServerConfig struct {
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" env:"ISUCONP_READ_HEADER_TIMEOUT"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" env:"ISUCONP_READ_TIMEOUT"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" env:"ISUCONP_WRITE_TIMEOUT"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" env:"ISUCONP_IDLE_TIMEOUT"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout" env:"ISUCONP_SHUTDOWN_TIMEOUT"`
+	// DrainDelay は/readyzを落としてから新規の接続を止めるまで待つ時間
+	// ロードバランサーがこのプロセスを外すまでの間もリクエストを受け付ける
+	DrainDelay time.Duration `yaml:"drain_delay" env:"ISUCONP_DRAIN_DELAY"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Listen:        ":8080",
+		PprofListen:   ":6060",
+		PublicDir:     "../public",
+		ImageDir:      "../public/image",
+		PostsPerPage:  20,
+		UploadLimit:   10 * 1024 * 1024, // 10mb
+		BaseURL:       "http://localhost",
+		DefaultLocale: "ja",
+		DB: DBConfig{
+			Host: "localhost",
+			Port: 3306,
+			User: "root",
+			Name: "isuconp",
+		},
+		Memcached: MemcachedConfig{
+			Address: "localhost:11211",
+		},
+		Session: SessionConfig{
+			AcceptLegacySecret: true,
+			IdleTimeout:        72 * time.Hour,
+			AbsoluteTimeout:    30 * 24 * time.Hour,
+			CookieSameSite:     "lax",
+		},
+		RateLimit: RateLimitConfig{
+			Store: "memory",
+		},
+		LoginLimit: LoginLimitConfig{
+			IPRate:             60,
+			AccountRate:        20,
+			MaxAccountFailures: 10,
+			MaxIPFailures:      50,
+			FailureWindow:      time.Hour,
+			LockoutBase:        time.Minute,
+			LockoutMax:         time.Hour,
+		},
+		UserLimit: UserLimitConfig{
+			PostRate:         30,
+			PostWindow:       time.Minute,
+			CommentRate:      60,
+			CommentWindow:    time.Minute,
+			DailyUploadQuota: 500 * 1024 * 1024, // 500mb
+		},
+		Mail: MailConfig{
+			Driver:   "log",
+			From:     "Iscogram <noreply@localhost>",
+			FileDir:  "../mail",
+			SMTPHost: "localhost",
+			SMTPPort: 25,
+		},
+		PasswordReset: PasswordResetConfig{
+			TokenTTL: time.Hour,
+			Rate:     10,
+		},
+		OIDC: OIDCConfig{
+			Name:   "外部アカウント",
+			Scopes: []string{"openid", "profile", "email"},
+		},
+		ActivityPub: ActivityPubConfig{
+			DeliveryTimeout: 10 * time.Second,
+		},
+		Webhook: WebhookConfig{
+			Timeout: 10 * time.Second,
+		},
+		Stream: StreamConfig{
+			Broker:         "memory",
+			Heartbeat:      15 * time.Second,
+			Buffer:         32,
+			MaxConnections: 10000,
+		},
+		Jobs: JobsConfig{
+			Driver:            "db",
+			Workers:           2,
+			PollInterval:      time.Second,
+			Timeout:           time.Minute,
+			MaxAttempts:       5,
+			BackoffBase:       10 * time.Second,
+			BackoffMax:        10 * time.Minute,
+			ReconcileInterval: time.Hour,
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			ServiceName: "isuconp",
+			SampleRatio: 1,
+		},
+		Log: LogConfig{
+			Level:     "info",
+			Format:    "json",
+			AccessLog: true,
+		},
+		Server: ServerConfig{
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       30 * time.Second,
+			WriteTimeout:      60 * time.Second,
+			IdleTimeout:       120 * time.Second,
+			ShutdownTimeout:   30 * time.Second,
+			DrainDelay:        5 * time.Second,
+		},
+	}
+}
+
+func (c *Config) validate() error {
+	var errs []string
+	if c.Listen == "" {
+		errs = append(errs, "listen must not be empty")
+	}
+	// 空だと :80 で /metrics や /debug/loglevel まで公開してしまうので、止めるときは off と書かせる
+	if c.PprofListen == "" {
+		errs = append(errs, "pprof_listen must not be empty (set it to off to disable)")
+	}
+	if c.PublicDir == "" {
+		errs = append(errs, "public_dir must not be empty")
+	}
+	if c.ImageDir == "" {
+		errs = append(errs, "image_dir must not be empty")
+	}
+	if c.PostsPerPage <= 0 {
+		errs = append(errs, "posts_per_page must be positive")
+	}
+	if c.UploadLimit <= 0 {
+		errs = append(errs, "upload_limit must be positive")
+	}
+	if c.DB.Host == "" || c.DB.User == "" || c.DB.Name == "" {
+		errs = append(errs, "db.host, db.user and db.name must not be empty")
+	}
+	if c.DB.Port <= 0 || c.DB.Port > 65535 {
+		errs = append(errs, fmt.Sprintf("db.port %d is out of range", c.DB.Port))
+	}
+	if c.Memcached.Address == "" {
+		errs = append(errs, "memcached.address must not be empty")
+	}
+	if _, err := sessionKeyPairs(c.Session); err != nil {
+		errs = append(errs, err.Error())
+	}
+	// 鍵を起動ごとに生成すると、デプロイのたびにログアウトされ、複数台の間でもセッションが通らない
+	if len(c.Session.HashKeys) == 0 && !c.Dev {
+		errs = append(errs, "session.hash_keys must be set unless dev is true (generate one with app session keygen)")
+	}
+	if c.Session.IdleTimeout <= 0 || c.Session.AbsoluteTimeout <= 0 {
+		errs = append(errs, "session.idle_timeout and session.absolute_timeout must be positive")
+	}
+	// memcachedは30日を超える有効期限をUNIX時刻として扱ってしまう
+	if c.Session.AbsoluteTimeout > 30*24*time.Hour {
+		errs = append(errs, "session.absolute_timeout must not exceed 720h")
+	}
+	switch c.Session.CookieSameSite {
+	case "lax", "strict":
+	case "none":
+		if !c.Session.CookieSecure {
+			errs = append(errs, "session.cookie_same_site none requires session.cookie_secure")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("session.cookie_same_site %q must be one of lax, strict or none", c.Session.CookieSameSite))
+	}
+	if c.RateLimit.Store != "memory" && c.RateLimit.Store != "memcached" {
+		errs = append(errs, fmt.Sprintf("rate_limit.store %q must be memory or memcached", c.RateLimit.Store))
+	}
+	if c.LoginLimit.FailureWindow <= 0 || c.LoginLimit.LockoutBase <= 0 || c.LoginLimit.LockoutMax < c.LoginLimit.LockoutBase {
+		errs = append(errs, "login_limit.failure_window and login_limit.lockout_base must be positive and login_limit.lockout_max must not be less than lockout_base")
+	}
+	if c.UserLimit.PostWindow <= 0 || c.UserLimit.CommentWindow <= 0 {
+		errs = append(errs, "user_limit.post_window and user_limit.comment_window must be positive")
+	}
+	if u, err := url.Parse(c.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Sprintf("base_url %q must be an absolute http(s) URL", c.BaseURL))
+	}
+	if _, err := language.Parse(c.DefaultLocale); err != nil {
+		errs = append(errs, fmt.Sprintf("default_locale %q is not a valid language tag", c.DefaultLocale))
+	}
+	switch c.Mail.Driver {
+	case "log", "file", "smtp":
+	default:
+		errs = append(errs, fmt.Sprintf("mail.driver %q must be one of log, file or smtp", c.Mail.Driver))
+	}
+	if _, err := mail.ParseAddress(c.Mail.From); err != nil {
+		errs = append(errs, fmt.Sprintf("mail.from %q is not a valid address", c.Mail.From))
+	}
+	if c.PasswordReset.TokenTTL <= 0 {
+		errs = append(errs, "password_reset.token_ttl must be positive")
+	}
+	if c.OIDC.enabled() {
+		if c.OIDC.ClientID == "" {
+			errs = append(errs, "oidc.client_id must not be empty when oidc.issuer is set")
+		}
+		if u, err := url.Parse(c.OIDC.Issuer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			errs = append(errs, fmt.Sprintf("oidc.issuer %q is not a valid URL", c.OIDC.Issuer))
+		}
+	}
+	if c.ActivityPub.DeliveryTimeout <= 0 {
+		errs = append(errs, "activitypub.delivery_timeout must be positive")
+	}
+	if c.Webhook.Timeout <= 0 {
+		errs = append(errs, "webhook.timeout must be positive")
+	}
+	if c.Stream.Broker != "memory" {
+		errs = append(errs, fmt.Sprintf("stream.broker must be memory, got %q", c.Stream.Broker))
+	}
+	if c.Stream.Heartbeat <= 0 || c.Stream.Buffer <= 0 {
+		errs = append(errs, "stream.heartbeat and stream.buffer must be positive")
+	}
+	if c.Jobs.Driver != "db" && c.Jobs.Driver != "memory" {
+		errs = append(errs, fmt.Sprintf("jobs.driver must be db or memory, got %q", c.Jobs.Driver))
+	}
+	if c.Jobs.Workers <= 0 || c.Jobs.MaxAttempts <= 0 {
+		errs = append(errs, "jobs.workers and jobs.max_attempts must be positive")
+	}
+	if c.Jobs.PollInterval <= 0 || c.Jobs.Timeout <= 0 || c.Jobs.BackoffBase <= 0 {
+		errs = append(errs, "jobs.poll_interval, jobs.timeout and jobs.backoff_base must be positive")
+	}
+	switch c.Tracing.Exporter {
+	case "none":
+	case "otlp":
+		if u, err := url.Parse(c.Tracing.Endpoint); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			errs = append(errs, fmt.Sprintf("tracing.endpoint %q is not a valid URL", c.Tracing.Endpoint))
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("tracing.exporter must be none or otlp, got %q", c.Tracing.Exporter))
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		errs = append(errs, "tracing.sample_ratio must be between 0 and 1")
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		errs = append(errs, fmt.Sprintf("log.level must be debug, info, warn or error, got %q", c.Log.Level))
+	}
+	if c.Log.Format != "json" && c.Log.Format != "text" {
+		errs = append(errs, fmt.Sprintf("log.format must be json or text, got %q", c.Log.Format))
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		errs = append(errs, "server.shutdown_timeout must be positive")
+	}
+	if c.Server.DrainDelay < 0 {
+		errs = append(errs, "server.drain_delay must not be negative")
+	}
+	if len(errs) > 0 {
+		return errors.New("invalid config: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (c *Config) dsn() string {
+	return fmt.Sprintf(
+		"%s:%s@tcp(%s:%d)/%s?charset=utf8mb4&parseTime=true&interpolateParams=true&loc=Local",
+		c.DB.User,
+		c.DB.Password,
+		c.DB.Host,
+		c.DB.Port,
+		c.DB.Name,
+	)
+}
+
+// configField は Config の末端の項目1つ分
+type configField struct {
+	key    string // yaml上のパス (db.host)
+	env    string
+	secret bool
+	value  reflect.Value
+}
+
+func (f configField) flagName() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(f.key)
+}
+
+func configFields(v reflect.Value, prefix string) []configField {
+	fields := []configField{}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		key := sf.Tag.Get("yaml")
+		if key == "" || key == "-" {
+			continue
+		}
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct && fv.Type() != reflect.TypeOf(time.Duration(0)) {
+			fields = append(fields, configFields(fv, key)...)
+			continue
+		}
+		fields = append(fields, configField{
+			key:    key,
+			env:    sf.Tag.Get("env"),
+			secret: sf.Tag.Get("secret") == "true",
+			value:  fv,
+		})
+	}
+	return fields
+}
+
+func setConfigValue(v reflect.Value, s string) error {
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Int || v.Kind() == reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case v.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		parts := []string{}
+		for _, p := range strings.Split(s, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				parts = append(parts, p)
+			}
+		}
+		v.Set(reflect.ValueOf(parts))
+	default:
+		return fmt.Errorf("unsupported config type %s", v.Type())
+	}
+	return nil
+}
+
+// flagValue はパースしたフラグを一旦保持し、設定ファイルと環境変数を読んだ後に適用する
+type flagValue struct {
+	field configField
+	raw   *string
+}
+
+func (f flagValue) String() string {
+	if f.raw == nil {
+		return ""
+	}
+	return *f.raw
+}
+
+func (f flagValue) Set(s string) error {
+	if err := setConfigValue(reflect.New(f.field.value.Type()).Elem(), s); err != nil {
+		return err
+	}
+	*f.raw = s
+	return nil
+}
+
+// loadConfig はデフォルト値に設定ファイル・環境変数・フラグの順に上書きした設定を返す
+func loadConfig(name string, args []string) (Config, error) {
+	c := defaultConfig()
+	fields := configFields(reflect.ValueOf(&c).Elem(), "")
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("ISUCONP_CONFIG"), "path to a YAML config file (env ISUCONP_CONFIG)")
+	flagged := map[string]*string{}
+	for _, f := range fields {
+		raw := new(string)
+		flagged[f.key] = raw
+		usage := f.key
+		if f.env != "" {
+			usage += " (env " + f.env + ")"
+		}
+		fs.Var(flagValue{field: f, raw: raw}, f.flagName(), usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+
+	if *configPath != "" {
+		b, err := os.ReadFile(*configPath)
+		if err != nil {
+			return c, err
+		}
+		if err := yaml.Unmarshal(b, &c); err != nil {
+			return c, fmt.Errorf("failed to parse %s: %w", *configPath, err)
+		}
+	}
+
+	for _, f := range fields {
+		if f.env == "" {
+			continue
+		}
+		s, ok := os.LookupEnv(f.env)
+		if !ok || s == "" {
+			continue
+		}
+		if err := setConfigValue(f.value, s); err != nil {
+			return c, fmt.Errorf("failed to read %s from an environment variable %s: %w", f.key, f.env, err)
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(fl *flag.Flag) {
+		for _, f := range fields {
+			if f.flagName() == fl.Name && flagErr == nil {
+				flagErr = setConfigValue(f.value, *flagged[f.key])
+			}
+		}
+	})
+	if flagErr != nil {
+		return c, flagErr
+	}
+
+	return c, c.validate()
+}
+
+// redact は secret な項目を伏せ字にしたコピーを返す
+func (c Config) redact() Config {
+	fields := configFields(reflect.ValueOf(&c).Elem(), "")
+	for _, f := range fields {
+		if !f.secret || f.value.IsZero() {
+			continue
+		}
+		switch f.value.Kind() {
+		case reflect.String:
+			f.value.SetString(redacted)
+		case reflect.Slice:
+			masked := reflect.MakeSlice(f.value.Type(), f.value.Len(), f.value.Len())
+			for i := 0; i < masked.Len(); i++ {
+				masked.Index(i).SetString(redacted)
+			}
+			f.value.Set(masked)
+		}
+	}
+	return c
+}
+
+func printConfig(w io.Writer, c Config) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c.redact()); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// `app config print [flags]` で読み込まれた設定を secret を伏せて表示する
+func runConfigCommand(args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return errors.New("usage: app config print [flags]")
+	}
+	c, err := loadConfig("config print", args[1:])
+	if err != nil {
+		return err
+	}
+	return printConfig(os.Stdout, c)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	csrfFormField = "csrf_token"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+// csrfSecret はセッションに保存されているCSRFトークンの元になる値を返す
+func csrfSecret(r *http.Request) string {
+	secret, _ := getSession(r).Values["csrf_token"].(string)
+	return secret
+}
+
+// maskCSRFToken はBREACH対策として毎回異なるランダムなマスクをかけたトークンを返す
+// フォームに埋め込む値は表示するたびに変わるが、どれもセッションが続く限り有効
+func maskCSRFToken(secret string) string {
+	mask := make([]byte, len(secret))
+	if _, err := crand.Read(mask); err != nil {
+		panic(err)
+	}
+	masked := make([]byte, len(secret)*2)
+	copy(masked, mask)
+	for i := 0; i < len(secret); i++ {
+		masked[len(secret)+i] = mask[i] ^ secret[i]
+	}
+	return base64.RawURLEncoding.EncodeToString(masked)
+}
+
+func unmaskCSRFToken(token string) string {
+	masked, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(masked) == 0 || len(masked)%2 != 0 {
+		return ""
+	}
+	n := len(masked) / 2
+	secret := make([]byte, n)
+	for i := 0; i < n; i++ {
+		secret[i] = masked[i] ^ masked[n+i]
+	}
+	return string(secret)
+}
+
+func validCSRFToken(r *http.Request) bool {
+	secret := csrfSecret(r)
+	if secret == "" {
+		return false
+	}
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		token = r.FormValue(csrfFormField)
+	}
+	return subtle.ConstantTimeCompare([]byte(unmaskCSRFToken(token)), []byte(secret)) == 1
+}
+
+func hostname(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	return host
+}
+
+// sameOrigin はOriginヘッダ、なければRefererヘッダが自サイトを指しているか確認する
+// nginxはポート番号を除いたHostを渡してくるので、ホスト名だけを比較する
+// どちらのヘッダもないリクエストはトークンの検証だけに任せる
+func sameOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Header.Get("Referer")
+	}
+	if source == "" {
+		return true
+	}
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Hostname(), hostname(r.Host)) {
+		return true
+	}
+	for _, origin := range cfg.CSRF.TrustedOrigins {
+		if strings.EqualFold(u.Scheme+"://"+u.Host, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// csrfProtection は GET などの安全なメソッド以外の全てのリクエストでCSRFトークンとOriginを検証する
+// 安全なメソッドではまだトークンを持っていないセッションにトークンを発行する
+func csrfProtection(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Authorization ヘッダーはブラウザが勝手に付けないので、トークンでの認証はCSRFの対象外
+		// ActivityPub の inbox は HTTP Signature で送信元を確認する
+		if _, ok := tokenAuthFrom(r); ok || isStaticPath(r.URL.Path) || isActivityPubInbox(r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if isSafeMethod(r.Method) {
+			if csrfSecret(r) == "" {
+				session := getSession(r)
+				session.Values["csrf_token"] = secureRandomStr(16)
+				if err := session.Save(r, w); err != nil {
+					logError(r, err)
+				}
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if !sameOrigin(r) {
+			requestLogger(r).Warn("csrf: origin mismatch", slog.String("method", r.Method), slog.String("path", r.URL.Path), slog.String("origin", r.Header.Get("Origin")), slog.String("referer", r.Header.Get("Referer")))
+			renderErrorPage(w, r, http.StatusForbidden, tr(r, "error.cross_site"))
+			return
+		}
+		if !validCSRFToken(r) {
+			requestLogger(r).Warn("csrf: invalid token", slog.String("method", r.Method), slog.String("path", r.URL.Path))
+			renderErrorPage(w, r, http.StatusUnprocessableEntity, tr(r, "error.form_expired"))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// postCursor はページの最後の投稿の位置。created_at は秒単位で重なるので id で順序を決める
+type postCursor struct {
+	CreatedAt time.Time
+	ID        int
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// firstPage は先頭のページを表すカーソル。どの投稿よりも後ろを指す
+var firstPage = postCursor{CreatedAt: time.Date(9999, 12, 31, 0, 0, 0, 0, time.Local), ID: math.MaxInt32}
+
+func (c postCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", c.CreatedAt.Unix(), c.ID)))
+}
+
+func decodeCursor(s string) (postCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return postCursor{}, errInvalidCursor
+	}
+	var sec int64
+	var id int
+	if n, err := fmt.Sscanf(string(b), "%d:%d", &sec, &id); err != nil || n != 2 || id <= 0 {
+		return postCursor{}, errInvalidCursor
+	}
+	return postCursor{CreatedAt: time.Unix(sec, 0), ID: id}, nil
+}
+
+// requestCursor はクエリの cursor を読む。無ければ先頭のページ
+// 以前の max_created_at も受け付ける。その場合は同じ秒の投稿を含めて返す
+func requestCursor(r *http.Request) (postCursor, error) {
+	q := r.URL.Query()
+	if s := q.Get("cursor"); s != "" {
+		return decodeCursor(s)
+	}
+	if s := q.Get("max_created_at"); s != "" {
+		t, err := time.Parse(ISO8601Format, s)
+		if err != nil {
+			return postCursor{}, errInvalidCursor
+		}
+		return postCursor{CreatedAt: t, ID: math.MaxInt32}, nil
+	}
+	return firstPage, nil
+}
+
+// selectPostsPage は query で1件多く取得して、続きがあれば次のページのカーソルを返す
+// query の最後の4つのプレースホルダはカーソルの created_at, created_at, id と件数
+func selectPostsPage(ctx context.Context, query string, c postCursor, args ...interface{}) ([]Post, string, error) {
+	args = append(args, c.CreatedAt, c.CreatedAt, c.ID, cfg.PostsPerPage+1)
+	posts := []Post{}
+	if err := db.SelectContext(ctx, &posts, query, args...); err != nil {
+		return nil, "", err
+	}
+	if len(posts) <= cfg.PostsPerPage {
+		return posts, "", nil
+	}
+	posts = posts[:cfg.PostsPerPage]
+	last := posts[len(posts)-1]
+	return posts, postCursor{CreatedAt: last.CreatedAt, ID: last.ID}.String(), nil
+}
+
+func timelinePage(ctx context.Context, c postCursor) ([]Post, string, error) {
+	return selectPostsPage(ctx, indexPostsQuery, c)
+}
+
+func accountPostsPage(ctx context.Context, userID int, c postCursor) ([]Post, string, error) {
+	return selectPostsPage(ctx, accountPostsQuery, c, userID)
+}
+
+// setNextLink は次のページのURLを Link ヘッダーで知らせる
+func setNextLink(w http.ResponseWriter, path, next string) {
+	if next == "" {
+		return
+	}
+	w.Header().Set("Link", fmt.Sprintf(`<%s?cursor=%s>; rel="next"`, path, next))
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strings"
+)
+
+const internalErrorMessage = "error.internal"
+
+// httpError はステータスコードと利用者に見せるメッセージを持つエラー
+// Message はメッセージカタログのキーで、返すときにリクエストの言語にする
+// Err は原因になったエラーで、ログにだけ出す
+type httpError struct {
+	Code    int
+	Message string
+	Err     error
+}
+
+func (e *httpError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%d %s: %v", e.Code, e.Message, e.Err)
+	}
+	return fmt.Sprintf("%d %s", e.Code, e.Message)
+}
+
+func (e *httpError) Unwrap() error {
+	return e.Err
+}
+
+func badRequest(message string) error {
+	return &httpError{Code: http.StatusBadRequest, Message: message}
+}
+
+func unauthorized(message string) error {
+	return &httpError{Code: http.StatusUnauthorized, Message: message}
+}
+
+func forbidden(message string) error {
+	return &httpError{Code: http.StatusForbidden, Message: message}
+}
+
+func notFound(message string) error {
+	return &httpError{Code: http.StatusNotFound, Message: message}
+}
+
+func unprocessable(message string) error {
+	return &httpError{Code: http.StatusUnprocessableEntity, Message: message}
+}
+
+// asHTTPError はエラーをステータスコードに対応付ける
+// 行が見つからなければ404、それ以外の型の無いエラーは500にする
+func asHTTPError(err error) *httpError {
+	var he *httpError
+	if errors.As(err, &he) {
+		return he
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return &httpError{Code: http.StatusNotFound, Message: "error.not_found", Err: err}
+	}
+	return &httpError{Code: http.StatusInternalServerError, Message: internalErrorMessage, Err: err}
+}
+
+// handler はエラーを返すハンドラー
+// エラーが返ったらステータスコードに応じたエラーページかJSONを返す
+type handler func(w http.ResponseWriter, r *http.Request) error
+
+func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mw := &metricsWriter{ResponseWriter: w}
+	err := h(mw, r)
+	if err == nil {
+		return
+	}
+	writeError(mw, r, err)
+}
+
+// writeError はエラーを記録して利用者に返す。すでにレスポンスを書き始めていれば記録だけする
+func writeError(w *metricsWriter, r *http.Request, err error) {
+	he := asHTTPError(err)
+	if he.Code >= 500 {
+		logError(r, err)
+	} else {
+		requestLogger(r).Info("request rejected", slog.Int("status", he.Code), slog.Any("err", err))
+	}
+	if w.status != 0 {
+		return
+	}
+
+	message := tr(r, he.Message)
+	if wantsJSON(r) {
+		writeJSONError(w, he.Code, message)
+		return
+	}
+	renderErrorPage(w, r, he.Code, message)
+}
+
+// wantsJSON はAPIトークンでのアクセスや、Accept か Content-Type がJSONのリクエストならtrue
+// application/activity+json や application/jrd+json のようなJSONの派生も含める
+func wantsJSON(r *http.Request) bool {
+	if _, ok := tokenAuthFrom(r); ok {
+		return true
+	}
+	return strings.HasPrefix(r.URL.Path, "/api/") ||
+		strings.Contains(r.Header.Get("Accept"), "json") ||
+		strings.Contains(r.Header.Get("Content-Type"), "json")
+}
+
+// writeJSONError は writeTokenError と同じ形でエラーを返す
+func writeJSONError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":             strings.ToLower(strings.ReplaceAll(http.StatusText(code), " ", "_")),
+		"error_description": message,
+	})
+}
+
+// renderErrorPage はレイアウト付きのエラーページをステータスコードとともに返す
+func renderErrorPage(w http.ResponseWriter, r *http.Request, code int, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	renderTemplate(r.Context(), w, "error", struct {
+		Me      User
+		Title   string
+		Message string
+	}{getSessionUser(r), http.StatusText(code), message})
+}
+
+// recoverPanic はハンドラーのパニックをスタックトレース付きで記録し、500を返す
+// クライアントの切断で使われる http.ErrAbortHandler はそのまま投げ直す
+func recoverPanic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mw := &metricsWriter{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			requestLogger(r).Error("panic", slog.Any("panic", v), slog.String("stack", string(debug.Stack())))
+			if mw.status != 0 {
+				return
+			}
+			message := tr(r, internalErrorMessage)
+			if wantsJSON(r) {
+				writeJSONError(mw, http.StatusInternalServerError, message)
+				return
+			}
+			renderErrorPage(mw, r, http.StatusInternalServerError, message)
+		}()
+		next.ServeHTTP(mw, r)
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// fakeRows はクエリの結果。SELECT なら Columns と Rows、それ以外は RowsAffected と LastInsertID を使う
+type fakeRows struct {
+	Columns      []string
+	Rows         [][]driver.Value
+	RowsAffected int64
+	LastInsertID int64
+}
+
+// fakeQueryFunc はテストごとにクエリへの応答を返す。知らないクエリにはエラーを返す
+type fakeQueryFunc func(query string, args []driver.Value) (fakeRows, error)
+
+// useFakeDB は db をクエリごとに f を呼ぶだけのデータベースに差し替える
+// MySQL を立てずにハンドラーやジョブを動かすために使う
+func useFakeDB(t *testing.T, f fakeQueryFunc) {
+	t.Helper()
+	old := db
+	db = &instrumentedDB{sqlx.NewDb(sql.OpenDB(fakeConnector{f}), "mysql")}
+	t.Cleanup(func() {
+		db.Close()
+		db = old
+	})
+}
+
+func unknownQuery(query string) (fakeRows, error) {
+	return fakeRows{}, fmt.Errorf("fakedb: unexpected query %q", query)
+}
+
+type fakeConnector struct {
+	f fakeQueryFunc
+}
+
+func (c fakeConnector) Connect(context.Context) (driver.Conn, error) {
+	return &fakeConn{f: c.f}, nil
+}
+
+func (c fakeConnector) Driver() driver.Driver {
+	return fakeDriver{}
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("fakedb: use fakeConnector")
+}
+
+type fakeConn struct {
+	f fakeQueryFunc
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{c: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return fakeTx{}, nil
+}
+
+func (c *fakeConn) run(query string, args []driver.Value) (fakeRows, error) {
+	return c.f(strings.Join(strings.Fields(query), " "), args)
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	c     *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+// 引数の数は確かめない
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	r, err := s.c.run(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return fakeResult{r}, nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	r, err := s.c.run(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeCursor{rows: r}, nil
+}
+
+type fakeResult struct {
+	rows fakeRows
+}
+
+func (r fakeResult) LastInsertId() (int64, error) {
+	return r.rows.LastInsertID, nil
+}
+
+func (r fakeResult) RowsAffected() (int64, error) {
+	return r.rows.RowsAffected, nil
+}
+
+type fakeCursor struct {
+	rows fakeRows
+	pos  int
+}
+
+func (c *fakeCursor) Columns() []string {
+	return c.rows.Columns
+}
+
+func (c *fakeCursor) Close() error {
+	return nil
+}
+
+func (c *fakeCursor) Next(dest []driver.Value) error {
+	if c.pos >= len(c.rows.Rows) {
+		return io.EOF
+	}
+	copy(dest, c.rows.Rows[c.pos])
+	c.pos++
+	return nil
+}
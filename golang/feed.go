@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"goji.io/pat"
+)
+
+// フィードの形式。パスの拡張子で切り替える
+const (
+	feedAtom = "atom"
+	feedRSS  = "rss"
+)
+
+type atomLink struct {
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Href   string `xml:"href,attr"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Body string `xml:",chardata"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomEntry struct {
+	ID        string     `xml:"id"`
+	Title     string     `xml:"title"`
+	Updated   string     `xml:"updated"`
+	Published string     `xml:"published"`
+	Author    atomPerson `xml:"author"`
+	Links     []atomLink `xml:"link"`
+	Content   atomText   `xml:"content"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  *atomPerson `xml:"author,omitempty"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssItem struct {
+	Title       string       `xml:"title"`
+	Link        string       `xml:"link"`
+	Description string       `xml:"description"`
+	Author      string       `xml:"dc:creator"`
+	PubDate     string       `xml:"pubDate"`
+	GUID        rssGUID      `xml:"guid"`
+	Enclosure   rssEnclosure `xml:"enclosure"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	AtomLink      atomLink  `xml:"atom:link"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	AtomNS  string     `xml:"xmlns:atom,attr"`
+	DCNS    string     `xml:"xmlns:dc,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+func absoluteURL(p string) string {
+	return strings.TrimRight(cfg.BaseURL, "/") + p
+}
+
+// feedTitle は本文の1行目を短くしたものをエントリのタイトルにする
+// フィードは誰にでも同じものをキャッシュさせるので、文言はデフォルトの言語にする
+func feedTitle(p Post) string {
+	title := strings.TrimSpace(strings.SplitN(p.Body, "\n", 2)[0])
+	if utf8.RuneCountInString(title) > 40 {
+		title = string([]rune(title)[:40]) + "…"
+	}
+	if title == "" {
+		title = defaultLocale.T("feed.user_title", p.User.AccountName)
+	}
+	return title
+}
+
+// feedContent は画像と本文をHTMLにする。フィードリーダーで画像も表示されるようにする
+func feedContent(p Post) string {
+	return fmt.Sprintf(`<p><img src="%s"></p><p>%s</p>`,
+		template.HTMLEscapeString(absoluteURL(imageURL(p))),
+		strings.Replace(template.HTMLEscapeString(p.Body), "\n", "<br>", -1))
+}
+
+func imageSize(p Post) int64 {
+	fi, err := os.Stat(imageFilePath(p.ID, p.Mime))
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+func renderAtom(title, self, alternate string, author *User, updated time.Time, posts []Post) ([]byte, error) {
+	feed := atomFeed{
+		ID:      absoluteURL(self),
+		Title:   title,
+		Updated: updated.Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: absoluteURL(self)},
+			{Rel: "alternate", Type: "text/html", Href: absoluteURL(alternate)},
+		},
+		Entries: make([]atomEntry, 0, len(posts)),
+	}
+	if author != nil {
+		feed.Author = &atomPerson{Name: author.AccountName, URI: absoluteURL("/@" + author.AccountName)}
+	}
+	for _, p := range posts {
+		postURL := absoluteURL("/posts/" + strconv.Itoa(p.ID))
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:        postURL,
+			Title:     feedTitle(p),
+			Updated:   p.CreatedAt.Format(time.RFC3339),
+			Published: p.CreatedAt.Format(time.RFC3339),
+			Author:    atomPerson{Name: p.User.AccountName, URI: absoluteURL("/@" + p.User.AccountName)},
+			Links: []atomLink{
+				{Rel: "alternate", Type: "text/html", Href: postURL},
+				{Rel: "enclosure", Type: p.Mime, Href: absoluteURL(imageURL(p)), Length: imageSize(p)},
+			},
+			Content: atomText{Type: "html", Body: feedContent(p)},
+		})
+	}
+
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	if err := xml.NewEncoder(&b).Encode(feed); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func renderRSS(title, self, alternate string, updated time.Time, posts []Post) ([]byte, error) {
+	feed := rssFeed{
+		Version: "2.0",
+		AtomNS:  "http://www.w3.org/2005/Atom",
+		DCNS:    "http://purl.org/dc/elements/1.1/",
+		Channel: rssChannel{
+			Title:         title,
+			Link:          absoluteURL(alternate),
+			Description:   title,
+			LastBuildDate: updated.Format(time.RFC1123Z),
+			AtomLink:      atomLink{Rel: "self", Type: "application/rss+xml", Href: absoluteURL(self)},
+			Items:         make([]rssItem, 0, len(posts)),
+		},
+	}
+	for _, p := range posts {
+		postURL := absoluteURL("/posts/" + strconv.Itoa(p.ID))
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       feedTitle(p),
+			Link:        postURL,
+			Description: feedContent(p),
+			Author:      p.User.AccountName,
+			PubDate:     p.CreatedAt.Format(time.RFC1123Z),
+			GUID:        rssGUID{IsPermaLink: true, Value: postURL},
+			Enclosure:   rssEnclosure{URL: absoluteURL(imageURL(p)), Length: imageSize(p), Type: p.Mime},
+		})
+	}
+
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	if err := xml.NewEncoder(&b).Encode(feed); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// serveFeed はフィードを書き出す。ETag と Last-Modified を付けるので
+// If-None-Match や If-Modified-Since が一致すれば 304 を返す
+func serveFeed(w http.ResponseWriter, r *http.Request, format, title, path, alternate string, author *User, updated time.Time, posts []Post) error {
+	var body []byte
+	var err error
+	if format == feedRSS {
+		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+		body, err = renderRSS(title, path+"."+feedRSS, alternate, updated, posts)
+	} else {
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		body, err = renderAtom(title, path+"."+feedAtom, alternate, author, updated, posts)
+	}
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sha1.Sum(body)))
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	http.ServeContent(w, r, "", updated, bytes.NewReader(body))
+	return nil
+}
+
+// feedUpdated は一番新しい投稿の日時を返す。投稿がなければ since を使う
+func feedUpdated(posts []Post, since time.Time) time.Time {
+	if len(posts) > 0 {
+		return posts[0].CreatedAt
+	}
+	return since
+}
+
+func getFeed(w http.ResponseWriter, r *http.Request) error {
+	posts, _, err := timelinePage(r.Context(), firstPage)
+	if err != nil {
+		return err
+	}
+	for i := range posts {
+		value, ok := userCache.Load(posts[i].UserID)
+		if !ok {
+			return fmt.Errorf("feed: user %d not found", posts[i].UserID)
+		}
+		posts[i].User = value.(User)
+	}
+
+	return serveFeed(w, r, pat.Param(r, "format"), "Iscogram", "/feed", "/", nil, feedUpdated(posts, time.Unix(0, 0)), posts)
+}
+
+func getAccountNameFeed(w http.ResponseWriter, r *http.Request) error {
+	accountName := pat.Param(r, "accountName")
+	user := User{}
+	err := db.GetContext(r.Context(), &user, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", accountName)
+	if err != nil {
+		return err
+	}
+
+	posts, _, err := accountPostsPage(r.Context(), user.ID, firstPage)
+	if err != nil {
+		return err
+	}
+	for i := range posts {
+		posts[i].User = user
+	}
+
+	return serveFeed(w, r, pat.Param(r, "format"), defaultLocale.T("feed.user_title", user.AccountName)+" - Iscogram", "/@"+user.AccountName+"/feed", "/@"+user.AccountName,
+		&user, feedUpdated(posts, user.CreatedAt), posts)
+}
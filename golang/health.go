@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// キャッシュの構築が終わるまでは0、終わったら1
+	cacheWarmed int32
+	// シャットダウンが始まったら1
+	shuttingDown int32
+)
+
+const readinessTimeout = 2 * time.Second
+
+var (
+	errCacheNotWarmed = errors.New("caches are not warmed yet")
+	errShuttingDown   = errors.New("server is shutting down")
+)
+
+type healthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+func isReady() bool {
+	return atomic.LoadInt32(&cacheWarmed) == 1
+}
+
+func markReady() {
+	atomic.StoreInt32(&cacheWarmed, 1)
+}
+
+// shutdownStarted は終了処理が始まると閉じられる。SSEのような長い接続はこれを見て切断する
+var shutdownStarted = make(chan struct{})
+
+func markShuttingDown() {
+	if atomic.CompareAndSwapInt32(&shuttingDown, 0, 1) {
+		close(shutdownStarted)
+	}
+}
+
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+func checkResult(err error) healthCheck {
+	if err != nil {
+		return healthCheck{Status: "error", Error: err.Error()}
+	}
+	return healthCheck{Status: "ok"}
+}
+
+func checkImageDir() error {
+	f, err := os.CreateTemp(cfg.ImageDir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
+func checkLifecycle() error {
+	if isShuttingDown() {
+		return errShuttingDown
+	}
+	return nil
+}
+
+func checkCaches() error {
+	if !isReady() {
+		return errCacheNotWarmed
+	}
+	return nil
+}
+
+func writeHealth(w http.ResponseWriter, code int, report healthReport) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(report)
+}
+
+// プロセスが生きていれば常に200を返す
+func getHealthz(w http.ResponseWriter, r *http.Request) error {
+	writeHealth(w, http.StatusOK, healthReport{Status: "ok"})
+	return nil
+}
+
+// リクエストを受け付けられる状態かどうかを依存先ごとに返す
+func getReadyz(w http.ResponseWriter, r *http.Request) error {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	checks := map[string]healthCheck{
+		"lifecycle": checkResult(checkLifecycle()),
+		"database":  checkResult(db.PingContext(ctx)),
+		"memcached": checkResult(memcacheClient.Ping()),
+		"caches":    checkResult(checkCaches()),
+		"image_dir": checkResult(checkImageDir()),
+	}
+
+	report := healthReport{Status: "ok", Checks: checks}
+	code := http.StatusOK
+	for _, c := range checks {
+		if c.Status != "ok" {
+			report.Status = "unavailable"
+			code = http.StatusServiceUnavailable
+			break
+		}
+	}
+
+	writeHealth(w, code, report)
+	return nil
+}
+
+// キャッシュの構築中はヘルスチェック以外のリクエストに503を返す
+func readiness(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isReady() && r.URL.Path != "/healthz" && r.URL.Path != "/readyz" {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/text/feature/plural"
+	"golang.org/x/text/language"
+	"gopkg.in/yaml.v3"
+)
+
+// locales/<BCP 47のタグ>.yaml を置けば言語を追加できる
+//
+//go:embed locales
+var embeddedLocales embed.FS
+
+// ログインしていなくても言語を選べるよう、選んだ言語はクッキーにも保存する
+const localeCookieName = "lang"
+
+// Locale は1つの言語のメッセージカタログ
+type Locale struct {
+	Tag      language.Tag
+	Name     string
+	messages map[string]message
+}
+
+// message は複数形ごとの文言。区別のない言語は other だけを持つ
+type message map[string]string
+
+var pluralForms = [...]string{
+	plural.Other: "other",
+	plural.Zero:  "zero",
+	plural.One:   "one",
+	plural.Two:   "two",
+	plural.Few:   "few",
+	plural.Many:  "many",
+}
+
+var (
+	defaultLocale *Locale
+	locales       map[string]*Locale
+	// localeMatcher に渡した順。先頭がデフォルトの言語
+	localeTags    []language.Tag
+	localeMatcher language.Matcher
+
+	// ユーザーが設定で選んだ言語。選んでいなければ入っていない
+	userLocales = cache{name: "user_locales"}
+)
+
+// loadLocales は埋め込んだカタログを全て読む
+// デフォルトの言語にあって他の言語にないキーは、デフォルトの文言で表示されるので警告だけ出す
+func loadLocales(def string) error {
+	entries, err := fs.ReadDir(embeddedLocales, "locales")
+	if err != nil {
+		return err
+	}
+
+	m := map[string]*Locale{}
+	for _, e := range entries {
+		if path.Ext(e.Name()) != ".yaml" {
+			continue
+		}
+		b, err := fs.ReadFile(embeddedLocales, "locales/"+e.Name())
+		if err != nil {
+			return err
+		}
+		l, err := parseLocale(strings.TrimSuffix(e.Name(), ".yaml"), b)
+		if err != nil {
+			return fmt.Errorf("locale %s: %w", e.Name(), err)
+		}
+		m[l.Tag.String()] = l
+	}
+
+	tag, err := language.Parse(def)
+	if err != nil {
+		return err
+	}
+	d, ok := m[tag.String()]
+	if !ok {
+		return fmt.Errorf("default locale %q is not defined", def)
+	}
+
+	tags := []language.Tag{d.Tag}
+	for _, l := range m {
+		if l == d {
+			continue
+		}
+		tags = append(tags, l.Tag)
+		for key := range d.messages {
+			if _, ok := l.messages[key]; !ok {
+				slog.Warn("missing translation", slog.String("locale", l.Tag.String()), slog.String("key", key))
+			}
+		}
+	}
+	sort.Slice(tags[1:], func(i, j int) bool { return tags[i+1].String() < tags[j+1].String() })
+
+	defaultLocale, locales, localeTags = d, m, tags
+	localeMatcher = language.NewMatcher(tags)
+	return nil
+}
+
+func parseLocale(name string, b []byte) (*Locale, error) {
+	tag, err := language.Parse(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var f struct {
+		Name     string               `yaml:"name"`
+		Messages map[string]yaml.Node `yaml:"messages"`
+	}
+	if err := yaml.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+
+	l := &Locale{Tag: tag, Name: f.Name, messages: make(map[string]message, len(f.Messages))}
+	for key, node := range f.Messages {
+		if node.Kind == yaml.ScalarNode {
+			l.messages[key] = message{"other": node.Value}
+			continue
+		}
+		msg := message{}
+		if err := node.Decode(&msg); err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		for form := range msg {
+			if !validPluralForm(form) {
+				return nil, fmt.Errorf("%s: unknown plural form %q", key, form)
+			}
+		}
+		if _, ok := msg["other"]; !ok {
+			return nil, fmt.Errorf("%s: other is required", key)
+		}
+		l.messages[key] = msg
+	}
+	return l, nil
+}
+
+func validPluralForm(form string) bool {
+	for _, f := range pluralForms {
+		if f == form {
+			return true
+		}
+	}
+	return false
+}
+
+// availableLocales は設定画面などに並べる言語。デフォルトの言語が先頭
+func availableLocales() []*Locale {
+	ls := make([]*Locale, 0, len(localeTags))
+	for _, tag := range localeTags {
+		ls = append(ls, locales[tag.String()])
+	}
+	return ls
+}
+
+func (l *Locale) String() string {
+	return l.Tag.String()
+}
+
+// text は key の form の文言を返す
+// 見つからなければデフォルトの言語、それもなければキーをそのまま返す
+func (l *Locale) text(key, form string) string {
+	for _, c := range []*Locale{l, defaultLocale} {
+		if msg, ok := c.messages[key]; ok {
+			if s, ok := msg[form]; ok {
+				return s
+			}
+			return msg["other"]
+		}
+	}
+	return key
+}
+
+func (l *Locale) pluralForm(n int) string {
+	if n < 0 {
+		n = -n
+	}
+	return pluralForms[plural.Cardinal.MatchPlural(l.Tag, n, 0, 0, 0, 0)]
+}
+
+// T は key の文言に args を埋める
+func (l *Locale) T(key string, args ...interface{}) string {
+	return formatMessage(l.text(key, "other"), args)
+}
+
+// N は n に合った複数形の文言に args を埋める。args がなければ n を埋める
+func (l *Locale) N(key string, n int, args ...interface{}) string {
+	if len(args) == 0 {
+		args = []interface{}{n}
+	}
+	return formatMessage(l.text(key, l.pluralForm(n)), args)
+}
+
+// Ago は t から今までの経過時間を「5分前」のように表す
+func (l *Locale) Ago(t time.Time) string {
+	const day = 24 * time.Hour
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return l.T("time.just_now")
+	case d < time.Hour:
+		return l.N("time.minutes_ago", int(d/time.Minute))
+	case d < day:
+		return l.N("time.hours_ago", int(d/time.Hour))
+	case d < 7*day:
+		return l.N("time.days_ago", int(d/day))
+	case d < 30*day:
+		return l.N("time.weeks_ago", int(d/(7*day)))
+	case d < 365*day:
+		return l.N("time.months_ago", int(d/(30*day)))
+	}
+	return l.N("time.years_ago", int(d/(365*day)))
+}
+
+// formatMessage は %s だけを使う前提で、引数を全て文字列にしてから埋める
+func formatMessage(s string, args []interface{}) string {
+	if len(args) == 0 {
+		return s
+	}
+	strs := make([]interface{}, len(args))
+	for i, a := range args {
+		strs[i] = fmt.Sprint(a)
+	}
+	return fmt.Sprintf(s, strs...)
+}
+
+// htmlMessage はテンプレートに埋める文言を作る
+// 文言と引数はエスケープするが、template.HTML の引数 (span で作った要素など) はそのまま埋める
+func htmlMessage(s string, args []interface{}) template.HTML {
+	escaped := make([]interface{}, len(args))
+	for i, a := range args {
+		escaped[i] = escapeHTMLArg(a)
+	}
+	return template.HTML(formatMessage(template.HTMLEscapeString(s), escaped))
+}
+
+func escapeHTMLArg(v interface{}) string {
+	if h, ok := v.(template.HTML); ok {
+		return string(h)
+	}
+	return template.HTMLEscapeString(fmt.Sprint(v))
+}
+
+// localeFuncs はテンプレートを組み立てるときに言語ごとに渡す関数
+func localeFuncs(l *Locale) template.FuncMap {
+	return template.FuncMap{
+		"t": func(key string, args ...interface{}) template.HTML {
+			return htmlMessage(l.text(key, "other"), args)
+		},
+		"tn": func(key string, n int, args ...interface{}) template.HTML {
+			if len(args) == 0 {
+				args = []interface{}{n}
+			}
+			return htmlMessage(l.text(key, l.pluralForm(n)), args)
+		},
+		"ago":     l.Ago,
+		"locale":  l.String,
+		"locales": availableLocales,
+		"span": func(class string, v interface{}) template.HTML {
+			return template.HTML(`<span class="` + template.HTMLEscapeString(class) + `">` + escapeHTMLArg(v) + `</span>`)
+		},
+		"code": func(v interface{}) template.HTML {
+			return template.HTML("<code>" + escapeHTMLArg(v) + "</code>")
+		},
+	}
+}
+
+type localeKey struct{}
+
+// localize はリクエストの言語を決めてコンテキストに入れる
+// セッションを読むので sessionLifecycle の後に置く
+func localize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 画像などにセッションを読みに行かない
+		if isStaticPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := context.WithValue(r.Context(), localeKey{}, requestLocale(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestLocale はユーザーの設定、lang クッキー、Accept-Language の順に言語を選ぶ
+func requestLocale(r *http.Request) *Locale {
+	if me := getSessionUser(r); isLogin(me) {
+		if l, ok := userLocale(me.ID); ok {
+			return l
+		}
+	}
+	if c, err := r.Cookie(localeCookieName); err == nil {
+		if l, ok := locales[c.Value]; ok {
+			return l
+		}
+	}
+	return acceptLocale(r)
+}
+
+// acceptLocale は Accept-Language に最も合う言語を選ぶ。合うものがなければデフォルトの言語
+func acceptLocale(r *http.Request) *Locale {
+	tags, _, _ := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	_, i, conf := localeMatcher.Match(tags...)
+	// 合うものがないとき Matcher は英語を選ぶことがあるので、デフォルトの言語にする
+	if conf == language.No {
+		return defaultLocale
+	}
+	return locales[localeTags[i].String()]
+}
+
+func userLocale(uid int) (*Locale, bool) {
+	v, ok := userLocales.Load(uid)
+	if !ok {
+		return nil, false
+	}
+	l, ok := locales[v.(string)]
+	return l, ok
+}
+
+// localeFrom はリクエストの言語を返す。決まっていなければデフォルトの言語
+func localeFrom(ctx context.Context) *Locale {
+	if l, ok := ctx.Value(localeKey{}).(*Locale); ok {
+		return l
+	}
+	return defaultLocale
+}
+
+// tr はフラッシュメッセージなどをリクエストの言語にする
+func tr(r *http.Request, key string, args ...interface{}) string {
+	return localeFrom(r.Context()).T(key, args...)
+}
+
+func setLocaleCookie(w http.ResponseWriter, value string) {
+	c := &http.Cookie{
+		Name:     localeCookieName,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   365 * 24 * 60 * 60,
+		Secure:   cfg.Session.CookieSecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if value == "" {
+		c.MaxAge = -1
+	}
+	http.SetCookie(w, c)
+}
+
+// getLocale はログインしていない人向けに、言語をクッキーにだけ保存して元のページに戻す
+func getLocale(w http.ResponseWriter, r *http.Request) error {
+	if l, ok := locales[r.URL.Query().Get("lang")]; ok {
+		setLocaleCookie(w, l.String())
+	}
+
+	// 他のサイトに飛ばないよう、Referer はパスとクエリだけを使う
+	back := "/"
+	if u, err := url.Parse(r.Referer()); err == nil && u.Host == r.Host && u.Path != "" {
+		back = u.RequestURI()
+	}
+	http.Redirect(w, r, back, http.StatusFound)
+	return nil
+}
+
+// postSettingsLocale は言語の設定を保存する。空ならブラウザの設定に合わせる
+func postSettingsLocale(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	value := r.FormValue("locale")
+	l, ok := locales[value]
+	if value != "" && !ok {
+		http.Redirect(w, r, "/settings", http.StatusFound)
+		return nil
+	}
+
+	if value == "" {
+		_, err := db.ExecContext(r.Context(), "DELETE FROM `user_locales` WHERE `user_id` = ?", me.ID)
+		if err != nil {
+			return err
+		}
+		userLocales.Delete(me.ID)
+		l = acceptLocale(r)
+	} else {
+		query := "INSERT INTO `user_locales` (`user_id`, `locale`) VALUES (?,?) ON DUPLICATE KEY UPDATE `locale` = VALUES(`locale`)"
+		_, err := db.ExecContext(r.Context(), query, me.ID, value)
+		if err != nil {
+			return err
+		}
+		userLocales.Store(me.ID, value)
+	}
+	setLocaleCookie(w, value)
+
+	session := getSession(r)
+	session.Values["notice"] = l.T("flash.locale_changed")
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/settings", http.StatusFound)
+	return nil
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ジョブの状態。成功したジョブは行ごと消すので、残るのは実行待ちと再試行を使い切ったものだけ
+const (
+	jobPending = "pending"
+	jobDead    = "dead"
+)
+
+// ジョブの種類
+const (
+	jobWriteImage      = "image.write"
+	jobReconcileCounts = "counts.reconcile"
+	jobDeliverWebhook  = "webhook.deliver"
+)
+
+type Job struct {
+	ID          int64     `db:"id"`
+	Kind        string    `db:"kind"`
+	Payload     []byte    `db:"payload"`
+	Status      string    `db:"status"`
+	Attempts    int       `db:"attempts"`
+	MaxAttempts int       `db:"max_attempts"`
+	UniqueKey   string    `db:"unique_key"`
+	RunAt       time.Time `db:"run_at"`
+	LastError   string    `db:"last_error"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+type JobStat struct {
+	Kind   string    `db:"kind"`
+	Status string    `db:"status"`
+	Count  int       `db:"count"`
+	Oldest time.Time `db:"oldest"`
+}
+
+// JobQueue はジョブの置き場所。本番はDB、開発やテストではプロセス内のものを使う
+type JobQueue interface {
+	// Enqueue はジョブを追加する。UniqueKey が同じジョブが残っていれば何もしない
+	Enqueue(j Job) error
+	// Claim は実行時刻を過ぎたジョブを1件取り出す。無ければ nil
+	// 取り出したジョブは lease の間は他のワーカーに渡さない
+	Claim(lease time.Duration) (*Job, error)
+	Done(j Job) error
+	// Fail は失敗したジョブを retryAt に再実行する。dead なら再実行せずに残す
+	Fail(j Job, cause error, retryAt time.Time, dead bool) error
+	// Requeue は再試行を使い切ったジョブを実行待ちに戻す
+	Requeue(id int64) error
+	Stats() ([]JobStat, error)
+	Dead(limit int) ([]Job, error)
+}
+
+// jobHandler には取り出したジョブを渡す。Attempts を見れば最後の試行かどうか分かる
+type jobHandler func(ctx context.Context, j Job) error
+
+// jobSchedule は Every ごとに1回だけ実行するジョブ
+type jobSchedule struct {
+	Kind  string
+	Every func() time.Duration
+}
+
+var (
+	jobQueue JobQueue
+	jobWake  = make(chan struct{}, 1)
+
+	jobHandlers = map[string]jobHandler{
+		jobWriteImage:      runWriteImage,
+		jobReconcileCounts: runReconcileCounts,
+		jobDeliverWebhook:  runDeliverWebhook,
+	}
+	jobSchedules = []jobSchedule{
+		{Kind: jobReconcileCounts, Every: func() time.Duration { return cfg.Jobs.ReconcileInterval }},
+	}
+)
+
+func newJobQueue(c JobsConfig) (JobQueue, error) {
+	switch c.Driver {
+	case "db":
+		return dbJobQueue{}, nil
+	case "memory":
+		return newMemoryJobQueue(), nil
+	}
+	return nil, fmt.Errorf("unknown jobs driver %q", c.Driver)
+}
+
+func enqueueJob(kind string, payload interface{}) error {
+	return scheduleJob(kind, payload, time.Now(), "")
+}
+
+// scheduleJob は at 以降に実行するジョブを追加する
+func scheduleJob(kind string, payload interface{}, at time.Time, uniqueKey string) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	err = jobQueue.Enqueue(Job{Kind: kind, Payload: data, MaxAttempts: cfg.Jobs.MaxAttempts, UniqueKey: uniqueKey, RunAt: at})
+	if err != nil {
+		return err
+	}
+	if !at.After(time.Now()) {
+		select {
+		case jobWake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func jobBackoff(attempts int) time.Duration {
+	d := cfg.Jobs.BackoffBase
+	for i := 1; i < attempts && d < cfg.Jobs.BackoffMax; i++ {
+		d *= 2
+	}
+	if d > cfg.Jobs.BackoffMax {
+		d = cfg.Jobs.BackoffMax
+	}
+	return d
+}
+
+// runJob はジョブを1件実行する。panic しても失敗として扱う
+func runJob(ctx context.Context, j Job) (err error) {
+	h, ok := jobHandlers[j.Kind]
+	if !ok {
+		return fmt.Errorf("unknown job kind %q", j.Kind)
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("panic: %v", v)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(ctx, cfg.Jobs.Timeout)
+	defer cancel()
+	return h(ctx, j)
+}
+
+func workJob(ctx context.Context) bool {
+	j, err := jobQueue.Claim(cfg.Jobs.Timeout + jobBackoff(1))
+	if err != nil {
+		slog.Error("workJob failed", slog.Any("err", err))
+		return false
+	}
+	if j == nil {
+		return false
+	}
+
+	err = runJob(ctx, *j)
+	if err == nil {
+		if err := jobQueue.Done(*j); err != nil {
+			slog.Error("workJob failed", slog.Any("err", err))
+		}
+		return true
+	}
+
+	_, known := jobHandlers[j.Kind]
+	dead := !known || j.Attempts >= j.MaxAttempts
+	slog.Warn("job failed", slog.Int64("job_id", j.ID), slog.String("kind", j.Kind), slog.Int("attempts", j.Attempts), slog.Bool("dead", dead), slog.Any("err", err))
+	if err := jobQueue.Fail(*j, err, time.Now().Add(jobBackoff(j.Attempts)), dead); err != nil {
+		slog.Error("workJob failed", slog.Any("err", err))
+	}
+	return true
+}
+
+// scheduleJobs は定期実行のジョブを次の区切りの時刻に入れておく
+// UniqueKey に時刻を含めるので、複数のプロセスが同時に入れても1件になる
+func scheduleJobs() {
+	now := time.Now()
+	for _, s := range jobSchedules {
+		every := s.Every()
+		if every <= 0 {
+			continue
+		}
+		at := now.Truncate(every).Add(every)
+		err := scheduleJob(s.Kind, struct{}{}, at, s.Kind+"@"+strconv.FormatInt(at.Unix(), 10))
+		if err != nil {
+			slog.Error("scheduleJobs failed", slog.Any("err", err))
+		}
+	}
+}
+
+// startJobWorkers は cfg.Jobs.Workers 個のワーカーでジョブを実行する
+func startJobWorkers() {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+
+	for i := 0; i < cfg.Jobs.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(cfg.Jobs.PollInterval)
+			defer ticker.Stop()
+			for {
+				for ctx.Err() == nil && workJob(ctx) {
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				case <-jobWake:
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			scheduleJobs()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// 止める前に実行できるジョブを片付ける
+	// memory のキューだと残ったジョブは消え、画像がファイルに書き出されずにDBに残り続ける
+	onFlush(func(flushCtx context.Context) error {
+		for flushCtx.Err() == nil && workJob(flushCtx) {
+		}
+		return flushCtx.Err()
+	})
+	onShutdown(func(shutdownCtx context.Context) error {
+		cancel()
+		select {
+		case <-done:
+			return nil
+		case <-shutdownCtx.Done():
+			return shutdownCtx.Err()
+		}
+	})
+}
+
+// dbJobQueue は jobs テーブルをキューにする
+type dbJobQueue struct{}
+
+func (dbJobQueue) Enqueue(j Job) error {
+	_, err := db.Exec(
+		"INSERT IGNORE INTO `jobs` (`kind`, `payload`, `status`, `max_attempts`, `unique_key`, `run_at`) VALUES (?,?,?,?,NULLIF(?, ''),?)",
+		j.Kind, j.Payload, jobPending, j.MaxAttempts, j.UniqueKey, j.RunAt,
+	)
+	return err
+}
+
+func (dbJobQueue) Claim(lease time.Duration) (*Job, error) {
+	candidates := []Job{}
+	err := db.Select(&candidates,
+		"SELECT `id`, `kind`, `payload`, `status`, `attempts`, `max_attempts`, `run_at` FROM `jobs` "+
+			"WHERE `status` = ? AND `run_at` <= ? ORDER BY `run_at` LIMIT 10",
+		jobPending, time.Now(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	// 他のワーカーと取り合いになったら次の候補を試す
+	for _, j := range candidates {
+		result, err := db.Exec(
+			"UPDATE `jobs` SET `attempts` = `attempts` + 1, `run_at` = ? WHERE `id` = ? AND `status` = ? AND `attempts` = ?",
+			time.Now().Add(lease), j.ID, jobPending, j.Attempts,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if n, _ := result.RowsAffected(); n == 1 {
+			j.Attempts++
+			return &j, nil
+		}
+	}
+	return nil, nil
+}
+
+func (dbJobQueue) Done(j Job) error {
+	_, err := db.Exec("DELETE FROM `jobs` WHERE `id` = ?", j.ID)
+	return err
+}
+
+func (dbJobQueue) Fail(j Job, cause error, retryAt time.Time, dead bool) error {
+	status := jobPending
+	if dead {
+		status = jobDead
+	}
+	_, err := db.Exec(
+		"UPDATE `jobs` SET `status` = ?, `run_at` = ?, `last_error` = ? WHERE `id` = ?",
+		status, retryAt, truncate(cause.Error(), 255), j.ID,
+	)
+	return err
+}
+
+func (dbJobQueue) Requeue(id int64) error {
+	_, err := db.Exec("UPDATE `jobs` SET `status` = ?, `attempts` = 0, `run_at` = ? WHERE `id` = ? AND `status` = ?",
+		jobPending, time.Now(), id, jobDead)
+	return err
+}
+
+func (dbJobQueue) Stats() ([]JobStat, error) {
+	stats := []JobStat{}
+	err := db.Select(&stats, "SELECT `kind`, `status`, COUNT(*) AS `count`, MIN(`run_at`) AS `oldest` FROM `jobs` GROUP BY `kind`, `status` ORDER BY `kind`, `status`")
+	return stats, err
+}
+
+func (dbJobQueue) Dead(limit int) ([]Job, error) {
+	jobs := []Job{}
+	err := db.Select(&jobs,
+		"SELECT `id`, `kind`, `payload`, `status`, `attempts`, `max_attempts`, `run_at`, `last_error`, `created_at` FROM `jobs` "+
+			"WHERE `status` = ? ORDER BY `id` DESC LIMIT ?",
+		jobDead, limit,
+	)
+	return jobs, err
+}
+
+// memoryJobQueue はプロセス内だけのキュー。再起動すると実行待ちのジョブは消える
+type memoryJobQueue struct {
+	mu     sync.Mutex
+	lastID int64
+	jobs   map[int64]*Job
+}
+
+func newMemoryJobQueue() *memoryJobQueue {
+	return &memoryJobQueue{jobs: map[int64]*Job{}}
+}
+
+func (q *memoryJobQueue) Enqueue(j Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if j.UniqueKey != "" {
+		for _, o := range q.jobs {
+			if o.UniqueKey == j.UniqueKey {
+				return nil
+			}
+		}
+	}
+	q.lastID++
+	j.ID = q.lastID
+	j.Status = jobPending
+	j.CreatedAt = time.Now()
+	q.jobs[j.ID] = &j
+	return nil
+}
+
+func (q *memoryJobQueue) Claim(lease time.Duration) (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	var next *Job
+	for _, j := range q.jobs {
+		if j.Status == jobPending && !j.RunAt.After(now) && (next == nil || j.RunAt.Before(next.RunAt)) {
+			next = j
+		}
+	}
+	if next == nil {
+		return nil, nil
+	}
+	next.Attempts++
+	next.RunAt = now.Add(lease)
+	j := *next
+	return &j, nil
+}
+
+func (q *memoryJobQueue) Done(j Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.jobs, j.ID)
+	return nil
+}
+
+func (q *memoryJobQueue) Fail(j Job, cause error, retryAt time.Time, dead bool) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	o, ok := q.jobs[j.ID]
+	if !ok {
+		return nil
+	}
+	if dead {
+		o.Status = jobDead
+	}
+	o.RunAt = retryAt
+	o.LastError = truncate(cause.Error(), 255)
+	return nil
+}
+
+func (q *memoryJobQueue) Requeue(id int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if o, ok := q.jobs[id]; ok && o.Status == jobDead {
+		o.Status = jobPending
+		o.Attempts = 0
+		o.RunAt = time.Now()
+	}
+	return nil
+}
+
+func (q *memoryJobQueue) Stats() ([]JobStat, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	byKey := map[[2]string]*JobStat{}
+	for _, j := range q.jobs {
+		k := [2]string{j.Kind, j.Status}
+		s, ok := byKey[k]
+		if !ok {
+			s = &JobStat{Kind: j.Kind, Status: j.Status, Oldest: j.RunAt}
+			byKey[k] = s
+		}
+		s.Count++
+		if j.RunAt.Before(s.Oldest) {
+			s.Oldest = j.RunAt
+		}
+	}
+	stats := make([]JobStat, 0, len(byKey))
+	for _, s := range byKey {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Kind != stats[j].Kind {
+			return stats[i].Kind < stats[j].Kind
+		}
+		return stats[i].Status < stats[j].Status
+	})
+	return stats, nil
+}
+
+func (q *memoryJobQueue) Dead(limit int) ([]Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := []Job{}
+	for _, j := range q.jobs {
+		if j.Status == jobDead {
+			jobs = append(jobs, *j)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID > jobs[j].ID })
+	if len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+	return jobs, nil
+}
+
+type imageJob struct {
+	PostID int `json:"post_id"`
+}
+
+// writeImageFile は画像を一時ファイルに書いてから置き換える
+// 書きかけのファイルを配信しないようにするため
+func writeImageFile(pid int, mime string, data []byte) error {
+	name := imageFilePath(pid, mime)
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// runWriteImage はDBに入れておいた画像をファイルに書き出し、DBからは消す
+// 書き出すまでは getImage がDBから返す
+func runWriteImage(ctx context.Context, j Job) error {
+	payload := imageJob{}
+	if err := json.Unmarshal(j.Payload, &payload); err != nil {
+		return err
+	}
+	p := Post{}
+	err := db.GetContext(ctx, &p, "SELECT `id`, `mime`, `imgdata` FROM `posts` WHERE `id` = ?", payload.PostID)
+	if err != nil {
+		return err
+	}
+	if len(p.Imgdata) == 0 {
+		return nil
+	}
+	if err := writeImageFile(p.ID, p.Mime, p.Imgdata); err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "UPDATE `posts` SET `imgdata` = '' WHERE `id` = ?", p.ID)
+	return err
+}
+
+// runReconcileCounts はオンメモリのコメント数をDBの値に合わせる
+// キャッシュは実行したプロセスのものしか直らないので、アプリは1プロセスで動かす前提
+// 数え終わってから直すまでの間にコメントが増減しないよう、その間は書き込みを止める
+func runReconcileCounts(ctx context.Context, j Job) error {
+	commentCountsMu.Lock()
+	defer commentCountsMu.Unlock()
+
+	postCounts := []idCount{}
+	err := db.SelectContext(ctx, &postCounts, "SELECT `post_id` AS `id`, COUNT(*) AS `count` FROM `comments` GROUP BY `post_id`")
+	if err != nil {
+		return err
+	}
+	userCounts := []idCount{}
+	err = db.SelectContext(ctx, &userCounts, "SELECT `user_id` AS `id`, COUNT(*) AS `count` FROM `comments` GROUP BY `user_id`")
+	if err != nil {
+		return err
+	}
+
+	fixed := 0
+	reconcile := func(m *cache, counts []idCount) {
+		seen := make(map[int]bool, len(counts))
+		for _, c := range counts {
+			seen[c.ID] = true
+			if value, ok := m.Load(c.ID); !ok || value.(int) != c.Count {
+				m.Store(c.ID, c.Count)
+				fixed++
+			}
+		}
+		m.Range(func(key, value interface{}) bool {
+			if !seen[key.(int)] && value.(int) != 0 {
+				m.Store(key, 0)
+				fixed++
+			}
+			return true
+		})
+	}
+	reconcile(&count, postCounts)
+	reconcile(&userCommentCache, userCounts)
+
+	if fixed > 0 {
+		slog.Info("reconciled comment counts", slog.Int("fixed", fixed))
+	}
+	return nil
+}
+
+func getAdminJobs(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+
+	if me.Authority == 0 {
+		return forbidden("error.forbidden")
+	}
+
+	stats, err := jobQueue.Stats()
+	if err != nil {
+		return err
+	}
+	dead, err := jobQueue.Dead(100)
+	if err != nil {
+		return err
+	}
+
+	return renderTemplate(r.Context(), w, "jobs", struct {
+		Stats     []JobStat
+		Dead      []Job
+		Me        User
+		CSRFToken string
+		Flash     string
+	}{stats, dead, me, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+func postAdminJobsRetry(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+
+	if me.Authority == 0 {
+		return forbidden("error.forbidden")
+	}
+
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		return badRequest("error.bad_request")
+	}
+
+	if err := jobQueue.Requeue(id); err != nil {
+		return err
+	}
+	select {
+	case jobWake <- struct{}{}:
+	default:
+	}
+
+	http.Redirect(w, r, "/admin/jobs", http.StatusFound)
+	return nil
+}
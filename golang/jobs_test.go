@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// 失敗したジョブは max_attempts まで再実行して dead になり、Requeue でもう一度実行される
+func TestJobRetryDeadRequeue(t *testing.T) {
+	const kind = "test.flaky"
+	prevCfg, prevQueue := cfg, jobQueue
+	t.Cleanup(func() {
+		cfg, jobQueue = prevCfg, prevQueue
+		delete(jobHandlers, kind)
+	})
+	cfg.Jobs.MaxAttempts = 2
+	cfg.Jobs.BackoffBase = time.Nanosecond
+	cfg.Jobs.BackoffMax = time.Nanosecond
+	q := newMemoryJobQueue()
+	jobQueue = q
+
+	calls, failing := 0, true
+	jobHandlers[kind] = func(ctx context.Context, j Job) error {
+		calls++
+		if failing {
+			return errors.New("flaky")
+		}
+		return nil
+	}
+
+	if err := enqueueJob(kind, struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i := 1; i <= 2; i++ {
+		time.Sleep(time.Millisecond)
+		if !workJob(ctx) {
+			t.Fatalf("attempt %d: no job was claimed", i)
+		}
+		dead, err := q.Dead(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := i / 2; len(dead) != want {
+			t.Fatalf("attempt %d: %d dead jobs, want %d", i, len(dead), want)
+		}
+	}
+
+	time.Sleep(time.Millisecond)
+	if workJob(ctx) {
+		t.Fatal("a dead job was claimed again")
+	}
+	dead, _ := q.Dead(10)
+	if dead[0].Attempts != 2 || dead[0].LastError != "flaky" {
+		t.Errorf("dead job = %+v, want 2 attempts and last_error flaky", dead[0])
+	}
+
+	failing = false
+	if err := q.Requeue(dead[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if !workJob(ctx) {
+		t.Fatal("the requeued job was not claimed")
+	}
+	if calls != 3 {
+		t.Errorf("handler called %d times, want 3", calls)
+	}
+	stats, _ := q.Stats()
+	if len(stats) != 0 {
+		t.Errorf("stats = %+v, want the job to be gone", stats)
+	}
+}
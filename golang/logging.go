@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"goji.io/middleware"
+)
+
+// logLevel は起動中でも内部向けのポートの /debug/loglevel から変えられる
+var logLevel = new(slog.LevelVar)
+
+// requestInfo はログに載せるリクエストの情報。ユーザーIDはセッションを読んだときに埋まる
+type requestInfo struct {
+	ID      string
+	Route   string
+	Handler string
+	UserID  int
+}
+
+type requestInfoKey struct{}
+
+// nginx の $request_id などをそのまま使う。ログを汚さないよう形をチェックする
+var requestIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// setupLogging は slog を標準のロガーにする。log.Print も同じ形式で出力される
+func setupLogging(c LogConfig) error {
+	if err := logLevel.UnmarshalText([]byte(c.Level)); err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(newLogHandler(os.Stdout, c.Format)))
+	return nil
+}
+
+func newLogHandler(w io.Writer, format string) slog.Handler {
+	opts := &slog.HandlerOptions{Level: logLevel}
+	if format == "text" {
+		return slog.NewTextHandler(w, opts)
+	}
+	return slog.NewJSONHandler(w, opts)
+}
+
+func requestInfoFrom(r *http.Request) *requestInfo {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+// handlerName はマッチしたハンドラーの関数名を返す
+func handlerName(r *http.Request) string {
+	h := middleware.Handler(r.Context())
+	if h == nil {
+		return ""
+	}
+	// http.HandlerFunc と handler は関数そのものの名前を使う
+	if v := reflect.ValueOf(h); v.Kind() == reflect.Func {
+		if fn := runtime.FuncForPC(v.Pointer()); fn != nil {
+			// main.getIndex のパッケージ名を取る
+			name := fn.Name()
+			name = name[strings.LastIndex(name, "/")+1:]
+			return name[strings.Index(name, ".")+1:]
+		}
+	}
+	return fmt.Sprintf("%T", h)
+}
+
+// requestLogger はリクエストIDやハンドラー名を付けたロガーを返す
+func requestLogger(r *http.Request) *slog.Logger {
+	info := requestInfoFrom(r)
+	return slog.With(
+		slog.String("request_id", info.ID),
+		slog.String("route", info.Route),
+		slog.String("handler", info.Handler),
+		slog.Int("user_id", info.UserID),
+	)
+}
+
+// logError はハンドラーの中で起きたエラーを記録する
+func logError(r *http.Request, err error) {
+	requestLogger(r).Error("handler error", slog.Any("err", err))
+}
+
+// accessLog はリクエストIDを振り、処理が終わったらアクセスログを出す
+// ヘルスチェックは数が多いので debug にする
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get("X-Request-Id")
+		if !requestIDRegexp.MatchString(id) {
+			id = secureRandomStr(8)
+		}
+		w.Header().Set("X-Request-Id", id)
+
+		info := &requestInfo{ID: id, Route: routeName(r), Handler: handlerName(r)}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+
+		sw := &metricsWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		level := slog.LevelInfo
+		if info.Route == "/healthz" || info.Route == "/readyz" {
+			level = slog.LevelDebug
+		}
+		if !cfg.Log.AccessLog && level < slog.LevelWarn {
+			return
+		}
+		slog.LogAttrs(r.Context(), level, "access",
+			slog.String("request_id", id),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("route", info.Route),
+			slog.String("handler", info.Handler),
+			slog.Int("user_id", info.UserID),
+			slog.Int("status", sw.Status()),
+			slog.Int64("bytes", sw.bytes),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("ip", clientIP(r)),
+		)
+	})
+}
+
+// serveLogLevel は内部向けのポートでログレベルを確認、変更する
+// curl -X PUT -d debug localhost:6060/debug/loglevel
+func serveLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		b, err := io.ReadAll(io.LimitReader(r.Body, 64))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(strings.TrimSpace(string(b)))); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, err)
+			return
+		}
+		logLevel.Set(level)
+		slog.Info("log level changed", slog.String("level", level.String()))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintln(w, logLevel.Level())
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	lockoutKindAccount = "account"
+	lockoutKindIP      = "ip"
+)
+
+type LoginLockout struct {
+	ID          int       `db:"id"`
+	Kind        string    `db:"kind"`
+	Target      string    `db:"target"`
+	Failures    int       `db:"failures"`
+	LastIP      string    `db:"last_ip"`
+	LockedUntil time.Time `db:"locked_until"`
+	UpdatedAt   time.Time `db:"updated_at"`
+}
+
+// CaptchaVerifier はログインの失敗が続いたときに追加の確認を求めるためのフック
+// 実際のCAPTCHAサービスを使う場合はこれを実装して captcha に設定する
+type CaptchaVerifier interface {
+	// Required は直近の失敗回数からCAPTCHAを求めるかどうかを返す
+	Required(failures int64) bool
+	// Verify はフォームに含まれるCAPTCHAの回答を検証する
+	Verify(r *http.Request) bool
+	// Widget はログインフォームに埋め込むHTML
+	Widget() template.HTML
+}
+
+type noCaptcha struct{}
+
+func (noCaptcha) Required(int64) bool       { return false }
+func (noCaptcha) Verify(*http.Request) bool { return true }
+func (noCaptcha) Widget() template.HTML     { return "" }
+
+var captcha CaptchaVerifier = noCaptcha{}
+
+// captchaWidget はログインフォームに表示するCAPTCHAを返す
+// 送信されるアカウント名は表示時点ではわからないので、IPアドレスの失敗回数で判断する
+func captchaWidget(r *http.Request) template.HTML {
+	n, err := limitStore.Get(failureKey(lockoutKindIP, clientIP(r)))
+	if err != nil {
+		logError(r, err)
+	}
+	if !captcha.Required(n) {
+		return ""
+	}
+	return captcha.Widget()
+}
+
+func lockoutKey(kind, target string) string {
+	return rateKey("lock", kind, target)
+}
+
+func failureKey(kind, target string) string {
+	return rateKey("fail", kind, target)
+}
+
+// lockoutDuration は上限を超えた失敗回数に応じて倍々に伸びるロック時間を返す
+func lockoutDuration(failures, maxFailures int64) time.Duration {
+	c := cfg.LoginLimit
+	d := c.LockoutBase
+	for i := maxFailures; i < failures && d < c.LockoutMax; i++ {
+		d *= 2
+	}
+	if d > c.LockoutMax {
+		d = c.LockoutMax
+	}
+	return d
+}
+
+// loginLockedUntil はアカウントかIPアドレスがロックされていればその解除時刻を返す
+func loginLockedUntil(accountName, ip string) (time.Time, bool) {
+	for _, t := range [][2]string{{lockoutKindAccount, accountName}, {lockoutKindIP, ip}} {
+		until, err := limitStore.Get(lockoutKey(t[0], t[1]))
+		if err != nil {
+			slog.Error("loginLockedUntil failed", slog.Any("err", err))
+			continue
+		}
+		if until > time.Now().Unix() {
+			return time.Unix(until, 0), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// allowLoginAttempt はIPアドレスとアカウント名ごとの試行回数の上限を確認する
+func allowLoginAttempt(accountName, ip string) bool {
+	c := cfg.LoginLimit
+	ok, err := allowRate(limitStore, rateKey("login", lockoutKindIP, ip), c.IPRate, time.Minute)
+	if err != nil {
+		slog.Error("allowLoginAttempt failed", slog.Any("err", err))
+		return true
+	}
+	if !ok {
+		return false
+	}
+	ok, err = allowRate(limitStore, rateKey("login", lockoutKindAccount, accountName), c.AccountRate, time.Minute)
+	if err != nil {
+		slog.Error("allowLoginAttempt failed", slog.Any("err", err))
+		return true
+	}
+	return ok
+}
+
+func loginFailures(accountName string) int64 {
+	n, err := limitStore.Get(failureKey(lockoutKindAccount, accountName))
+	if err != nil {
+		slog.Error("loginFailures failed", slog.Any("err", err))
+	}
+	return n
+}
+
+// recordLoginFailure は失敗回数を数え、上限を超えたらロックする
+func recordLoginFailure(accountName, ip string) {
+	c := cfg.LoginLimit
+	targets := []struct {
+		kind, target string
+		max          int64
+	}{
+		{lockoutKindAccount, accountName, int64(c.MaxAccountFailures)},
+		{lockoutKindIP, ip, int64(c.MaxIPFailures)},
+	}
+
+	for _, t := range targets {
+		failures, err := limitStore.Incr(failureKey(t.kind, t.target), c.FailureWindow)
+		if err != nil {
+			slog.Error("recordLoginFailure failed", slog.Any("err", err))
+			continue
+		}
+		slog.Warn("login failed", slog.String("kind", t.kind), slog.String("target", t.target), slog.String("ip", ip), slog.Int64("failures", failures))
+
+		if t.max <= 0 || failures < t.max {
+			continue
+		}
+		d := lockoutDuration(failures, t.max)
+		until := time.Now().Add(d)
+		err = limitStore.Set(lockoutKey(t.kind, t.target), until.Unix(), d)
+		if err != nil {
+			slog.Error("recordLoginFailure failed", slog.Any("err", err))
+			continue
+		}
+		slog.Warn("login locked", slog.String("kind", t.kind), slog.String("target", t.target), slog.String("ip", ip), slog.Time("until", until))
+
+		query := "INSERT INTO `login_lockouts` (`kind`, `target`, `failures`, `last_ip`, `locked_until`) VALUES (?,?,?,?,?) " +
+			"ON DUPLICATE KEY UPDATE `failures` = VALUES(`failures`), `last_ip` = VALUES(`last_ip`), `locked_until` = VALUES(`locked_until`)"
+		_, err = db.Exec(query, t.kind, truncate(t.target, 255), failures, truncate(ip, 64), until)
+		if err != nil {
+			slog.Error("recordLoginFailure failed", slog.Any("err", err))
+		}
+	}
+}
+
+// ログインに成功したらアカウントの失敗回数は忘れる
+func resetLoginFailures(accountName string) {
+	err := limitStore.Delete(failureKey(lockoutKindAccount, accountName))
+	if err != nil {
+		slog.Error("resetLoginFailures failed", slog.Any("err", err))
+	}
+}
+
+func unlockLogin(kind, target string) error {
+	if err := limitStore.Delete(lockoutKey(kind, target)); err != nil {
+		return err
+	}
+	if err := limitStore.Delete(failureKey(kind, target)); err != nil {
+		return err
+	}
+	_, err := db.Exec("DELETE FROM `login_lockouts` WHERE `kind` = ? AND `target` = ?", kind, target)
+	return err
+}
+
+func getAdminLockouts(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+
+	if me.Authority == 0 {
+		return forbidden("error.forbidden")
+	}
+
+	lockouts := []LoginLockout{}
+	err := db.SelectContext(r.Context(), &lockouts, "SELECT * FROM `login_lockouts` WHERE `locked_until` > ? ORDER BY `locked_until` DESC", time.Now())
+	if err != nil {
+		return err
+	}
+
+	return renderTemplate(r.Context(), w, "lockouts", struct {
+		Lockouts  []LoginLockout
+		Me        User
+		CSRFToken string
+		Flash     string
+	}{lockouts, me, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+func postAdminLockoutsUnlock(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+
+	if me.Authority == 0 {
+		return forbidden("error.forbidden")
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		return badRequest("error.bad_request")
+	}
+	lockout := LoginLockout{}
+	err = db.GetContext(r.Context(), &lockout, "SELECT * FROM `login_lockouts` WHERE `id` = ?", id)
+	if err != nil {
+		return err
+	}
+
+	err = unlockLogin(lockout.Kind, lockout.Target)
+	if err != nil {
+		return err
+	}
+	requestLogger(r).Info("login unlocked", slog.String("kind", lockout.Kind), slog.String("target", lockout.Target), slog.String("by", me.AccountName))
+
+	http.Redirect(w, r, "/admin/lockouts", http.StatusFound)
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer はメールの送信方法を差し替えるためのインターフェース
+// 本番ではSMTP、開発中はログやファイルに書き出す実装を使う
+type Mailer interface {
+	Send(ctx context.Context, m Mail) error
+}
+
+var (
+	mailer Mailer
+	// バックグラウンドで送信中のメール。終了時に待つ
+	mailSends sync.WaitGroup
+)
+
+// 1通の送信にかける時間の上限
+const mailSendTimeout = 10 * time.Second
+
+// waitMails は終了時に送信中のメールを待つ
+func waitMails(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		mailSends.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func newMailer(c MailConfig) (Mailer, error) {
+	switch c.Driver {
+	case "log":
+		return logMailer{from: c.From}, nil
+	case "file":
+		if err := os.MkdirAll(c.FileDir, 0755); err != nil {
+			return nil, err
+		}
+		return fileMailer{from: c.From, dir: c.FileDir}, nil
+	case "smtp":
+		// "名前 <アドレス>" の形のまま MAIL FROM に渡すと拒否するサーバーがあるので、エンベロープにはアドレスだけを使う
+		sender, err := mail.ParseAddress(c.From)
+		if err != nil {
+			return nil, fmt.Errorf("mail.from: %w", err)
+		}
+		return smtpMailer{
+			from:     c.From,
+			sender:   sender.Address,
+			addr:     net.JoinHostPort(c.SMTPHost, strconv.Itoa(c.SMTPPort)),
+			host:     c.SMTPHost,
+			username: c.SMTPUsername,
+			password: c.SMTPPassword,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown mail driver %q", c.Driver)
+}
+
+// formatMail はRFC 5322形式のメッセージを組み立てる
+func formatMail(from string, m Mail) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(m.Body)
+	return b.Bytes()
+}
+
+type logMailer struct {
+	from string
+}
+
+func (l logMailer) Send(ctx context.Context, m Mail) error {
+	slog.Info("mail", slog.String("from", l.from), slog.String("to", m.To), slog.String("subject", m.Subject), slog.String("body", m.Body))
+	return nil
+}
+
+// fileMailer は送信する代わりに1通ずつ.emlファイルとして保存する
+type fileMailer struct {
+	from string
+	dir  string
+}
+
+func (f fileMailer) Send(ctx context.Context, m Mail) error {
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), secureRandomStr(4))
+	return os.WriteFile(filepath.Join(f.dir, name), formatMail(f.from, m), 0600)
+}
+
+// from は From ヘッダー、sender はエンベロープの送信者
+type smtpMailer struct {
+	from     string
+	sender   string
+	addr     string
+	host     string
+	username string
+	password string
+}
+
+// Send はサーバーが対応していればSTARTTLSで送信する
+func (s smtpMailer) Send(ctx context.Context, m Mail) error {
+	var auth smtp.Auth
+	if s.username != "" {
+		auth = smtp.PlainAuth("", s.username, s.password, s.host)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.addr, auth, s.sender, []string{m.To}, formatMail(s.from, m))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	gsm "github.com/bradleypeabody/gorilla-sessions-memcache"
+	"github.com/gorilla/securecookie"
+)
+
+// テストはデフォルトの設定と埋め込みのカタログで動かし、セッションはメモリに置く
+func TestMain(m *testing.M) {
+	cfg = defaultConfig()
+	if err := loadLocales(cfg.DefaultLocale); err != nil {
+		log.Fatal(err)
+	}
+	// セッションを破棄するときの Delete は繋がらずに失敗するだけ
+	memcacheClient = memcache.New("127.0.0.1:1")
+	s := gsm.NewMemcacherStore(&fakeMemcacher{items: map[string]string{}}, "iscogram_", securecookie.GenerateRandomKey(sessionHashKeyLength))
+	s.Options = sessionOptions(cfg.Session, int(cfg.Session.AbsoluteTimeout.Seconds()))
+	store = &sessionStore{s}
+
+	os.Exit(m.Run())
+}
+
+// fakeMemcacher はセッションを保存するだけのメモリ上のmemcached
+type fakeMemcacher struct {
+	mu    sync.Mutex
+	items map[string]string
+}
+
+func (f *fakeMemcacher) Get(key string) (string, uint32, uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	val, ok := f.items[key]
+	if !ok {
+		return "", 0, 0, memcache.ErrCacheMiss
+	}
+	return val, 0, 0, nil
+}
+
+func (f *fakeMemcacher) Set(key, val string, flags, exp uint32, ocas uint64) (uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.items[key] = val
+	return ocas, nil
+}
+
+// doRequest は h にリクエストを渡し、前のレスポンスのCookieがあれば付けて送る
+func doRequest(t *testing.T, h http.Handler, req *http.Request, prev *httptest.ResponseRecorder) *httptest.ResponseRecorder {
+	t.Helper()
+	if prev != nil {
+		for _, c := range prev.Result().Cookies() {
+			req.AddCookie(c)
+		}
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// loggedIn は uid でログインしたセッションのCookieを持つレスポンスを返す
+func loggedIn(t *testing.T, uid int) *httptest.ResponseRecorder {
+	t.Helper()
+	return doRequest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := getSession(r)
+		session.Values["user_id"] = uid
+		if err := session.Save(r, w); err != nil {
+			t.Fatalf("save session: %v", err)
+		}
+	}), httptest.NewRequest(http.MethodGet, "/", nil), nil)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"goji.io/middleware"
+)
+
+// /metrics はpprofと同じ内部向けのポートで公開する
+// Goのランタイムとプロセスのメトリクスは DefaultRegisterer に最初から入っている
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "isuconp_http_requests_total",
+		Help: "HTTPリクエスト数",
+	}, []string{"method", "route", "status"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "isuconp_http_request_duration_seconds",
+		Help:    "HTTPリクエストの処理時間",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+	dbDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "isuconp_db_query_duration_seconds",
+		Help:    "クエリの実行時間。query は種類とテーブル名 (select_posts など)",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"query"})
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "isuconp_cache_requests_total",
+		Help: "オンメモリのキャッシュの参照数",
+	}, []string{"cache", "result"})
+	uploadBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "isuconp_upload_size_bytes",
+		Help:    "投稿された画像のサイズ",
+		Buckets: prometheus.ExponentialBuckets(16*1024, 2, 10),
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "isuconp_active_sessions",
+		Help: "アイドルタイムアウト以内にアクセスのあったログイン中のセッション数",
+	}, activeSessions)
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "isuconp_stream_connections",
+		Help: "接続中のSSEの数",
+	}, func() float64 { return float64(atomic.LoadInt64(&streamConnections)) })
+)
+
+func activeSessions() float64 {
+	if db == nil {
+		return 0
+	}
+	lastSeenAt, createdAt := sessionActiveSince(time.Now())
+	n := 0
+	err := db.DB.Get(&n, "SELECT COUNT(*) FROM `user_sessions` WHERE `last_seen_at` > ? AND `created_at` > ?", lastSeenAt, createdAt)
+	if err != nil {
+		return 0
+	}
+	return float64(n)
+}
+
+// metricsWriter はステータスコードと書き込んだバイト数を覚えておく
+// SSEで http.ResponseController を使えるよう Unwrap で元の ResponseWriter を返す
+type metricsWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *metricsWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *metricsWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Status は書き込まれたステータスコード。何も書かれていなければ 200
+func (w *metricsWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *metricsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// routeName はマッチしたルートのパターンを返す。生のパスを使うとラベルが増え続けるため
+func routeName(r *http.Request) string {
+	p, ok := middleware.Pattern(r.Context()).(interface{ String() string })
+	if !ok {
+		return "none"
+	}
+	return p.String()
+}
+
+// instrumentRoutes はルートごとのリクエスト数と処理時間を記録する
+// goji はミドルウェアより先にルーティングするので、ここでパターンが分かる
+func instrumentRoutes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		mw := &metricsWriter{ResponseWriter: w}
+		next.ServeHTTP(mw, r)
+
+		status := mw.Status()
+		route := routeName(r)
+		httpRequests.WithLabelValues(r.Method, route, strconv.Itoa(status)).Inc()
+		httpDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+var queryTableRegexp = regexp.MustCompile("(?i)\\b(?:FROM|INTO|UPDATE)\\s+`?(\\w+)`?")
+
+// queryName はクエリの種類と最初のテーブル名からラベルを作る
+// IN句の長さなどでクエリ文字列が変わってもラベルは増えない
+func queryName(query string) string {
+	verb := strings.ToLower(strings.SplitN(strings.TrimSpace(query), " ", 2)[0])
+	if m := queryTableRegexp.FindStringSubmatch(query); m != nil {
+		return verb + "_" + m[1]
+	}
+	return verb
+}
+
+func observeQuery(query string, start time.Time) {
+	dbDuration.WithLabelValues(queryName(query)).Observe(time.Since(start).Seconds())
+}
+
+// instrumentedDB はクエリの実行時間を記録する *sqlx.DB
+// context を渡す呼び出しはスパンにもする。トランザクションの中のクエリは記録しない
+// context の期限やキャンセルはそのままクエリに伝える
+type instrumentedDB struct {
+	*sqlx.DB
+}
+
+func (d *instrumentedDB) Get(dest interface{}, query string, args ...interface{}) error {
+	defer observeQuery(query, time.Now())
+	return d.DB.Get(dest, query, args...)
+}
+
+func (d *instrumentedDB) Select(dest interface{}, query string, args ...interface{}) error {
+	defer observeQuery(query, time.Now())
+	return d.DB.Select(dest, query, args...)
+}
+
+func (d *instrumentedDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	defer observeQuery(query, time.Now())
+	return d.DB.Exec(query, args...)
+}
+
+func (d *instrumentedDB) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) (err error) {
+	defer observeQuery(query, time.Now())
+	ctx, span := startQuerySpan(ctx, query)
+	defer func() { endSpan(span, err) }()
+	return d.DB.GetContext(ctx, dest, query, args...)
+}
+
+func (d *instrumentedDB) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) (err error) {
+	defer observeQuery(query, time.Now())
+	ctx, span := startQuerySpan(ctx, query)
+	defer func() { endSpan(span, err) }()
+	return d.DB.SelectContext(ctx, dest, query, args...)
+}
+
+func (d *instrumentedDB) ExecContext(ctx context.Context, query string, args ...interface{}) (result sql.Result, err error) {
+	defer observeQuery(query, time.Now())
+	ctx, span := startQuerySpan(ctx, query)
+	defer func() { endSpan(span, err) }()
+	return d.DB.ExecContext(ctx, query, args...)
+}
+
+// cache はヒット率を記録する sync.Map
+type cache struct {
+	sync.Map
+	name string
+}
+
+func (c *cache) Load(key interface{}) (interface{}, bool) {
+	value, ok := c.Map.Load(key)
+	if ok {
+		cacheRequests.WithLabelValues(c.name, "hit").Inc()
+	} else {
+		cacheRequests.WithLabelValues(c.name, "miss").Inc()
+	}
+	return value, ok
+}
+
+// Add はカウンターの値に delta を足して新しい値を返す。キーが無ければ何もしない
+func (c *cache) Add(key interface{}, delta int) (int, bool) {
+	for {
+		value, ok := c.Map.Load(key)
+		if !ok {
+			return 0, false
+		}
+		n := value.(int) + delta
+		if c.Map.CompareAndSwap(key, value, n) {
+			return n, true
+		}
+	}
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 認可リクエストからコールバックまでの猶予
+	oidcPendingTTL = 10 * time.Minute
+	// ID トークンの時刻を確認するときに許容するずれ
+	oidcClockSkew = time.Minute
+)
+
+// テストではモックのプロバイダに向けたクライアントや時計に差し替える
+var (
+	oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+	oidcClock      = time.Now
+)
+
+// UserIdentity は外部のプロバイダのアカウントと users の対応
+type UserIdentity struct {
+	Issuer    string    `db:"issuer"`
+	Subject   string    `db:"subject"`
+	UserID    int       `db:"user_id"`
+	Email     string    `db:"email"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type oidcClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"`
+	AuthorizedParty   string          `json:"azp"`
+	Expiry            int64           `json:"exp"`
+	IssuedAt          int64           `json:"iat"`
+	Nonce             string          `json:"nonce"`
+	Email             string          `json:"email"`
+	EmailVerified     bool            `json:"email_verified"`
+	PreferredUsername string          `json:"preferred_username"`
+}
+
+// oidcProvider はディスカバリの結果と署名の検証鍵を保持する
+// プロバイダが起動していなくてもアプリは起動できるよう、最初に使うときに取得する
+type oidcProvider struct {
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+}
+
+var oidc oidcProvider
+
+func oidcGetJSON(u string, v interface{}) error {
+	res, err := oidcHTTPClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: GET %s: %s", u, res.Status)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(v)
+}
+
+func (p *oidcProvider) config() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	issuer := strings.TrimRight(cfg.OIDC.Issuer, "/")
+	d := &oidcDiscovery{}
+	if err := oidcGetJSON(issuer+"/.well-known/openid-configuration", d); err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(d.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("oidc: issuer mismatch: configured %q, discovered %q", cfg.OIDC.Issuer, d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("oidc: discovery document is missing endpoints")
+	}
+	p.discovery = d
+	return d, nil
+}
+
+// key は kid に対応する検証鍵を返す。見つからなければ鍵の更新を考えて取得し直す
+func (p *oidcProvider) key(kid string) (crypto.PublicKey, error) {
+	d, err := p.config()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := oidcGetJSON(d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		k, err := jwk.publicKey()
+		if err != nil {
+			slog.Warn("oidc: skip jwk", slog.String("kid", jwk.Kid), slog.Any("err", err))
+			continue
+		}
+		keys[jwk.Kid] = k
+	}
+	p.keys = keys
+
+	k, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("oidc: unknown key id %q", kid)
+	}
+	return k, nil
+}
+
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
+
+// verifyIDToken は ID トークンの署名と iss, aud, exp, nonce を確認してクレームを返す
+// 対応している署名アルゴリズムは RS256 と ES256 だけ
+func verifyIDToken(token, nonce string) (*oidcClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("oidc: malformed id_token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &header); err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	key, err := oidc.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return nil, fmt.Errorf("oidc: unexpected alg %q for rsa key", header.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig); err != nil {
+			return nil, errors.New("oidc: invalid id_token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 {
+			return nil, fmt.Errorf("oidc: unexpected alg %q for ec key", header.Alg)
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return nil, errors.New("oidc: invalid id_token signature")
+		}
+	default:
+		return nil, errors.New("oidc: unsupported key")
+	}
+
+	b, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	claims := &oidcClaims{}
+	if err := json.Unmarshal(b, claims); err != nil {
+		return nil, err
+	}
+
+	if strings.TrimRight(claims.Issuer, "/") != strings.TrimRight(cfg.OIDC.Issuer, "/") {
+		return nil, fmt.Errorf("oidc: unexpected issuer %q", claims.Issuer)
+	}
+	var audiences []string
+	if err := json.Unmarshal(claims.Audience, &audiences); err != nil {
+		var aud string
+		if err := json.Unmarshal(claims.Audience, &aud); err != nil {
+			return nil, errors.New("oidc: invalid aud")
+		}
+		audiences = []string{aud}
+	}
+	found := false
+	for _, aud := range audiences {
+		found = found || aud == cfg.OIDC.ClientID
+	}
+	if !found || (len(audiences) > 1 && claims.AuthorizedParty != cfg.OIDC.ClientID) {
+		return nil, errors.New("oidc: id_token is not issued for this client")
+	}
+	now := oidcClock()
+	if now.Add(-oidcClockSkew).After(time.Unix(claims.Expiry, 0)) {
+		return nil, errors.New("oidc: id_token is expired")
+	}
+	if claims.IssuedAt != 0 && now.Add(oidcClockSkew).Before(time.Unix(claims.IssuedAt, 0)) {
+		return nil, errors.New("oidc: id_token is issued in the future")
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, errors.New("oidc: nonce mismatch")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("oidc: sub is empty")
+	}
+	return claims, nil
+}
+
+func oidcRedirectURL() string {
+	if cfg.OIDC.RedirectURL != "" {
+		return cfg.OIDC.RedirectURL
+	}
+	return strings.TrimRight(cfg.BaseURL, "/") + "/login/oidc/callback"
+}
+
+// pkceChallenge は code_verifier から S256 の code_challenge を作る
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// exchangeCode は認可コードをトークンエンドポイントで ID トークンと交換する
+func exchangeCode(code, verifier string) (string, error) {
+	d, err := oidc.config()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", oidcRedirectURL())
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", cfg.OIDC.ClientID)
+
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if cfg.OIDC.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(cfg.OIDC.ClientID), url.QueryEscape(cfg.OIDC.ClientSecret))
+	}
+
+	res, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("oidc: token response: %s: %v", res.Status, err)
+	}
+	if res.StatusCode != http.StatusOK || body.Error != "" {
+		return "", fmt.Errorf("oidc: token request failed: %s: %s %s", res.Status, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("oidc: token response has no id_token")
+	}
+	return body.IDToken, nil
+}
+
+var accountNameUnsafe = regexp.MustCompile(`[^0-9a-zA-Z_]`)
+
+// newAccountName はプロバイダのユーザー名からまだ使われていないアカウント名を作る
+func newAccountName(claims *oidcClaims) string {
+	base := claims.PreferredUsername
+	if base == "" {
+		base = strings.SplitN(claims.Email, "@", 2)[0]
+	}
+	base = truncate(accountNameUnsafe.ReplaceAllString(base, "_"), 48)
+	if len(base) < 3 {
+		base = "user_" + base
+	}
+
+	name := base
+	for i := 0; i < 10; i++ {
+		exists := 0
+		// ユーザーが存在しない場合はエラーになるのでエラーチェックはしない
+		db.Get(&exists, "SELECT 1 FROM users WHERE `account_name` = ?", name)
+		if exists == 0 {
+			return name
+		}
+		name = base + "_" + secureRandomStr(2)
+	}
+	return base + "_" + secureRandomStr(4)
+}
+
+// identityUser は外部アカウントに対応するユーザーを返す
+// 未連携の場合、ログイン中なら今のユーザーに連携し、そうでなければ新しくユーザーを作る
+func identityUser(r *http.Request, claims *oidcClaims) (User, bool, error) {
+	identity := UserIdentity{}
+	err := db.GetContext(r.Context(), &identity, "SELECT * FROM `user_identities` WHERE `issuer` = ? AND `subject` = ?", claims.Issuer, claims.Subject)
+	if err == nil {
+		value, ok := userCache.Load(identity.UserID)
+		if !ok {
+			return User{}, false, fmt.Errorf("oidc: user %d not found", identity.UserID)
+		}
+		return value.(User), false, nil
+	}
+	// 連携済みかどうか分からないまま作ると、同じ外部アカウントのユーザーが重複する
+	if !errors.Is(err, sql.ErrNoRows) {
+		return User{}, false, err
+	}
+
+	me := getSessionUser(r)
+	linked := isLogin(me)
+	if !linked {
+		accountName := newAccountName(claims)
+		// パスワードでログインできないよう、誰も知らないパスワードにする
+		passhash := calculatePasshash(accountName, secureRandomStr(32))
+		result, err := db.ExecContext(context.WithoutCancel(r.Context()), "INSERT INTO `users` (`account_name`, `passhash`) VALUES (?,?)", accountName, passhash)
+		if err != nil {
+			return User{}, false, err
+		}
+		uid, err := result.LastInsertId()
+		if err != nil {
+			return User{}, false, err
+		}
+		me = User{ID: int(uid), AccountName: accountName, Passhash: passhash, CreatedAt: time.Now()}
+		userCache.Store(me.ID, me)
+		userCommentCache.Store(me.ID, 0)
+
+		if claims.Email != "" && claims.EmailVerified {
+			_, err = db.ExecContext(r.Context(), "INSERT IGNORE INTO `user_emails` (`user_id`, `email`) VALUES (?,?)", me.ID, claims.Email)
+			if err != nil {
+				logError(r, err)
+			}
+		}
+	}
+
+	_, err = db.ExecContext(
+		r.Context(),
+		"INSERT INTO `user_identities` (`issuer`, `subject`, `user_id`, `email`) VALUES (?,?,?,?)",
+		claims.Issuer, claims.Subject, me.ID, truncate(claims.Email, 255),
+	)
+	if err != nil {
+		return User{}, false, err
+	}
+	return me, linked, nil
+}
+
+// getLoginOIDC は PKCE を使った認可コードフローを開始する
+func getLoginOIDC(w http.ResponseWriter, r *http.Request) error {
+	if !cfg.OIDC.enabled() {
+		return notFound("error.not_found")
+	}
+
+	d, err := oidc.config()
+	if err != nil {
+		logError(r, err)
+		session := getSession(r)
+		session.Values["notice"] = tr(r, "flash.oidc_unavailable", cfg.OIDC.Name)
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	state, nonce, verifier := secureRandomStr(16), secureRandomStr(16), secureRandomStr(32)
+	session := getSession(r)
+	session.Values["oidc_state"] = state
+	session.Values["oidc_nonce"] = nonce
+	session.Values["oidc_verifier"] = verifier
+	session.Values["oidc_at"] = oidcClock().Unix()
+	if err := session.Save(r, w); err != nil {
+		return err
+	}
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", cfg.OIDC.ClientID)
+	q.Set("redirect_uri", oidcRedirectURL())
+	q.Set("scope", strings.Join(cfg.OIDC.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", pkceChallenge(verifier))
+	q.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+	return nil
+}
+
+func getLoginOIDCCallback(w http.ResponseWriter, r *http.Request) error {
+	if !cfg.OIDC.enabled() {
+		return notFound("error.not_found")
+	}
+
+	session := getSession(r)
+	state, _ := session.Values["oidc_state"].(string)
+	nonce, _ := session.Values["oidc_nonce"].(string)
+	verifier, _ := session.Values["oidc_verifier"].(string)
+	at, _ := session.Values["oidc_at"].(int64)
+	// state は1回しか使えないようにする
+	delete(session.Values, "oidc_state")
+	delete(session.Values, "oidc_nonce")
+	delete(session.Values, "oidc_verifier")
+	delete(session.Values, "oidc_at")
+
+	fail := func(format string, args ...interface{}) {
+		requestLogger(r).Warn("oidc: login failed", slog.String("reason", fmt.Sprintf(format, args...)))
+		session.Values["notice"] = tr(r, "flash.oidc_failed", cfg.OIDC.Name)
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/login", http.StatusFound)
+	}
+
+	q := r.URL.Query()
+	if state == "" || subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(state)) != 1 {
+		fail("state mismatch")
+		return nil
+	}
+	if oidcClock().Sub(time.Unix(at, 0)) > oidcPendingTTL {
+		fail("authorization request expired")
+		return nil
+	}
+	if e := q.Get("error"); e != "" {
+		fail("provider returned error: %s %s", e, q.Get("error_description"))
+		return nil
+	}
+
+	idToken, err := exchangeCode(q.Get("code"), verifier)
+	if err != nil {
+		fail("%v", err)
+		return nil
+	}
+	claims, err := verifyIDToken(idToken, nonce)
+	if err != nil {
+		fail("%v", err)
+		return nil
+	}
+
+	u, linked, err := identityUser(r, claims)
+	if err != nil {
+		fail("%v", err)
+		return nil
+	}
+	if u.DelFlg != 0 {
+		fail("user %d is banned", u.ID)
+		return nil
+	}
+
+	if linked {
+		session.Values["notice"] = tr(r, "flash.oidc_linked", cfg.OIDC.Name)
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/settings", http.StatusFound)
+		return nil
+	}
+	if me := getSessionUser(r); isLogin(me) && me.ID != u.ID {
+		fail("identity %s is linked to another user", claims.Subject)
+		return nil
+	}
+
+	if isTOTPEnabled(u.ID) {
+		err = beginPending2FA(w, r, u.ID)
+		if err != nil {
+			return err
+		}
+		http.Redirect(w, r, "/login/2fa", http.StatusFound)
+		return nil
+	}
+
+	err = startUserSession(w, r, u.ID)
+	if err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
+}
+
+func userIdentities(uid int) []UserIdentity {
+	identities := []UserIdentity{}
+	err := db.Select(&identities, "SELECT * FROM `user_identities` WHERE `user_id` = ? ORDER BY `created_at`", uid)
+	if err != nil {
+		slog.Error("userIdentities failed", slog.Any("err", err))
+	}
+	return identities
+}
+
+// 連携を解除する。パスワードを知らないユーザーは再設定のメールでログインし直せる
+func postSettingsOIDCUnlink(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	_, err := db.ExecContext(r.Context(), "DELETE FROM `user_identities` WHERE `user_id` = ? AND `issuer` = ? AND `subject` = ?", me.ID, r.FormValue("issuer"), r.FormValue("subject"))
+	if err != nil {
+		return err
+	}
+
+	session := getSession(r)
+	session.Values["notice"] = tr(r, "flash.oidc_unlinked", cfg.OIDC.Name)
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/settings", http.StatusFound)
+	return nil
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockOIDCProvider はディスカバリ、JWKS、トークンエンドポイントだけを持つプロバイダ
+// 認可エンドポイントの代わりに authorize で認可コードを発行する
+type mockOIDCProvider struct {
+	srv *httptest.Server
+	key *rsa.PrivateKey
+	now time.Time
+
+	mu            sync.Mutex
+	codes         map[string]mockOIDCCode
+	tokenRequests int
+}
+
+type mockOIDCCode struct {
+	challenge string
+	claims    map[string]interface{}
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockOIDCProvider{key: key, now: time.Unix(1700000000, 0), codes: map[string]mockOIDCCode{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                p.srv.URL,
+			AuthorizationEndpoint: p.srv.URL + "/authorize",
+			TokenEndpoint:         p.srv.URL + "/token",
+			JWKSURI:               p.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]jsonWebKey{"keys": {{
+			Kty: "RSA",
+			Kid: "test",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", p.token)
+	p.srv = httptest.NewServer(mux)
+	t.Cleanup(p.srv.Close)
+	return p
+}
+
+func (p *mockOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tokenRequests++
+
+	fail := func(code string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+	if r.FormValue("grant_type") != "authorization_code" || r.FormValue("client_id") != cfg.OIDC.ClientID {
+		fail("invalid_request")
+		return
+	}
+	c, ok := p.codes[r.FormValue("code")]
+	delete(p.codes, r.FormValue("code"))
+	if !ok || pkceChallenge(r.FormValue("code_verifier")) != c.challenge {
+		fail("invalid_grant")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": p.sign(c.claims)})
+}
+
+// sign は RS256 で署名した ID トークンを返す
+func (p *mockOIDCProvider) sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// authorize は認可リクエストを受けたものとしてコードを発行し、コールバックのクエリを返す
+// edit で ID トークンのクレームを書き換えられる
+func (p *mockOIDCProvider) authorize(t *testing.T, location string, subject string, edit func(claims map[string]interface{})) url.Values {
+	t.Helper()
+	u, err := url.Parse(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.Scheme + "://" + u.Host + u.Path; got != p.srv.URL+"/authorize" {
+		t.Fatalf("redirected to %s, want the authorization endpoint", got)
+	}
+	q := u.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != cfg.OIDC.ClientID || q.Get("redirect_uri") != oidcRedirectURL() {
+		t.Fatalf("unexpected authorization request %s", u.RawQuery)
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("authorization request without PKCE: %s", u.RawQuery)
+	}
+
+	claims := map[string]interface{}{
+		"iss":                p.srv.URL,
+		"sub":                subject,
+		"aud":                cfg.OIDC.ClientID,
+		"exp":                p.now.Add(time.Hour).Unix(),
+		"iat":                p.now.Unix(),
+		"nonce":              q.Get("nonce"),
+		"email":              subject + "@example.com",
+		"email_verified":     true,
+		"preferred_username": subject,
+	}
+	if edit != nil {
+		edit(claims)
+	}
+	code := secureRandomStr(16)
+	p.mu.Lock()
+	p.codes[code] = mockOIDCCode{challenge: q.Get("code_challenge"), claims: claims}
+	p.mu.Unlock()
+
+	return url.Values{"code": {code}, "state": {q.Get("state")}}
+}
+
+// fakeIdentityStore は users と user_identities のうちOIDCのログインで使うところ
+type fakeIdentityStore struct {
+	mu         sync.Mutex
+	nextUserID int64
+	createdIDs []int
+	// subject -> user_id
+	identities map[string]int64
+	// 設定すると user_identities の検索が失敗する
+	lookupErr error
+}
+
+func (s *fakeIdentityStore) query(query string, args []driver.Value) (fakeRows, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case strings.HasPrefix(query, "SELECT * FROM `user_identities`"):
+		if s.lookupErr != nil {
+			return fakeRows{}, s.lookupErr
+		}
+		rows := fakeRows{Columns: []string{"issuer", "subject", "user_id", "email", "created_at"}}
+		if uid, ok := s.identities[args[1].(string)]; ok {
+			rows.Rows = [][]driver.Value{{args[0], args[1], uid, "", time.Unix(0, 0)}}
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "SELECT 1 FROM users"):
+		return fakeRows{Columns: []string{"1"}}, nil
+	case strings.HasPrefix(query, "INSERT INTO `users`"):
+		s.nextUserID++
+		s.createdIDs = append(s.createdIDs, int(s.nextUserID))
+		return fakeRows{RowsAffected: 1, LastInsertID: s.nextUserID}, nil
+	case strings.HasPrefix(query, "INSERT INTO `user_identities`"):
+		s.identities[args[1].(string)] = args[2].(int64)
+		return fakeRows{RowsAffected: 1}, nil
+	case strings.HasPrefix(query, "INSERT IGNORE INTO `user_emails`"),
+		strings.HasPrefix(query, "INSERT INTO `user_sessions`"),
+		strings.HasPrefix(query, "DELETE FROM `user_sessions`"):
+		return fakeRows{RowsAffected: 1}, nil
+	}
+	return unknownQuery(query)
+}
+
+func setupOIDC(t *testing.T) (*mockOIDCProvider, *fakeIdentityStore) {
+	t.Helper()
+	p := newMockOIDCProvider(t)
+
+	oldConfig, oldBaseURL, oldClient, oldClock := cfg.OIDC, cfg.BaseURL, oidcHTTPClient, oidcClock
+	cfg.OIDC = OIDCConfig{Name: "Mock", Issuer: p.srv.URL, ClientID: "iscogram", Scopes: []string{"openid", "email", "profile"}}
+	cfg.BaseURL = "http://localhost"
+	oidcHTTPClient = p.srv.Client()
+	oidcClock = func() time.Time { return p.now }
+	t.Cleanup(func() {
+		cfg.OIDC, cfg.BaseURL, oidcHTTPClient, oidcClock = oldConfig, oldBaseURL, oldClient, oldClock
+		resetOIDCProvider()
+	})
+	resetOIDCProvider()
+
+	s := &fakeIdentityStore{nextUserID: 1000, identities: map[string]int64{}}
+	useFakeDB(t, s.query)
+	t.Cleanup(func() {
+		for _, id := range s.createdIDs {
+			userCache.Delete(id)
+			userCommentCache.Delete(id)
+		}
+	})
+	return p, s
+}
+
+// resetOIDCProvider はディスカバリと鍵のキャッシュを捨てる
+func resetOIDCProvider() {
+	oidc.mu.Lock()
+	defer oidc.mu.Unlock()
+	oidc.discovery = nil
+	oidc.keys = nil
+}
+
+// startOIDCLogin は /login/oidc を開き、認可エンドポイントへのリダイレクトを返す
+func startOIDCLogin(t *testing.T, prev *httptest.ResponseRecorder) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+	w := doRequest(t, handler(getLoginOIDC), httptest.NewRequest(http.MethodGet, "/login/oidc", nil), prev)
+	if w.Code != http.StatusFound {
+		t.Fatalf("GET /login/oidc: status %d", w.Code)
+	}
+	return w, w.Header().Get("Location")
+}
+
+func oidcCallback(t *testing.T, prev *httptest.ResponseRecorder, q url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	w := doRequest(t, handler(getLoginOIDCCallback), httptest.NewRequest(http.MethodGet, "/login/oidc/callback?"+q.Encode(), nil), prev)
+	if w.Code != http.StatusFound {
+		t.Fatalf("GET /login/oidc/callback: status %d", w.Code)
+	}
+	return w
+}
+
+// sessionUserID はレスポンスのCookieのセッションでログインしているユーザーを返す
+func sessionUserID(t *testing.T, prev *httptest.ResponseRecorder) int {
+	t.Helper()
+	uid := 0
+	doRequest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uid, _ = getSession(r).Values["user_id"].(int)
+	}), httptest.NewRequest(http.MethodGet, "/", nil), prev)
+	return uid
+}
+
+func TestOIDCLoginCreatesUser(t *testing.T) {
+	p, s := setupOIDC(t)
+
+	start, location := startOIDCLogin(t, nil)
+	w := oidcCallback(t, start, p.authorize(t, location, "alice", nil))
+	if loc := w.Header().Get("Location"); loc != "/" {
+		t.Fatalf("redirected to %s, want /", loc)
+	}
+	if len(s.createdIDs) != 1 || s.identities["alice"] != int64(s.createdIDs[0]) {
+		t.Fatalf("created users %v and identities %v", s.createdIDs, s.identities)
+	}
+	if uid := sessionUserID(t, w); uid != s.createdIDs[0] {
+		t.Errorf("logged in as %d, want %d", uid, s.createdIDs[0])
+	}
+
+	// 2回目は同じユーザーでログインする
+	start, location = startOIDCLogin(t, nil)
+	w = oidcCallback(t, start, p.authorize(t, location, "alice", nil))
+	if loc := w.Header().Get("Location"); loc != "/" {
+		t.Fatalf("redirected to %s, want /", loc)
+	}
+	if len(s.createdIDs) != 1 {
+		t.Errorf("created users %v on the second login", s.createdIDs)
+	}
+	if uid := sessionUserID(t, w); uid != s.createdIDs[0] {
+		t.Errorf("logged in as %d, want %d", uid, s.createdIDs[0])
+	}
+}
+
+func TestOIDCLinksToLoggedInUser(t *testing.T) {
+	p, s := setupOIDC(t)
+	me := User{ID: 42, AccountName: "mary"}
+	userCache.Store(me.ID, me)
+	t.Cleanup(func() { userCache.Delete(me.ID) })
+
+	start, location := startOIDCLogin(t, loggedIn(t, me.ID))
+	w := oidcCallback(t, start, p.authorize(t, location, "mary-at-provider", nil))
+	if loc := w.Header().Get("Location"); loc != "/settings" {
+		t.Fatalf("redirected to %s, want /settings", loc)
+	}
+	if len(s.createdIDs) != 0 {
+		t.Errorf("created users %v while linking", s.createdIDs)
+	}
+	if uid := s.identities["mary-at-provider"]; uid != int64(me.ID) {
+		t.Errorf("identity is linked to %d, want %d", uid, me.ID)
+	}
+}
+
+// 連携済みかを確かめられなかったときはユーザーを作らない
+func TestOIDCLookupErrorDoesNotCreateUser(t *testing.T) {
+	p, s := setupOIDC(t)
+	s.lookupErr = errors.New("connection refused")
+
+	start, location := startOIDCLogin(t, nil)
+	w := oidcCallback(t, start, p.authorize(t, location, "alice", nil))
+	if loc := w.Header().Get("Location"); loc != "/login" {
+		t.Fatalf("redirected to %s, want /login", loc)
+	}
+	if len(s.createdIDs) != 0 || len(s.identities) != 0 {
+		t.Errorf("created users %v and identities %v", s.createdIDs, s.identities)
+	}
+}
+
+// ログインに失敗したら /login に戻し、ユーザーは作らない
+func TestOIDCCallbackRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		// authorize の後にコールバックのクエリやプロバイダの状態を書き換える
+		tamper func(p *mockOIDCProvider, q url.Values)
+		edit   func(claims map[string]interface{})
+	}{
+		{
+			name: "state mismatch",
+			tamper: func(p *mockOIDCProvider, q url.Values) {
+				q.Set("state", "forged")
+			},
+		},
+		{
+			// 別の code_verifier に対して発行されたコードは交換できない
+			name: "pkce verifier mismatch",
+			tamper: func(p *mockOIDCProvider, q url.Values) {
+				p.mu.Lock()
+				defer p.mu.Unlock()
+				c := p.codes[q.Get("code")]
+				c.challenge = pkceChallenge("another verifier")
+				p.codes[q.Get("code")] = c
+			},
+		},
+		{
+			name: "nonce mismatch",
+			edit: func(claims map[string]interface{}) {
+				claims["nonce"] = "forged"
+			},
+		},
+		{
+			name: "expired id_token",
+			edit: func(claims map[string]interface{}) {
+				claims["exp"] = time.Unix(1700000000, 0).Add(-oidcClockSkew - time.Second).Unix()
+			},
+		},
+		{
+			name: "wrong audience",
+			edit: func(claims map[string]interface{}) {
+				claims["aud"] = "someone-else"
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, s := setupOIDC(t)
+
+			start, location := startOIDCLogin(t, nil)
+			q := p.authorize(t, location, "eve", tt.edit)
+			if tt.tamper != nil {
+				tt.tamper(p, q)
+			}
+			w := oidcCallback(t, start, q)
+			if loc := w.Header().Get("Location"); loc != "/login" {
+				t.Fatalf("redirected to %s, want /login", loc)
+			}
+			if len(s.createdIDs) != 0 || len(s.identities) != 0 {
+				t.Errorf("created users %v and identities %v", s.createdIDs, s.identities)
+			}
+			if uid := sessionUserID(t, w); uid != 0 {
+				t.Errorf("logged in as %d", uid)
+			}
+		})
+	}
+}
+
+// state は1回しか使えない。失敗したコールバックの後に正しいクエリを送っても通さない
+func TestOIDCStateIsSingleUse(t *testing.T) {
+	p, s := setupOIDC(t)
+
+	start, location := startOIDCLogin(t, nil)
+	q := p.authorize(t, location, "bob", nil)
+	forged := url.Values{"code": q["code"], "state": {"forged"}}
+	w := oidcCallback(t, start, forged)
+
+	w = oidcCallback(t, w, q)
+	if loc := w.Header().Get("Location"); loc != "/login" {
+		t.Fatalf("redirected to %s, want /login", loc)
+	}
+	if p.tokenRequests != 0 {
+		t.Error("exchanged the code after the state was used")
+	}
+	if len(s.createdIDs) != 0 {
+		t.Errorf("created users %v", s.createdIDs)
+	}
+}
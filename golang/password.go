@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"goji.io/pat"
+)
+
+var passwordRegexp = regexp.MustCompile(`\A[0-9a-zA-Z_]{6,}\z`)
+
+func validatePassword(password string) bool {
+	return passwordRegexp.MatchString(password)
+}
+
+func hashResetToken(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+func userEmail(uid int) string {
+	email := ""
+	// 未登録の場合はエラーになるのでエラーチェックはしない
+	db.Get(&email, "SELECT `email` FROM `user_emails` WHERE `user_id` = ?", uid)
+	return email
+}
+
+// updatePassword はパスワードを変更し、except 以外のセッションを全てログアウトさせる
+func updatePassword(u User, password, except string) error {
+	passhash := calculatePasshash(u.AccountName, password)
+	_, err := db.Exec("UPDATE `users` SET `passhash` = ? WHERE `id` = ?", passhash, u.ID)
+	if err != nil {
+		return err
+	}
+
+	if value, ok := userCache.Load(u.ID); ok {
+		cached := value.(User)
+		cached.Passhash = passhash
+		userCache.Store(u.ID, cached)
+	}
+
+	// 使われていない再設定用のリンクも無効にする
+	_, err = db.Exec("UPDATE `password_reset_tokens` SET `used_at` = NOW() WHERE `user_id` = ? AND `used_at` IS NULL", u.ID)
+	if err != nil {
+		return err
+	}
+
+	return revokeUserSessions([]int{u.ID}, except)
+}
+
+func getSettings(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	// 言語を設定していなければ空にして「ブラウザの設定に合わせる」を選ばせる
+	locale := ""
+	if l, ok := userLocale(me.ID); ok {
+		locale = l.String()
+	}
+
+	return renderTemplate(r.Context(), w, "settings", struct {
+		Me         User
+		Email      string
+		Locale     string
+		OIDC       OIDCConfig
+		Identities []UserIdentity
+		// ログインし直してアカウントを削除できる時間
+		ReauthMinutes int
+		CSRFToken     string
+		Flash         string
+	}{me, userEmail(me.ID), locale, cfg.OIDC, userIdentities(me.ID), int(reauthWindow.Minutes()), getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+func postSettingsPassword(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	session := getSession(r)
+	current, password := r.FormValue("current_password"), r.FormValue("password")
+
+	// 古いパスワードでもう一度本人確認する
+	if tryLogin(me.AccountName, current) == nil {
+		recordLoginFailure(me.AccountName, clientIP(r))
+		session.Values["notice"] = tr(r, "flash.wrong_current_password")
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/settings", http.StatusFound)
+		return nil
+	}
+
+	if !validatePassword(password) || password != r.FormValue("password_confirmation") {
+		session.Values["notice"] = tr(r, "flash.invalid_new_password")
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/settings", http.StatusFound)
+		return nil
+	}
+
+	err := updatePassword(me, password, session.ID)
+	if err != nil {
+		return err
+	}
+
+	session.Values["notice"] = tr(r, "flash.password_changed")
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/settings", http.StatusFound)
+	return nil
+}
+
+func postSettingsEmail(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	session := getSession(r)
+	email := strings.TrimSpace(r.FormValue("email"))
+
+	if email == "" {
+		_, err := db.ExecContext(r.Context(), "DELETE FROM `user_emails` WHERE `user_id` = ?", me.ID)
+		if err != nil {
+			return err
+		}
+	} else {
+		addr, err := mail.ParseAddress(email)
+		if err != nil || addr.Address != email {
+			session.Values["notice"] = tr(r, "flash.invalid_email")
+			session.Save(r, w)
+
+			http.Redirect(w, r, "/settings", http.StatusFound)
+			return nil
+		}
+
+		query := "INSERT INTO `user_emails` (`user_id`, `email`) VALUES (?,?) ON DUPLICATE KEY UPDATE `email` = VALUES(`email`)"
+		_, err = db.ExecContext(r.Context(), query, me.ID, email)
+		if err != nil {
+			return err
+		}
+	}
+
+	session.Values["notice"] = tr(r, "flash.email_changed")
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/settings", http.StatusFound)
+	return nil
+}
+
+func getPasswordReset(w http.ResponseWriter, r *http.Request) error {
+	if isLogin(getSessionUser(r)) {
+		http.Redirect(w, r, "/settings", http.StatusFound)
+		return nil
+	}
+
+	return renderTemplate(r.Context(), w, "password_reset_request", struct {
+		Me        User
+		CSRFToken string
+		Flash     string
+	}{User{}, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+// postPasswordReset は再設定用のリンクをメールで送る
+// アカウントの有無が分からないよう、結果に関わらず同じメッセージを返す
+// 応答時間からも分からないよう、アカウントを探すところからバックグラウンドで行う
+func postPasswordReset(w http.ResponseWriter, r *http.Request) error {
+	session := getSession(r)
+	session.Values["notice"] = tr(r, "flash.reset_link_sent")
+	session.Save(r, w)
+
+	ip := clientIP(r)
+	ok, err := allowRate(limitStore, rateKey("reset", ip), cfg.PasswordReset.Rate, time.Hour)
+	if err != nil {
+		logError(r, err)
+	}
+	if !ok {
+		requestLogger(r).Warn("password reset rate limited", slog.String("ip", ip))
+		http.Redirect(w, r, "/password/reset", http.StatusFound)
+		return nil
+	}
+
+	accountName := r.FormValue("account_name")
+	fallback := localeFrom(r.Context())
+	logger := requestLogger(r)
+	mailSends.Add(1)
+	go func() {
+		defer mailSends.Done()
+		if err := sendPasswordReset(accountName, fallback); err != nil {
+			logger.Error("failed to send password reset mail", slog.Any("err", err))
+		}
+	}()
+
+	http.Redirect(w, r, "/password/reset", http.StatusFound)
+	return nil
+}
+
+// sendPasswordReset はトークンを発行して再設定用のリンクを送る
+// アカウントが無いかメールアドレスが未登録なら何もしない
+func sendPasswordReset(accountName string, fallback *Locale) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mailSendTimeout)
+	defer cancel()
+
+	u := User{}
+	err := db.GetContext(ctx, &u, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", accountName)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	email := userEmail(u.ID)
+	if email == "" {
+		return nil
+	}
+
+	token := secureRandomStr(32)
+	_, err = db.ExecContext(
+		ctx,
+		"INSERT INTO `password_reset_tokens` (`user_id`, `token_hash`, `expires_at`) VALUES (?,?,?)",
+		u.ID, hashResetToken(token), time.Now().Add(cfg.PasswordReset.TokenTTL),
+	)
+	if err != nil {
+		return err
+	}
+
+	// 本人が言語を設定していればその言語で送る
+	l, ok := userLocale(u.ID)
+	if !ok {
+		l = fallback
+	}
+	link := strings.TrimRight(cfg.BaseURL, "/") + "/password/reset/" + token
+	body := l.T("mail.password_reset_body", u.AccountName, cfg.PasswordReset.TokenTTL, link)
+
+	return mailer.Send(ctx, Mail{To: email, Subject: l.T("mail.password_reset_subject"), Body: body})
+}
+
+// validResetToken は有効期限内で未使用のトークンの持ち主を返す
+func validResetToken(token string) (User, bool) {
+	uid := 0
+	err := db.Get(&uid,
+		"SELECT `user_id` FROM `password_reset_tokens` WHERE `token_hash` = ? AND `used_at` IS NULL AND `expires_at` > ?",
+		hashResetToken(token), time.Now(),
+	)
+	if err != nil {
+		return User{}, false
+	}
+	value, ok := userCache.Load(uid)
+	if !ok {
+		return User{}, false
+	}
+	u := value.(User)
+	return u, u.DelFlg == 0
+}
+
+func getPasswordResetToken(w http.ResponseWriter, r *http.Request) error {
+	token := pat.Param(r, "token")
+	if _, ok := validResetToken(token); !ok {
+		session := getSession(r)
+		session.Values["notice"] = tr(r, "flash.invalid_reset_link")
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/password/reset", http.StatusFound)
+		return nil
+	}
+
+	return renderTemplate(r.Context(), w, "password_reset", struct {
+		Me        User
+		Token     string
+		CSRFToken string
+		Flash     string
+	}{User{}, token, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+func postPasswordResetToken(w http.ResponseWriter, r *http.Request) error {
+	token := pat.Param(r, "token")
+	session := getSession(r)
+
+	u, ok := validResetToken(token)
+	if !ok {
+		session.Values["notice"] = tr(r, "flash.invalid_reset_link")
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/password/reset", http.StatusFound)
+		return nil
+	}
+
+	password := r.FormValue("password")
+	if !validatePassword(password) || password != r.FormValue("password_confirmation") {
+		session.Values["notice"] = tr(r, "flash.invalid_new_password")
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/password/reset/"+token, http.StatusFound)
+		return nil
+	}
+
+	// 同じトークンが同時に使われても1回しか通さない
+	result, err := db.ExecContext(r.Context(), "UPDATE `password_reset_tokens` SET `used_at` = NOW() WHERE `token_hash` = ? AND `used_at` IS NULL", hashResetToken(token))
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n != 1 {
+		session.Values["notice"] = tr(r, "flash.invalid_reset_link")
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/password/reset", http.StatusFound)
+		return nil
+	}
+
+	err = updatePassword(u, password, "")
+	if err != nil {
+		return err
+	}
+	resetLoginFailures(u.AccountName)
+
+	session.Values["notice"] = tr(r, "flash.password_reset")
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/login", http.StatusFound)
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// rateStore は有効期限付きのカウンタを保存する
+// 1台で動かすならメモリ、複数台で共有するならmemcachedを使う
+type rateStore interface {
+	// Incr はカウンタを1増やした値を返す。キーがなければ ttl の有効期限で作る
+	Incr(key string, ttl time.Duration) (int64, error)
+	Get(key string) (int64, error)
+	Set(key string, value int64, ttl time.Duration) error
+	Delete(key string) error
+}
+
+var limitStore rateStore
+
+func newRateStore(kind string) (rateStore, error) {
+	switch kind {
+	case "memory":
+		s := newMemoryRateStore(time.Minute)
+		onShutdown(func(ctx context.Context) error {
+			s.Close()
+			return nil
+		})
+		return s, nil
+	case "memcached":
+		return &memcacheRateStore{client: memcacheClient, prefix: "iscogram_rl_"}, nil
+	}
+	return nil, fmt.Errorf("unknown rate limit store %q", kind)
+}
+
+// rateKey はmemcachedのキーに使えない文字を含みうる値からキーを作る
+func rateKey(parts ...string) string {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%s_%x", parts[0], h.Sum(nil))
+}
+
+type rateEntry struct {
+	value   int64
+	expires time.Time
+}
+
+type memoryRateStore struct {
+	mu      sync.Mutex
+	entries map[string]rateEntry
+	done    chan struct{}
+}
+
+func newMemoryRateStore(sweepInterval time.Duration) *memoryRateStore {
+	s := &memoryRateStore{
+		entries: map[string]rateEntry{},
+		done:    make(chan struct{}),
+	}
+	go s.sweep(sweepInterval)
+	return s
+}
+
+// 期限切れのエントリを定期的に消す
+func (s *memoryRateStore) sweep(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-t.C:
+			s.mu.Lock()
+			for k, e := range s.entries {
+				if now.After(e.expires) {
+					delete(s.entries, k)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *memoryRateStore) Close() {
+	close(s.done)
+}
+
+func (s *memoryRateStore) Incr(key string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	e, ok := s.entries[key]
+	if !ok || now.After(e.expires) {
+		e = rateEntry{expires: now.Add(ttl)}
+	}
+	e.value++
+	s.entries[key] = e
+	return e.value, nil
+}
+
+func (s *memoryRateStore) Get(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return 0, nil
+	}
+	return e.value, nil
+}
+
+func (s *memoryRateStore) Set(key string, value int64, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = rateEntry{value: value, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (s *memoryRateStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+type memcacheRateStore struct {
+	client *memcache.Client
+	prefix string
+}
+
+func expirationSeconds(ttl time.Duration) int32 {
+	sec := int32(ttl / time.Second)
+	if sec < 1 {
+		sec = 1
+	}
+	return sec
+}
+
+func (s *memcacheRateStore) Incr(key string, ttl time.Duration) (int64, error) {
+	key = s.prefix + key
+	v, err := s.client.Increment(key, 1)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		err = s.client.Add(&memcache.Item{Key: key, Value: []byte("1"), Expiration: expirationSeconds(ttl)})
+		if errors.Is(err, memcache.ErrNotStored) {
+			// 別のプロセスが先に作った
+			v, err = s.client.Increment(key, 1)
+			return int64(v), err
+		}
+		return 1, err
+	}
+	return int64(v), err
+}
+
+func (s *memcacheRateStore) Get(key string) (int64, error) {
+	item, err := s.client.Get(s.prefix + key)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(item.Value), 10, 64)
+}
+
+func (s *memcacheRateStore) Set(key string, value int64, ttl time.Duration) error {
+	return s.client.Set(&memcache.Item{
+		Key:        s.prefix + key,
+		Value:      []byte(strconv.FormatInt(value, 10)),
+		Expiration: expirationSeconds(ttl),
+	})
+}
+
+func (s *memcacheRateStore) Delete(key string) error {
+	err := s.client.Delete(s.prefix + key)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return nil
+	}
+	return err
+}
+
+func rateBucketKey(key string, window time.Duration) string {
+	bucket := time.Now().UnixNano() / int64(window)
+	return key + "_" + strconv.FormatInt(bucket, 10)
+}
+
+// rateWindowEnd は現在のウィンドウが終わる時刻を返す
+func rateWindowEnd(window time.Duration) time.Time {
+	bucket := time.Now().UnixNano() / int64(window)
+	return time.Unix(0, (bucket+1)*int64(window))
+}
+
+// allowRate は window ごとの固定ウィンドウで limit 回まで許可する
+// limit が0以下なら制限しない
+func allowRate(s rateStore, key string, limit int, window time.Duration) (bool, error) {
+	if limit <= 0 {
+		return true, nil
+	}
+	n, err := s.Incr(rateBucketKey(key, window), window)
+	if err != nil {
+		return false, err
+	}
+	return n <= int64(limit), nil
+}
+
+// currentRate は現在のウィンドウで数えられた回数を返す
+func currentRate(s rateStore, key string, window time.Duration) (int64, error) {
+	return s.Get(rateBucketKey(key, window))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	shutdownHooksMu sync.Mutex
+	shutdownHooks   []func(context.Context) error
+	flushHooks      []func(context.Context) error
+)
+
+// onFlush はHTTPサーバーが停止した直後、onShutdown の処理より前に呼ばれる処理を登録する
+// 書き込み待ちのキャッシュやジョブをここで書き出す。登録した順に呼ばれる
+func onFlush(hook func(context.Context) error) {
+	shutdownHooksMu.Lock()
+	defer shutdownHooksMu.Unlock()
+	flushHooks = append(flushHooks, hook)
+}
+
+func runFlushHooks(ctx context.Context) {
+	shutdownHooksMu.Lock()
+	hooks := flushHooks
+	flushHooks = nil
+	shutdownHooksMu.Unlock()
+
+	for _, hook := range hooks {
+		if err := hook(ctx); err != nil {
+			slog.Error("flush hook failed", slog.Any("err", err))
+		}
+	}
+}
+
+// onShutdown はHTTPサーバーが停止した後に呼ばれる処理を登録する
+// 登録と逆順に呼ばれるので、後から初期化したものほど先に片付けられる
+func onShutdown(hook func(context.Context) error) {
+	shutdownHooksMu.Lock()
+	defer shutdownHooksMu.Unlock()
+	shutdownHooks = append(shutdownHooks, hook)
+}
+
+func runShutdownHooks(ctx context.Context) {
+	shutdownHooksMu.Lock()
+	hooks := shutdownHooks
+	shutdownHooks = nil
+	shutdownHooksMu.Unlock()
+
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if err := hooks[i](ctx); err != nil {
+			slog.Error("shutdown hook failed", slog.Any("err", err))
+		}
+	}
+}
+
+func newServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+	}
+}
+
+// serve はSIGTERMかSIGINTを受け取るまでサーバーを動かし続ける
+// シグナルを受け取ったら drain_delay だけ待ってから新規の接続を止め、
+// 処理中のリクエストが終わるのを待ってから書き込み待ちのものを書き出し、後片付けをする
+func serve(servers ...*http.Server) error {
+	errCh := make(chan error, len(servers))
+	for _, srv := range servers {
+		srv := srv
+		go func() {
+			slog.Info("listening", slog.String("addr", srv.Addr))
+			if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errCh <- err
+			}
+		}()
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigCh)
+
+	var serveErr error
+	select {
+	case sig := <-sigCh:
+		slog.Info("shutting down", slog.String("signal", sig.String()))
+	case serveErr = <-errCh:
+		slog.Error("server error, shutting down", slog.Any("err", serveErr))
+	}
+
+	// ロードバランサーに新しいリクエストを送らせないよう/readyzを先に落とし、
+	// 外されるまでの間は今まで通りリクエストを受け付ける。もう一度シグナルを受け取れば待たない
+	markShuttingDown()
+	if serveErr == nil && cfg.Server.DrainDelay > 0 {
+		slog.Info("draining", slog.Duration("delay", cfg.Server.DrainDelay))
+		select {
+		case <-time.After(cfg.Server.DrainDelay):
+		case <-sigCh:
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				slog.Error("failed to shutdown gracefully", slog.String("addr", srv.Addr), slog.Any("err", err))
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	runFlushHooks(ctx)
+	runShutdownHooks(ctx)
+	slog.Info("shutdown completed")
+
+	return serveErr
+}
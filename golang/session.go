@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	gsm "github.com/bradleypeabody/gorilla-sessions-memcache"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	sessionName           = "isuconp-go.session"
+	sessionHashKeyLength  = 64
+	sessionBlockKeyLength = 32
+	// last_seen の更新はこの間隔より短い間は省略する
+	sessionTouchInterval = time.Minute
+	// ログインし直してからこの時間内なら、パスワードの代わりの本人確認として扱う
+	reauthWindow = 5 * time.Minute
+	// 鍵を設定できるようになる前に埋め込まれていた署名用の鍵
+	legacySessionSecret = "sendagaya"
+)
+
+type UserSession struct {
+	ID         int       `db:"id"`
+	SessionID  string    `db:"session_id"`
+	UserID     int       `db:"user_id"`
+	IP         string    `db:"ip"`
+	UserAgent  string    `db:"user_agent"`
+	CreatedAt  time.Time `db:"created_at"`
+	LastSeenAt time.Time `db:"last_seen_at"`
+	Current    bool      `db:"-"`
+}
+
+func decodeSessionKey(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(s)
+}
+
+// sessionKeyPairs は gorilla/sessions に渡すハッシュ鍵と暗号化鍵のペアを新しい順に返す
+// 署名と暗号化には先頭のペアだけが使われ、検証は全てのペアで試される
+// ローテーションするときは新しい鍵を先頭に追加し、古い鍵は1世代分だけ残しておく
+// accept_legacy_secret が有効なら (デフォルト)、旧来の鍵を検証だけに使う最も古い鍵として扱う
+// session.secret が空なら以前埋め込まれていた鍵を使う。hash_keys へ移行して1リリース経ったら無効にする
+func sessionKeyPairs(c SessionConfig) ([][]byte, error) {
+	pairs := [][]byte{}
+	for i, hs := range c.HashKeys {
+		hashKey, err := decodeSessionKey(hs)
+		if err != nil {
+			return nil, fmt.Errorf("session.hash_keys[%d]: %w", i, err)
+		}
+		if len(hashKey) < 32 {
+			return nil, fmt.Errorf("session.hash_keys[%d] must be at least 32 bytes", i)
+		}
+
+		var blockKey []byte
+		if i < len(c.BlockKeys) {
+			blockKey, err = decodeSessionKey(c.BlockKeys[i])
+			if err != nil {
+				return nil, fmt.Errorf("session.block_keys[%d]: %w", i, err)
+			}
+			if l := len(blockKey); l != 16 && l != 24 && l != 32 {
+				return nil, fmt.Errorf("session.block_keys[%d] must be 16, 24 or 32 bytes", i)
+			}
+		}
+		pairs = append(pairs, hashKey, blockKey)
+	}
+
+	if c.AcceptLegacySecret {
+		secret := c.Secret
+		if secret == "" {
+			secret = legacySessionSecret
+		}
+		pairs = append(pairs, []byte(secret), nil)
+	}
+	return pairs, nil
+}
+
+// sessionStore はmemcachedとのやりとりをスパンにする
+// Session.Save からも呼ばれるよう、New で作るセッションの持ち主を自分にする
+type sessionStore struct {
+	*gsm.MemcacheStore
+}
+
+func (s *sessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *sessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	_, span := tracer.Start(r.Context(), "session load")
+	inner, err := s.MemcacheStore.New(r, name)
+	endSpan(span, err)
+
+	session := sessions.NewSession(s, name)
+	session.ID, session.Values, session.Options, session.IsNew = inner.ID, inner.Values, inner.Options, inner.IsNew
+	return session, err
+}
+
+func (s *sessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	_, span := tracer.Start(r.Context(), "session save")
+	err := s.MemcacheStore.Save(r, w, session)
+	endSpan(span, err)
+	return err
+}
+
+func newSessionStore(client *memcache.Client, c SessionConfig) (*sessionStore, error) {
+	pairs, err := sessionKeyPairs(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Secret != "" && !c.AcceptLegacySecret {
+		slog.Warn("session.secret is ignored because session.accept_legacy_secret is false")
+	}
+	if len(c.HashKeys) == 0 {
+		// dev のときだけここに来る (validate で弾く)。起動ごとに生成するので再起動するとログインし直しになる
+		slog.Warn("session.hash_keys is not set; using a random key, so sessions do not survive a restart")
+		pairs = append([][]byte{
+			securecookie.GenerateRandomKey(sessionHashKeyLength),
+			securecookie.GenerateRandomKey(sessionBlockKeyLength),
+		}, pairs...)
+	}
+	s := gsm.NewMemcacheStore(client, "iscogram_", pairs...)
+	s.Options = sessionOptions(c, int(c.AbsoluteTimeout/time.Second))
+	return &sessionStore{s}, nil
+}
+
+func sessionOptions(c SessionConfig, maxAge int) *sessions.Options {
+	sameSite := http.SameSiteLaxMode
+	switch c.CookieSameSite {
+	case "strict":
+		sameSite = http.SameSiteStrictMode
+	case "none":
+		sameSite = http.SameSiteNoneMode
+	}
+	return &sessions.Options{
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   c.CookieSecure,
+		HttpOnly: true,
+		SameSite: sameSite,
+	}
+}
+
+// clientIP はnginxが付与するX-Real-IPを優先してクライアントのIPアドレスを返す
+func clientIP(r *http.Request) string {
+	if ip := r.Header.Get("X-Real-IP"); ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
+
+// startUserSession はログイン時にセッションIDを作り直してからユーザーを紐付ける
+// セッション固定攻撃を防ぐため、ログイン前のセッションはmemcachedから消す
+func startUserSession(w http.ResponseWriter, r *http.Request, uid int) error {
+	session := getSession(r)
+	if session.ID != "" {
+		memcacheClient.Delete(store.KeyPrefix + session.ID)
+		db.ExecContext(r.Context(), "DELETE FROM `user_sessions` WHERE `session_id` = ?", session.ID)
+	}
+	session.ID = ""
+	session.IsNew = true
+	for k := range session.Values {
+		delete(session.Values, k)
+	}
+
+	now := time.Now().Unix()
+	session.Values["user_id"] = uid
+	session.Values["csrf_token"] = secureRandomStr(16)
+	session.Values["created_at"] = now
+	session.Values["authenticated_at"] = now
+	session.Values["last_seen"] = now
+	if err := session.Save(r, w); err != nil {
+		return err
+	}
+
+	return touchUserSession(session.ID, uid, r)
+}
+
+func touchUserSession(sessionID string, uid int, r *http.Request) error {
+	query := "INSERT INTO `user_sessions` (`session_id`, `user_id`, `ip`, `user_agent`) VALUES (?,?,?,?) " +
+		"ON DUPLICATE KEY UPDATE `ip` = VALUES(`ip`), `user_agent` = VALUES(`user_agent`), `last_seen_at` = CURRENT_TIMESTAMP"
+	_, err := db.ExecContext(r.Context(), query, sessionID, uid, truncate(clientIP(r), 64), truncate(r.UserAgent(), 255))
+	return err
+}
+
+// recentlyAuthenticated は現在のセッションが reauthWindow 以内のログインで作られたなら true
+// created_at は有効期限の導入前のセッションにも後から入るので、ログインしたときだけ入れる authenticated_at を見る
+func recentlyAuthenticated(r *http.Request) bool {
+	at, ok := getSession(r).Values["authenticated_at"].(int64)
+	return ok && time.Since(time.Unix(at, 0)) <= reauthWindow
+}
+
+// destroySession は現在のセッションを破棄してCookieも消す
+func destroySession(w http.ResponseWriter, r *http.Request) {
+	session := getSession(r)
+	if session.ID != "" {
+		memcacheClient.Delete(store.KeyPrefix + session.ID)
+		db.ExecContext(r.Context(), "DELETE FROM `user_sessions` WHERE `session_id` = ?", session.ID)
+	}
+	for k := range session.Values {
+		delete(session.Values, k)
+	}
+	http.SetCookie(w, sessions.NewCookie(sessionName, "", sessionOptions(cfg.Session, -1)))
+}
+
+// revokeUserSessions は指定したユーザーのセッションを全て破棄する
+// except に渡したセッションIDだけは残す
+func revokeUserSessions(userIDs []int, except string) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+	query, args, err := sqlx.In("SELECT `session_id` FROM `user_sessions` WHERE `user_id` IN (?)", userIDs)
+	if err != nil {
+		return err
+	}
+	sessionIDs := []string{}
+	if err := db.Select(&sessionIDs, query, args...); err != nil {
+		return err
+	}
+	for _, sid := range sessionIDs {
+		if sid == except {
+			continue
+		}
+		memcacheClient.Delete(store.KeyPrefix + sid)
+		if _, err := db.Exec("DELETE FROM `user_sessions` WHERE `session_id` = ?", sid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isStaticPath(p string) bool {
+	for _, prefix := range []string{"/image/", "/css/", "/js/", "/img/", "/favicon.ico", "/healthz", "/readyz"} {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionLifecycle はログイン中のセッションの有効期限を確認し、最終アクセス時刻を更新する
+// アイドル時間か作成からの経過時間が上限を超えたセッションと、BANされたユーザーのセッションは破棄する
+func sessionLifecycle(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isStaticPath(r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if _, err := r.Cookie(sessionName); err != nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		session := getSession(r)
+		uid, ok := session.Values["user_id"].(int)
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		now := time.Now()
+		createdAt, _ := session.Values["created_at"].(int64)
+		lastSeen, _ := session.Values["last_seen"].(int64)
+		// 有効期限の導入前に作られたセッションは今作られたものとみなす
+		if createdAt == 0 {
+			createdAt = now.Unix()
+			session.Values["created_at"] = createdAt
+		}
+
+		banned := false
+		if value, ok := userCache.Load(uid); ok {
+			banned = value.(User).DelFlg == 1
+		}
+
+		if banned ||
+			now.Sub(time.Unix(createdAt, 0)) > cfg.Session.AbsoluteTimeout ||
+			(lastSeen != 0 && now.Sub(time.Unix(lastSeen, 0)) > cfg.Session.IdleTimeout) {
+			destroySession(w, r)
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if now.Sub(time.Unix(lastSeen, 0)) >= sessionTouchInterval {
+			session.Values["last_seen"] = now.Unix()
+			if err := session.Save(r, w); err != nil {
+				logError(r, err)
+			} else if err := touchUserSession(session.ID, uid, r); err != nil {
+				logError(r, err)
+			}
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// sessionActiveSince は有効なセッションの last_seen_at と created_at の下限を返す
+// それより古い行はmemcachedのセッションが sessionLifecycle で破棄されるので、一覧にも出さない
+func sessionActiveSince(now time.Time) (lastSeenAt, createdAt time.Time) {
+	return now.Add(-cfg.Session.IdleTimeout), now.Add(-cfg.Session.AbsoluteTimeout)
+}
+
+func getSettingsSessions(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	lastSeenAt, createdAt := sessionActiveSince(time.Now())
+	userSessions := []UserSession{}
+	query := "SELECT * FROM `user_sessions` WHERE `user_id` = ? AND `last_seen_at` > ? AND `created_at` > ? ORDER BY `last_seen_at` DESC"
+	err := db.SelectContext(r.Context(), &userSessions, query, me.ID, lastSeenAt, createdAt)
+	if err != nil {
+		return err
+	}
+	current := getSession(r).ID
+	for i := range userSessions {
+		userSessions[i].Current = userSessions[i].SessionID == current
+	}
+
+	return renderTemplate(r.Context(), w, "sessions", struct {
+		Sessions  []UserSession
+		Me        User
+		CSRFToken string
+		Flash     string
+	}{userSessions, me, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+// 他の端末のセッションをログアウトさせる
+// id を指定しなければ現在のセッション以外の全てを破棄する
+func postSettingsSessionsRevoke(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	current := getSession(r).ID
+	if r.FormValue("id") == "" {
+		err := revokeUserSessions([]int{me.ID}, current)
+		if err != nil {
+			return err
+		}
+	} else {
+		id, err := strconv.Atoi(r.FormValue("id"))
+		if err != nil {
+			return badRequest("error.bad_request")
+		}
+		// 期限切れのセッションは一覧に出していないので、指定されても見つからないものとして扱う
+		lastSeenAt, createdAt := sessionActiveSince(time.Now())
+		us := UserSession{}
+		query := "SELECT * FROM `user_sessions` WHERE `id` = ? AND `user_id` = ? AND `last_seen_at` > ? AND `created_at` > ?"
+		err = db.GetContext(r.Context(), &us, query, id, me.ID, lastSeenAt, createdAt)
+		if err != nil {
+			return err
+		}
+		if us.SessionID != current {
+			memcacheClient.Delete(store.KeyPrefix + us.SessionID)
+			_, err = db.ExecContext(r.Context(), "DELETE FROM `user_sessions` WHERE `id` = ?", us.ID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	session := getSession(r)
+	session.Values["notice"] = tr(r, "flash.sessions_revoked")
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/settings/sessions", http.StatusFound)
+	return nil
+}
+
+// `app session keygen` でローテーション用の新しい鍵ペアを生成する
+func runSessionCommand(args []string) error {
+	if len(args) == 0 || args[0] != "keygen" {
+		return errors.New("usage: app session keygen")
+	}
+
+	hashKey := securecookie.GenerateRandomKey(sessionHashKeyLength)
+	blockKey := securecookie.GenerateRandomKey(sessionBlockKeyLength)
+	if hashKey == nil || blockKey == nil {
+		return errors.New("failed to generate random keys")
+	}
+
+	fmt.Fprintf(os.Stdout, `# 既存の鍵の先頭に追加する (古い鍵は1世代分残しておく)
+session:
+  hash_keys:
+    - %s
+  block_keys:
+    - %s
+`, base64.StdEncoding.EncodeToString(hashKey), base64.StdEncoding.EncodeToString(blockKey))
+	return nil
+}
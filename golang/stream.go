@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SSEのイベントの種類
+const (
+	streamEventPost    = "post"
+	streamEventComment = "comment"
+)
+
+// 1回の書き込みにかけられる時間。超えたら相手が読んでいないとみなして切断する
+const streamWriteTimeout = 10 * time.Second
+
+type StreamEvent struct {
+	ID   int64
+	Type string
+	Data []byte
+}
+
+// Broker は新しい投稿などをSSEの接続に配る
+// 複数台で動かす場合は、他のプロセスの Publish も届く実装に差し替える
+type Broker interface {
+	Publish(typ string, data []byte)
+	// Subscribe は lastID より後のイベントを流すチャネルを返す
+	// 受信が追いつかなくなるとチャネルは閉じられる
+	Subscribe(lastID int64) (<-chan StreamEvent, func())
+}
+
+var (
+	streamBroker      Broker
+	streamConnections int64
+)
+
+func newBroker(c StreamConfig) (Broker, error) {
+	switch c.Broker {
+	case "memory":
+		return newMemoryBroker(c.Buffer), nil
+	}
+	return nil, fmt.Errorf("unknown stream broker %q", c.Broker)
+}
+
+// memoryBroker はプロセス内で配るだけの Broker
+// 再接続したクライアントが取りこぼさないよう、直近のイベントを buffer 件だけ覚えておく
+type memoryBroker struct {
+	mu          sync.Mutex
+	buffer      int
+	lastID      int64
+	recent      []StreamEvent
+	subscribers map[chan StreamEvent]struct{}
+}
+
+func newMemoryBroker(buffer int) *memoryBroker {
+	return &memoryBroker{
+		buffer:      buffer,
+		subscribers: map[chan StreamEvent]struct{}{},
+	}
+}
+
+func (b *memoryBroker) Publish(typ string, data []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	e := StreamEvent{ID: b.lastID, Type: typ, Data: data}
+	b.recent = append(b.recent, e)
+	if len(b.recent) > b.buffer {
+		b.recent = b.recent[len(b.recent)-b.buffer:]
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+			// 詰まっている接続は閉じる。クライアントは Last-Event-ID を付けて再接続してくる
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (b *memoryBroker) Subscribe(lastID int64) (<-chan StreamEvent, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan StreamEvent, b.buffer)
+	if lastID > 0 {
+		for _, e := range b.recent {
+			if e.ID > lastID {
+				ch <- e
+			}
+		}
+	}
+	b.subscribers[ch] = struct{}{}
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[ch]; ok {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// renderStreamPost は投稿をタイムラインと同じHTMLにする
+// CSRFトークンは接続ごとに違うので空にしておき、main.js がページ内のトークンで埋める
+func renderStreamPost(l *Locale, p Post) ([]byte, error) {
+	tpl, err := lookupTemplate(l, "post")
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	if err := tpl.Execute(&b, p); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// publishPost は新しい投稿を接続中のブラウザに配る
+// 見ている人の言語は分からないので全ての言語で描画し、main.js がページの言語のものを使う
+func publishPost(p Post) {
+	htmls := make(map[string]string, len(locales))
+	for _, l := range locales {
+		html, err := renderStreamPost(l, p)
+		if err != nil {
+			slog.Error("publishPost failed", slog.Any("err", err))
+			return
+		}
+		htmls[l.String()] = string(html)
+	}
+	data, err := json.Marshal(map[string]interface{}{"id": p.ID, "html": htmls[defaultLocale.String()], "html_by_locale": htmls})
+	if err != nil {
+		slog.Error("publishPost failed", slog.Any("err", err))
+		return
+	}
+	streamBroker.Publish(streamEventPost, data)
+}
+
+func publishCommentCount(postID, count int) {
+	data, err := json.Marshal(map[string]int{"post_id": postID, "count": count})
+	if err != nil {
+		slog.Error("publishCommentCount failed", slog.Any("err", err))
+		return
+	}
+	streamBroker.Publish(streamEventComment, data)
+}
+
+// getStream は新しい投稿とコメント数の変化をSSEで流し続ける
+func getStream(w http.ResponseWriter, r *http.Request) error {
+	if n := atomic.AddInt64(&streamConnections, 1); cfg.Stream.MaxConnections > 0 && n > int64(cfg.Stream.MaxConnections) {
+		atomic.AddInt64(&streamConnections, -1)
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return nil
+	}
+	defer atomic.AddInt64(&streamConnections, -1)
+
+	rc := http.NewResponseController(w)
+	write := func(format string, args ...interface{}) error {
+		// サーバー全体の WriteTimeout の代わりに、書き込みごとに期限を付ける
+		if err := rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout)); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	lastID, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+	events, unsubscribe := streamBroker.Subscribe(lastID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// nginx にバッファさせない
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := write("retry: 3000\n\n"); err != nil {
+		return nil
+	}
+
+	heartbeat := time.NewTicker(cfg.Stream.Heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-shutdownStarted:
+			return nil
+		case e, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if err := write("id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, e.Data); err != nil {
+				return nil
+			}
+		case <-heartbeat.C:
+			if err := write(": ping\n\n"); err != nil {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//go:embed templates
+var embeddedTemplates embed.FS
+
+// pageTemplates はテンプレートの名前と組み立てるファイル。最初のファイルから描画する
+var pageTemplates = map[string][]string{
+	"index":                  {"layout.html", "index.html", "posts.html", "post.html"},
+	"user":                   {"layout.html", "user.html", "posts.html", "post.html"},
+	"post_id":                {"layout.html", "post_id.html", "post.html"},
+	"posts":                  {"posts.html", "post.html"},
+	"post":                   {"post.html"},
+	"login":                  {"layout.html", "login.html"},
+	"login_2fa":              {"layout.html", "login_2fa.html"},
+	"register":               {"layout.html", "register.html"},
+	"password_reset":         {"layout.html", "password_reset.html"},
+	"password_reset_request": {"layout.html", "password_reset_request.html"},
+	"settings":               {"layout.html", "settings.html"},
+	"sessions":               {"layout.html", "sessions.html"},
+	"totp":                   {"layout.html", "totp.html"},
+	"tokens":                 {"layout.html", "tokens.html"},
+	"banned":                 {"layout.html", "banned.html"},
+	"lockouts":               {"layout.html", "lockouts.html"},
+	"webhooks":               {"layout.html", "webhooks.html"},
+	"jobs":                   {"layout.html", "jobs.html"},
+	"error":                  {"layout.html", "error.html"},
+}
+
+var (
+	templatesMu sync.RWMutex
+	// 言語ごとに、その言語の t や ago を組み込んで組み立てる
+	templates map[*Locale]map[string]*template.Template
+)
+
+// parseTemplates はすべての言語のすべてのテンプレートを組み立てる。1つでも失敗したらエラーにする
+func parseTemplates(fsys fs.FS) (map[*Locale]map[string]*template.Template, error) {
+	all := make(map[*Locale]map[string]*template.Template, len(locales))
+	for _, l := range locales {
+		m := make(map[string]*template.Template, len(pageTemplates))
+		for name, files := range pageTemplates {
+			tpl, err := template.New(files[0]).Funcs(fmap).Funcs(localeFuncs(l)).ParseFS(fsys, files...)
+			if err != nil {
+				return nil, fmt.Errorf("template %s (%s): %w", name, l, err)
+			}
+			if files[0] == "layout.html" && tpl.Lookup("content") == nil {
+				return nil, fmt.Errorf("template %s: content is not defined", name)
+			}
+			m[name] = tpl
+		}
+		all[l] = m
+	}
+	return all, nil
+}
+
+// loadTemplates は起動時にテンプレートを読む。loadLocales の後に呼ぶ
+// dir が空ならバイナリに埋め込んだものを使うので、どのディレクトリから起動しても動く
+func loadTemplates(dir string) error {
+	var fsys fs.FS
+	if dir == "" {
+		sub, err := fs.Sub(embeddedTemplates, "templates")
+		if err != nil {
+			return err
+		}
+		fsys = sub
+	} else {
+		fsys = os.DirFS(dir)
+	}
+
+	m, err := parseTemplates(fsys)
+	if err != nil {
+		return err
+	}
+	setTemplates(m)
+
+	if dir != "" {
+		watchTemplates(dir)
+	}
+	return nil
+}
+
+func setTemplates(m map[*Locale]map[string]*template.Template) {
+	templatesMu.Lock()
+	templates = m
+	templatesMu.Unlock()
+}
+
+func lookupTemplate(l *Locale, name string) (*template.Template, error) {
+	templatesMu.RLock()
+	tpl, ok := templates[l][name]
+	templatesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("template %q is not defined", name)
+	}
+	return tpl, nil
+}
+
+// renderTemplate は名前で選んだテンプレートをリクエストの言語で描画する。描画はスパンにする
+func renderTemplate(ctx context.Context, w io.Writer, name string, data interface{}) error {
+	l := localeFrom(ctx)
+	tpl, err := lookupTemplate(l, name)
+	if err != nil {
+		return err
+	}
+	_, span := tracer.Start(ctx, "template "+name, trace.WithAttributes(
+		attribute.String("template.name", name),
+		attribute.String("template.locale", l.String()),
+	))
+	err = tpl.Execute(w, data)
+	endSpan(span, err)
+	return err
+}
+
+// watchTemplates は dir のファイルの更新を1秒ごとに調べ、変わっていれば読み直す
+// 読み直しに失敗したときは前のテンプレートを使い続ける
+func watchTemplates(dir string) {
+	last := templatesModTime(dir)
+	ticker := time.NewTicker(time.Second)
+	done := make(chan struct{})
+	onShutdown(func(ctx context.Context) error {
+		ticker.Stop()
+		close(done)
+		return nil
+	})
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			t := templatesModTime(dir)
+			if t.Equal(last) {
+				continue
+			}
+			last = t
+
+			m, err := parseTemplates(os.DirFS(dir))
+			if err != nil {
+				slog.Error("failed to reload templates", slog.Any("err", err))
+				continue
+			}
+			setTemplates(m)
+			slog.Info("templates reloaded", slog.String("dir", dir))
+		}
+	}()
+}
+
+// templatesModTime は dir とその中のファイルの最終更新時刻のうち最も新しいもの
+func templatesModTime(dir string) time.Time {
+	var latest time.Time
+	fs.WalkDir(os.DirFS(dir), ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	return latest
+}
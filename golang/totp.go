@@ -0,0 +1,487 @@
+package main
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	totpIssuer  = "Iscogram"
+	totpDigits  = 6
+	totpPeriod  = 30 * time.Second
+	totpSkew    = 1 // 前後何ステップまで許容するか
+	totpPending = 5 * time.Minute
+
+	recoveryCodeCount = 10
+)
+
+var (
+	// テストでは固定の時刻を返す関数に差し替える
+	totpClock = time.Now
+	// 2段階認証を有効にしているユーザー
+	totpEnabled = cache{name: "totp_enabled"}
+)
+
+type UserTOTP struct {
+	UserID       int       `db:"user_id"`
+	Secret       string    `db:"secret"`
+	LastUsedStep int64     `db:"last_used_step"`
+	EnabledAt    time.Time `db:"enabled_at"`
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTOTPSecret() string {
+	b := make([]byte, 20)
+	if _, err := crand.Read(b); err != nil {
+		panic(err)
+	}
+	return totpEncoding.EncodeToString(b)
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / int64(totpPeriod/time.Second)
+}
+
+// totpCode は RFC 6238 (HMAC-SHA1, 6桁) のワンタイムパスワードを返す
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, bin%1000000), nil
+}
+
+// verifyTOTP はコードが一致したステップを返す
+// lastUsedStep 以前のステップは同じコードの使い回しになるので受け付けない
+func verifyTOTP(secret, code string, lastUsedStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := totpStep(totpClock())
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastUsedStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			slog.Error("verifyTOTP failed", slog.Any("err", err))
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpURI(accountName, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(int(totpPeriod/time.Second)))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+accountName) + "?" + v.Encode()
+}
+
+func qrCodeDataURI(content string) (template.URL, error) {
+	png, err := qrcode.Encode(content, qrcode.Medium, 256)
+	if err != nil {
+		return "", err
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)), nil
+}
+
+func isTOTPEnabled(uid int) bool {
+	_, ok := totpEnabled.Load(uid)
+	return ok
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(code)))
+}
+
+// generateRecoveryCodes は既存のリカバリーコードを捨てて新しく発行する
+// 平文のコードはこのときに一度だけ表示する
+func generateRecoveryCodes(uid int) ([]string, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM `user_recovery_codes` WHERE `user_id` = ?", uid)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		s := secureRandomStr(5)
+		code := s[:5] + "-" + s[5:]
+		_, err = tx.Exec("INSERT INTO `user_recovery_codes` (`user_id`, `code_hash`) VALUES (?,?)", uid, hashRecoveryCode(code))
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, tx.Commit()
+}
+
+// useRecoveryCode は未使用のリカバリーコードであれば使用済みにする
+func useRecoveryCode(uid int, code string) (bool, error) {
+	result, err := db.Exec(
+		"UPDATE `user_recovery_codes` SET `used_at` = NOW() WHERE `user_id` = ? AND `code_hash` = ? AND `used_at` IS NULL LIMIT 1",
+		uid, hashRecoveryCode(code),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// verifySecondFactor はTOTPのコードかリカバリーコードを検証する
+func verifySecondFactor(uid int, code string) (bool, error) {
+	t := UserTOTP{}
+	err := db.Get(&t, "SELECT * FROM `user_totp` WHERE `user_id` = ?", uid)
+	if err != nil {
+		return false, err
+	}
+
+	if step, ok := verifyTOTP(t.Secret, code, t.LastUsedStep); ok {
+		// 同時に送られた同じコードの片方だけを通す
+		result, err := db.Exec("UPDATE `user_totp` SET `last_used_step` = ? WHERE `user_id` = ? AND `last_used_step` < ?", step, uid, step)
+		if err != nil {
+			return false, err
+		}
+		n, err := result.RowsAffected()
+		return n == 1, err
+	}
+
+	return useRecoveryCode(uid, code)
+}
+
+// beginPending2FA はパスワードの確認が済んだユーザーを2段階目の確認待ちにする
+// この時点ではまだログインさせない
+func beginPending2FA(w http.ResponseWriter, r *http.Request, uid int) error {
+	session := getSession(r)
+	session.Values["pending_2fa_user_id"] = uid
+	session.Values["pending_2fa_at"] = totpClock().Unix()
+	return session.Save(r, w)
+}
+
+func pending2FAUser(r *http.Request) (User, bool) {
+	session := getSession(r)
+	uid, ok := session.Values["pending_2fa_user_id"].(int)
+	if !ok {
+		return User{}, false
+	}
+	at, _ := session.Values["pending_2fa_at"].(int64)
+	if totpClock().Sub(time.Unix(at, 0)) > totpPending {
+		return User{}, false
+	}
+	value, ok := userCache.Load(uid)
+	if !ok {
+		return User{}, false
+	}
+	u := value.(User)
+	if u.DelFlg != 0 {
+		return User{}, false
+	}
+	return u, true
+}
+
+func getLogin2FA(w http.ResponseWriter, r *http.Request) error {
+	if isLogin(getSessionUser(r)) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+	if _, ok := pending2FAUser(r); !ok {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	return renderTemplate(r.Context(), w, "login_2fa", struct {
+		Me        User
+		CSRFToken string
+		Flash     string
+	}{User{}, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+func postLogin2FA(w http.ResponseWriter, r *http.Request) error {
+	u, ok := pending2FAUser(r)
+	if !ok {
+		session := getSession(r)
+		session.Values["notice"] = tr(r, "flash.login_again")
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	ip := clientIP(r)
+	if _, locked := loginLockedUntil(u.AccountName, ip); locked {
+		session := getSession(r)
+		session.Values["notice"] = tr(r, "flash.too_many_logins")
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	ok, err := verifySecondFactor(u.ID, r.FormValue("code"))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		recordLoginFailure(u.AccountName, ip)
+
+		session := getSession(r)
+		session.Values["notice"] = tr(r, "flash.wrong_code")
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/login/2fa", http.StatusFound)
+		return nil
+	}
+
+	resetLoginFailures(u.AccountName)
+	err = startUserSession(w, r, u.ID)
+	if err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
+}
+
+type totpPage struct {
+	Me            User
+	CSRFToken     string
+	Flash         string
+	Enabled       bool
+	Required      bool
+	Secret        string
+	URI           string
+	QRCode        template.URL
+	RecoveryCodes []string
+}
+
+func renderTOTPPage(w http.ResponseWriter, r *http.Request, page totpPage) error {
+	return renderTemplate(r.Context(), w, "totp", page)
+}
+
+func getSettings2FA(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	page := totpPage{
+		Me:        me,
+		CSRFToken: getCSRFToken(r),
+		Flash:     getFlash(w, r, "notice"),
+		Enabled:   isTOTPEnabled(me.ID),
+		Required:  me.Authority != 0,
+	}
+
+	if !page.Enabled {
+		// 確認コードが送られてくるまでは秘密鍵をセッションに置いておく
+		session := getSession(r)
+		secret, ok := session.Values["totp_pending_secret"].(string)
+		if !ok {
+			secret = generateTOTPSecret()
+			session.Values["totp_pending_secret"] = secret
+			session.Save(r, w)
+		}
+		page.Secret = secret
+		page.URI = totpURI(me.AccountName, secret)
+		qr, err := qrCodeDataURI(page.URI)
+		if err != nil {
+			logError(r, err)
+		}
+		page.QRCode = qr
+	}
+
+	return renderTOTPPage(w, r, page)
+}
+
+func postSettings2FAEnable(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	session := getSession(r)
+	secret, ok := session.Values["totp_pending_secret"].(string)
+	if !ok || isTOTPEnabled(me.ID) {
+		http.Redirect(w, r, "/settings/2fa", http.StatusFound)
+		return nil
+	}
+
+	step, ok := verifyTOTP(secret, r.FormValue("code"), 0)
+	if !ok {
+		session.Values["notice"] = tr(r, "flash.wrong_code")
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/settings/2fa", http.StatusFound)
+		return nil
+	}
+
+	query := "INSERT INTO `user_totp` (`user_id`, `secret`, `last_used_step`) VALUES (?,?,?) " +
+		"ON DUPLICATE KEY UPDATE `secret` = VALUES(`secret`), `last_used_step` = VALUES(`last_used_step`), `enabled_at` = CURRENT_TIMESTAMP"
+	_, err := db.ExecContext(r.Context(), query, me.ID, secret, step)
+	if err != nil {
+		return err
+	}
+	codes, err := generateRecoveryCodes(me.ID)
+	if err != nil {
+		return err
+	}
+	totpEnabled.Store(me.ID, true)
+
+	delete(session.Values, "totp_pending_secret")
+	session.Save(r, w)
+
+	return renderTOTPPage(w, r, totpPage{
+		Me:            me,
+		CSRFToken:     getCSRFToken(r),
+		Flash:         tr(r, "flash.totp_enabled"),
+		Enabled:       true,
+		Required:      me.Authority != 0,
+		RecoveryCodes: codes,
+	})
+}
+
+func postSettings2FARecoveryCodes(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+	if !isTOTPEnabled(me.ID) {
+		http.Redirect(w, r, "/settings/2fa", http.StatusFound)
+		return nil
+	}
+
+	ok, err := verifySecondFactor(me.ID, r.FormValue("code"))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		session := getSession(r)
+		session.Values["notice"] = tr(r, "flash.wrong_code")
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/settings/2fa", http.StatusFound)
+		return nil
+	}
+
+	codes, err := generateRecoveryCodes(me.ID)
+	if err != nil {
+		return err
+	}
+
+	return renderTOTPPage(w, r, totpPage{
+		Me:            me,
+		CSRFToken:     getCSRFToken(r),
+		Flash:         tr(r, "flash.recovery_codes_regenerated"),
+		Enabled:       true,
+		Required:      me.Authority != 0,
+		RecoveryCodes: codes,
+	})
+}
+
+func postSettings2FADisable(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	session := getSession(r)
+	if me.Authority != 0 {
+		session.Values["notice"] = tr(r, "flash.admin_cannot_disable_totp")
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/settings/2fa", http.StatusFound)
+		return nil
+	}
+
+	ok, err := verifySecondFactor(me.ID, r.FormValue("code"))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		session.Values["notice"] = tr(r, "flash.wrong_code")
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/settings/2fa", http.StatusFound)
+		return nil
+	}
+
+	_, err = db.ExecContext(r.Context(), "DELETE FROM `user_totp` WHERE `user_id` = ?", me.ID)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(r.Context(), "DELETE FROM `user_recovery_codes` WHERE `user_id` = ?", me.ID)
+	if err != nil {
+		return err
+	}
+	totpEnabled.Delete(me.ID)
+
+	session.Values["notice"] = tr(r, "flash.totp_disabled")
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/settings/2fa", http.StatusFound)
+	return nil
+}
+
+// requireAdmin2FA は2段階認証を設定していない管理者を設定ページに誘導する
+func requireAdmin2FA(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isStaticPath(r.URL.Path) || strings.HasPrefix(r.URL.Path, "/settings/2fa") || r.URL.Path == "/logout" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		me := getSessionUser(r)
+		if isLogin(me) && me.Authority != 0 && !isTOTPEnabled(me.ID) {
+			session := getSession(r)
+			session.Values["notice"] = tr(r, "flash.admin_requires_totp")
+			session.Save(r, w)
+
+			http.Redirect(w, r, "/settings/2fa", http.StatusFound)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 6238 の付録Bの SHA1 のテストベクタ。totpCode は6桁なので下6桁と比べる
+func TestTOTPCodeRFC6238(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		got, err := totpCode(secret, totpStep(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := tt.want[len(tt.want)-totpDigits:]; got != want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, want)
+		}
+	}
+}
+
+// useTOTPClock は totpClock を now を返す関数に差し替える
+func useTOTPClock(t *testing.T, now time.Time) {
+	t.Helper()
+	old := totpClock
+	totpClock = func() time.Time { return now }
+	t.Cleanup(func() { totpClock = old })
+}
+
+func mustTOTPCode(t *testing.T, secret string, step int64) string {
+	t.Helper()
+	code, err := totpCode(secret, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestVerifyTOTPSkew(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	useTOTPClock(t, now)
+	secret := generateTOTPSecret()
+	current := totpStep(now)
+
+	for offset := int64(-2); offset <= 2; offset++ {
+		step, ok := verifyTOTP(secret, mustTOTPCode(t, secret, current+offset), 0)
+		want := offset >= -totpSkew && offset <= totpSkew
+		if ok != want {
+			t.Errorf("offset %d: ok = %v, want %v", offset, ok, want)
+		}
+		if ok && step != current+offset {
+			t.Errorf("offset %d: step = %d, want %d", offset, step, current+offset)
+		}
+	}
+
+	if _, ok := verifyTOTP(secret, "12345", 0); ok {
+		t.Error("accepted a code with too few digits")
+	}
+}
+
+func TestVerifyTOTPRejectsUsedStep(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	useTOTPClock(t, now)
+	secret := generateTOTPSecret()
+	current := totpStep(now)
+
+	if _, ok := verifyTOTP(secret, mustTOTPCode(t, secret, current), current); ok {
+		t.Error("accepted the code of last_used_step")
+	}
+	// 前のステップのコードで入った後は、それより前のコードも通さない
+	if _, ok := verifyTOTP(secret, mustTOTPCode(t, secret, current-1), current-1); ok {
+		t.Error("accepted the code of the step before last_used_step")
+	}
+	if _, ok := verifyTOTP(secret, mustTOTPCode(t, secret, current+1), current); !ok {
+		t.Error("rejected the code of the step after last_used_step")
+	}
+}
+
+// fakeTOTPStore は user_totp と user_recovery_codes の1ユーザー分の行
+type fakeTOTPStore struct {
+	uid          int
+	secret       string
+	lastUsedStep int64
+	// code_hash -> 使用済みかどうか
+	recoveryCodes map[string]bool
+}
+
+func (s *fakeTOTPStore) query(query string, args []driver.Value) (fakeRows, error) {
+	switch {
+	case strings.HasPrefix(query, "SELECT * FROM `user_totp`"):
+		return fakeRows{
+			Columns: []string{"user_id", "secret", "last_used_step", "enabled_at"},
+			Rows:    [][]driver.Value{{int64(s.uid), s.secret, s.lastUsedStep, time.Unix(0, 0)}},
+		}, nil
+	case strings.HasPrefix(query, "UPDATE `user_totp` SET `last_used_step`"):
+		step := args[0].(int64)
+		if s.lastUsedStep >= step {
+			return fakeRows{}, nil
+		}
+		s.lastUsedStep = step
+		return fakeRows{RowsAffected: 1}, nil
+	case strings.HasPrefix(query, "DELETE FROM `user_recovery_codes`"):
+		s.recoveryCodes = map[string]bool{}
+		return fakeRows{}, nil
+	case strings.HasPrefix(query, "INSERT INTO `user_recovery_codes`"):
+		s.recoveryCodes[args[1].(string)] = false
+		return fakeRows{RowsAffected: 1}, nil
+	case strings.HasPrefix(query, "UPDATE `user_recovery_codes` SET `used_at`"):
+		used, ok := s.recoveryCodes[args[1].(string)]
+		if !ok || used {
+			return fakeRows{}, nil
+		}
+		s.recoveryCodes[args[1].(string)] = true
+		return fakeRows{RowsAffected: 1}, nil
+	}
+	return unknownQuery(query)
+}
+
+func TestVerifySecondFactorReplay(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	useTOTPClock(t, now)
+	s := &fakeTOTPStore{uid: 1, secret: generateTOTPSecret(), recoveryCodes: map[string]bool{}}
+	useFakeDB(t, s.query)
+
+	code := mustTOTPCode(t, s.secret, totpStep(now))
+	ok, err := verifySecondFactor(s.uid, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("rejected a valid code")
+	}
+	if s.lastUsedStep != totpStep(now) {
+		t.Errorf("last_used_step = %d, want %d", s.lastUsedStep, totpStep(now))
+	}
+
+	ok, err = verifySecondFactor(s.uid, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("accepted the same code twice")
+	}
+}
+
+func TestRecoveryCodesAreSingleUse(t *testing.T) {
+	useTOTPClock(t, time.Unix(1700000000, 0))
+	s := &fakeTOTPStore{uid: 1, secret: generateTOTPSecret(), recoveryCodes: map[string]bool{}}
+	useFakeDB(t, s.query)
+
+	codes, err := generateRecoveryCodes(s.uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(s.recoveryCodes) != recoveryCodeCount {
+		t.Fatalf("generated %d codes and stored %d, want %d", len(codes), len(s.recoveryCodes), recoveryCodeCount)
+	}
+
+	// 大文字やハイフン抜きで入力されても同じコードとして扱う
+	input := strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))
+	ok, err := verifySecondFactor(s.uid, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("rejected an unused recovery code")
+	}
+	ok, err = verifySecondFactor(s.uid, codes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("accepted a used recovery code")
+	}
+
+	// 発行し直すと前のコードは使えなくなる
+	if _, err := generateRecoveryCodes(s.uid); err != nil {
+		t.Fatal(err)
+	}
+	ok, err = verifySecondFactor(s.uid, codes[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("accepted a recovery code from before regeneration")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	userActionPost    = "post"
+	userActionComment = "comment"
+)
+
+// RateStatus はユーザーごとの投稿数の上限と残り回数
+type RateStatus struct {
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Window    string    `json:"window"`
+	ResetAt   time.Time `json:"reset_at"`
+}
+
+// QuotaStatus は1日あたりのアップロード容量の上限と使用量
+type QuotaStatus struct {
+	Limit     int64     `json:"limit"`
+	Used      int64     `json:"used"`
+	Remaining int64     `json:"remaining"`
+	ResetAt   time.Time `json:"reset_at"`
+}
+
+type UserLimits struct {
+	Exempt   bool         `json:"exempt"`
+	Posts    *RateStatus  `json:"posts,omitempty"`
+	Comments *RateStatus  `json:"comments,omitempty"`
+	Upload   *QuotaStatus `json:"upload,omitempty"`
+}
+
+// 管理者は制限を受けない
+func isLimitExempt(u User) bool {
+	return u.Authority != 0
+}
+
+func userActionLimit(action string) (int, time.Duration) {
+	c := cfg.UserLimit
+	if action == userActionComment {
+		return c.CommentRate, c.CommentWindow
+	}
+	return c.PostRate, c.PostWindow
+}
+
+func userActionKey(u User, action string) string {
+	return rateKey("user", action, strconv.Itoa(u.ID))
+}
+
+// allowUserAction は投稿やコメントの回数が上限以内なら数えて true を返す
+func allowUserAction(w http.ResponseWriter, u User, action string) bool {
+	if isLimitExempt(u) {
+		return true
+	}
+	limit, window := userActionLimit(action)
+	ok, err := allowRate(limitStore, userActionKey(u, action), limit, window)
+	if err != nil {
+		slog.Error("allowUserAction failed", slog.Any("err", err))
+		return true
+	}
+	if status := userRateStatus(u, action); status != nil {
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(status.Limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(status.Remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(status.ResetAt.Unix(), 10))
+	}
+	if !ok {
+		slog.Warn("user rate limited", slog.Int("user_id", u.ID), slog.String("action", action))
+	}
+	return ok
+}
+
+func userRateStatus(u User, action string) *RateStatus {
+	limit, window := userActionLimit(action)
+	if limit <= 0 {
+		return nil
+	}
+	used, err := currentRate(limitStore, userActionKey(u, action), window)
+	if err != nil {
+		slog.Error("userRateStatus failed", slog.Any("err", err))
+	}
+	remaining := limit - int(used)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return &RateStatus{
+		Limit:     limit,
+		Remaining: remaining,
+		Window:    window.String(),
+		ResetAt:   rateWindowEnd(window),
+	}
+}
+
+func today() (string, time.Time) {
+	now := time.Now()
+	y, m, d := now.Date()
+	return now.Format("2006-01-02"), time.Date(y, m, d+1, 0, 0, 0, 0, now.Location())
+}
+
+func uploadUsageToday(uid int) (int64, error) {
+	day, _ := today()
+	var used int64
+	err := db.Get(&used, "SELECT COALESCE(SUM(`bytes`), 0) FROM `user_upload_usage` WHERE `user_id` = ? AND `day` = ?", uid, day)
+	return used, err
+}
+
+// reserveUpload は今日のアップロード量に size を足しても上限を超えなければ足して true を返す
+// 確認と加算を1つの UPDATE で行うので、同時にアップロードされても上限を超えない
+func reserveUpload(u User, size int64) (bool, error) {
+	if isLimitExempt(u) || cfg.UserLimit.DailyUploadQuota <= 0 || size <= 0 {
+		return true, addUploadUsage(u.ID, size)
+	}
+	day, _ := today()
+	_, err := db.Exec("INSERT IGNORE INTO `user_upload_usage` (`user_id`, `day`, `bytes`) VALUES (?,?,0)", u.ID, day)
+	if err != nil {
+		return false, err
+	}
+	query := "UPDATE `user_upload_usage` SET `bytes` = `bytes` + ? WHERE `user_id` = ? AND `day` = ? AND `bytes` + ? <= ?"
+	result, err := db.Exec(query, size, u.ID, day, size, cfg.UserLimit.DailyUploadQuota)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// releaseUpload は投稿できなかった分を reserveUpload で足した量から戻す
+func releaseUpload(uid int, size int64) error {
+	day, _ := today()
+	_, err := db.Exec("UPDATE `user_upload_usage` SET `bytes` = GREATEST(`bytes` - ?, 0) WHERE `user_id` = ? AND `day` = ?", size, uid, day)
+	return err
+}
+
+func addUploadUsage(uid int, size int64) error {
+	day, _ := today()
+	query := "INSERT INTO `user_upload_usage` (`user_id`, `day`, `bytes`) VALUES (?,?,?) " +
+		"ON DUPLICATE KEY UPDATE `bytes` = `bytes` + VALUES(`bytes`)"
+	_, err := db.Exec(query, uid, day, size)
+	return err
+}
+
+func userLimits(u User) (UserLimits, error) {
+	if isLimitExempt(u) {
+		return UserLimits{Exempt: true}, nil
+	}
+	limits := UserLimits{
+		Posts:    userRateStatus(u, userActionPost),
+		Comments: userRateStatus(u, userActionComment),
+	}
+	if quota := cfg.UserLimit.DailyUploadQuota; quota > 0 {
+		used, err := uploadUsageToday(u.ID)
+		if err != nil {
+			return limits, err
+		}
+		remaining := quota - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		_, resetAt := today()
+		limits.Upload = &QuotaStatus{Limit: quota, Used: used, Remaining: remaining, ResetAt: resetAt}
+	}
+	return limits, nil
+}
+
+// ログイン中のユーザーの投稿回数とアップロード容量の上限をJSONで返す
+func getAPILimits(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		return unauthorized("error.login_required")
+	}
+
+	limits, err := userLimits(me)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(limits)
+	return nil
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Webhookで通知するイベント
+const (
+	eventPostCreated    = "post.created"
+	eventCommentCreated = "comment.created"
+	eventUserBanned     = "user.banned"
+)
+
+var webhookEvents = []string{eventPostCreated, eventCommentCreated, eventUserBanned}
+
+const (
+	deliveryPending   = "pending"
+	deliverySucceeded = "succeeded"
+	deliveryFailed    = "failed"
+)
+
+// Webhookの送信先で追うリダイレクトの回数
+const webhookMaxRedirects = 3
+
+// 管理者が登録したURLでも、内部のアドレスやクラウドのメタデータには接続させない
+// 1回の送信の時間は cfg.Webhook.Timeout のコンテキストで区切る
+var webhookHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext:           externalDialer().DialContext,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost:   4,
+		IdleConnTimeout:       90 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= webhookMaxRedirects {
+			return fmt.Errorf("webhook: stopped after %d redirects", webhookMaxRedirects)
+		}
+		return nil
+	},
+}
+
+type Webhook struct {
+	ID        int       `db:"id"`
+	URL       string    `db:"url"`
+	Secret    string    `db:"secret"`
+	Events    string    `db:"events"`
+	Active    bool      `db:"active"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type WebhookDelivery struct {
+	ID             int            `db:"id"`
+	WebhookID      int            `db:"webhook_id"`
+	Event          string         `db:"event"`
+	Payload        string         `db:"payload"`
+	Status         string         `db:"status"`
+	Attempts       int            `db:"attempts"`
+	LastStatusCode int            `db:"last_status_code"`
+	LastError      string         `db:"last_error"`
+	CreatedAt      time.Time      `db:"created_at"`
+	DeliveredAt    sql.NullTime   `db:"delivered_at"`
+	URL            sql.NullString `db:"url"`
+}
+
+type webhookPayload struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+type webhookJob struct {
+	DeliveryID int `json:"delivery_id"`
+}
+
+// enqueueWebhook はイベントを購読しているWebhookごとに配送を記録し、送信をジョブにする
+// 送信はジョブのワーカーが行うので、ハンドラーは待たされない
+func enqueueWebhook(event string, data interface{}) {
+	hooks := []Webhook{}
+	err := db.Select(&hooks, "SELECT * FROM `webhooks` WHERE `active` = 1 AND FIND_IN_SET(?, `events`)", event)
+	if err != nil {
+		slog.Error("enqueueWebhook failed", slog.Any("err", err))
+		return
+	}
+	if len(hooks) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(webhookPayload{
+		ID:        secureRandomStr(16),
+		Event:     event,
+		CreatedAt: time.Now(),
+		Data:      data,
+	})
+	if err != nil {
+		slog.Error("enqueueWebhook failed", slog.Any("err", err))
+		return
+	}
+	for _, h := range hooks {
+		result, err := db.Exec(
+			"INSERT INTO `webhook_deliveries` (`webhook_id`, `event`, `payload`, `status`) VALUES (?,?,?,?)",
+			h.ID, event, string(payload), deliveryPending,
+		)
+		if err != nil {
+			slog.Error("enqueueWebhook failed", slog.Any("err", err))
+			continue
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			slog.Error("enqueueWebhook failed", slog.Any("err", err))
+			continue
+		}
+		if err := enqueueJob(jobDeliverWebhook, webhookJob{DeliveryID: int(id)}); err != nil {
+			slog.Error("enqueueWebhook failed", slog.Any("err", err))
+		}
+	}
+}
+
+// signWebhook は "タイムスタンプ.本文" の HMAC-SHA256 を返す
+// 受信側はタイムスタンプも確認してリプレイを防げる
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func sendWebhook(ctx context.Context, h Webhook, d WebhookDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Webhook.Timeout)
+	defer cancel()
+
+	body := []byte(d.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Iscogram-Webhook/1.0")
+	req.Header.Set("X-Iscogram-Event", d.Event)
+	req.Header.Set("X-Iscogram-Delivery", strconv.Itoa(d.ID))
+	req.Header.Set("X-Iscogram-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Iscogram-Signature", signWebhook(h.Secret, timestamp, body))
+
+	res, err := webhookHTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<20))
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+// runDeliverWebhook は配送を1件送る。失敗したらエラーを返してジョブとして再試行させ、
+// 最後の試行でも失敗したら配送を failed にする
+// 再送ボタンと /admin/jobs からの再試行が重なっても、送信済みの配送は送り直さない
+func runDeliverWebhook(ctx context.Context, j Job) error {
+	payload := webhookJob{}
+	if err := json.Unmarshal(j.Payload, &payload); err != nil {
+		return err
+	}
+	d := WebhookDelivery{}
+	err := db.GetContext(ctx, &d, "SELECT * FROM `webhook_deliveries` WHERE `id` = ?", payload.DeliveryID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if d.Status == deliverySucceeded {
+		return nil
+	}
+
+	// 削除されたWebhookの配送は postAdminWebhooksUpdate が failed にしている
+	h := Webhook{}
+	err = db.GetContext(ctx, &h, "SELECT * FROM `webhooks` WHERE `id` = ?", d.WebhookID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	code, sendErr := sendWebhook(ctx, h, d)
+	if sendErr == nil {
+		_, err = db.ExecContext(ctx,
+			"UPDATE `webhook_deliveries` SET `status` = ?, `attempts` = `attempts` + 1, `last_status_code` = ?, `last_error` = '', `delivered_at` = NOW() WHERE `id` = ?",
+			deliverySucceeded, code, d.ID,
+		)
+		return err
+	}
+
+	status := deliveryPending
+	if j.Attempts >= j.MaxAttempts {
+		status = deliveryFailed
+	}
+	_, err = db.ExecContext(ctx,
+		"UPDATE `webhook_deliveries` SET `status` = ?, `attempts` = `attempts` + 1, `last_status_code` = ?, `last_error` = ? WHERE `id` = ?",
+		status, code, truncate(sendErr.Error(), 255), d.ID,
+	)
+	if err != nil {
+		slog.Error("runDeliverWebhook failed", slog.Any("err", err))
+	}
+	return fmt.Errorf("webhook %d to %s: %w", d.ID, h.URL, sendErr)
+}
+
+func getAdminWebhooks(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+
+	if me.Authority == 0 {
+		return forbidden("error.forbidden")
+	}
+
+	hooks := []Webhook{}
+	err := db.SelectContext(r.Context(), &hooks, "SELECT * FROM `webhooks` ORDER BY `id`")
+	if err != nil {
+		return err
+	}
+
+	deliveries := []WebhookDelivery{}
+	query := "SELECT `webhook_deliveries`.*, `webhooks`.`url` FROM `webhook_deliveries` LEFT JOIN `webhooks` ON `webhook_deliveries`.`webhook_id` = `webhooks`.`id` " +
+		"ORDER BY `webhook_deliveries`.`id` DESC LIMIT 100"
+	err = db.SelectContext(r.Context(), &deliveries, query)
+	if err != nil {
+		return err
+	}
+
+	return renderTemplate(r.Context(), w, "webhooks", struct {
+		Webhooks   []Webhook
+		Deliveries []WebhookDelivery
+		Events     []string
+		Me         User
+		CSRFToken  string
+		Flash      string
+	}{hooks, deliveries, webhookEvents, me, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+func postAdminWebhooks(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+
+	if me.Authority == 0 {
+		return forbidden("error.forbidden")
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		return badRequest("error.bad_request")
+	}
+
+	session := getSession(r)
+	target := strings.TrimSpace(r.FormValue("url"))
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || len(target) > 512 {
+		session.Values["notice"] = tr(r, "flash.invalid_webhook_url")
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/admin/webhooks", http.StatusFound)
+		return nil
+	}
+	events := []string{}
+	for _, e := range r.Form["events[]"] {
+		for _, known := range webhookEvents {
+			if e == known {
+				events = append(events, e)
+			}
+		}
+	}
+	if len(events) == 0 {
+		session.Values["notice"] = tr(r, "flash.webhook_events_required")
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/admin/webhooks", http.StatusFound)
+		return nil
+	}
+
+	secret := secureRandomStr(32)
+	_, err = db.ExecContext(r.Context(), "INSERT INTO `webhooks` (`url`, `secret`, `events`) VALUES (?,?,?)", target, secret, strings.Join(events, ","))
+	if err != nil {
+		return err
+	}
+
+	session.Values["notice"] = tr(r, "flash.webhook_added", secret)
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/admin/webhooks", http.StatusFound)
+	return nil
+}
+
+// 有効・無効の切り替えと削除
+func postAdminWebhooksUpdate(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+
+	if me.Authority == 0 {
+		return forbidden("error.forbidden")
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		return badRequest("error.bad_request")
+	}
+
+	switch r.FormValue("action") {
+	case "enable":
+		_, err = db.ExecContext(r.Context(), "UPDATE `webhooks` SET `active` = 1 WHERE `id` = ?", id)
+	case "disable":
+		_, err = db.ExecContext(r.Context(), "UPDATE `webhooks` SET `active` = 0 WHERE `id` = ?", id)
+	case "delete":
+		_, err = db.ExecContext(r.Context(), "DELETE FROM `webhooks` WHERE `id` = ?", id)
+		if err == nil {
+			_, err = db.ExecContext(r.Context(), "UPDATE `webhook_deliveries` SET `status` = ? WHERE `webhook_id` = ? AND `status` = ?", deliveryFailed, id, deliveryPending)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, "/admin/webhooks", http.StatusFound)
+	return nil
+}
+
+// 失敗した配送をもう一度送る
+func postAdminWebhooksRedeliver(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+
+	if me.Authority == 0 {
+		return forbidden("error.forbidden")
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		return badRequest("error.bad_request")
+	}
+
+	result, err := db.ExecContext(r.Context(), "UPDATE `webhook_deliveries` SET `status` = ?, `attempts` = 0 WHERE `id` = ? AND `status` = ?",
+		deliveryPending, id, deliveryFailed)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 1 {
+		if err := enqueueJob(jobDeliverWebhook, webhookJob{DeliveryID: id}); err != nil {
+			return err
+		}
+	}
+
+	http.Redirect(w, r, "/admin/webhooks", http.StatusFound)
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// 管理者が登録したURLでも、ループバックを指していれば接続しない
+func TestSendWebhookRefusesInternalAddress(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	t.Cleanup(srv.Close)
+
+	h := Webhook{ID: 1, URL: srv.URL, Secret: "secret"}
+	_, err := sendWebhook(context.Background(), h, WebhookDelivery{ID: 1, Event: eventPostCreated, Payload: "{}"})
+	if err == nil || !strings.Contains(err.Error(), "internal address") {
+		t.Errorf("sendWebhook to %s: err = %v, want an internal address error", srv.URL, err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("server got %d requests", n)
+	}
+}
@@ -1,58 +1,146 @@
 'use strict';
 
-// cf: https://github.com/hustcc/timeago.js
-timeago.register('ja', (number, index) => {
-  return [
-    ['すこし前', 'すぐに'],
-    ['%s秒前', '%s秒以内'],
-    ['1分前', '1分以内'],
-    ['%s分前', '%s分以内'],
-    ['1時間前', '1時間以内'],
-    ['%s時間前', '%s時間以内'],
-    ['1日前', '1日以内'],
-    ['%s日前', '%s日以内'],
-    ['1週間前', '1週間以内'],
-    ['%s週間前', '%s週間以内'],
-    ['1ヶ月前', '1ヶ月以内'],
-    ['%sヶ月前', '%sヶ月以内'],
-    ['1年前', '1年以内'],
-    ['%s年前', '%s年以内'],
-  ][index];
-})
+// 投稿日時を「5分前」のように表示する
+// Go実装はサーバーが <html lang> の言語で描画しているので、開いている間に1分ごとに更新するだけ
+// 空の要素 (他の言語の実装) は読み込み時に埋める
+const relativeTime = window.Intl && Intl.RelativeTimeFormat
+  ? new Intl.RelativeTimeFormat(document.documentElement.lang || 'ja', { numeric: 'auto' })
+  : null;
+const timeUnits = [
+  ['year', 365 * 24 * 60 * 60],
+  ['month', 30 * 24 * 60 * 60],
+  ['week', 7 * 24 * 60 * 60],
+  ['day', 24 * 60 * 60],
+  ['hour', 60 * 60],
+  ['minute', 60],
+];
+
+const renderTimes = (root, onlyEmpty) => {
+  if (!relativeTime) {
+    return;
+  }
+  const now = Date.now();
+  root.querySelectorAll('time.timeago').forEach((el) => {
+    if (onlyEmpty && el.textContent.trim() !== '') {
+      return;
+    }
+    const seconds = (now - Date.parse(el.getAttribute('datetime'))) / 1000;
+    const unit = timeUnits.find(([, size]) => seconds >= size);
+    if (!unit) {
+      // 1分未満はサーバーの文言 (すこし前) のままにする
+      if (el.textContent.trim() === '') {
+        el.textContent = relativeTime.format(0, 'second');
+      }
+      return;
+    }
+    el.textContent = relativeTime.format(-Math.floor(seconds / unit[1]), unit[0]);
+  });
+};
 
 document.addEventListener('DOMContentLoaded', () => {
-  timeago.render(document.querySelectorAll('time.timeago'), 'ja');
+  renderTimes(document, true);
+  setInterval(() => renderTimes(document, false), 60 * 1000);
 
-  const btn = document.getElementById('isu-post-more-btn');
-  const postMore = document.getElementById('isu-post-more');
+  listenTimeline();
 
-  if (!btn) {
+  const postMore = document.getElementById('isu-post-more');
+  if (!postMore) {
     return;
   }
+  const btn = document.getElementById('isu-post-more-btn');
 
-  btn.addEventListener('click', () => {
+  // data-next のページを読み込んで末尾に追加する。次のページは Link ヘッダーで返ってくる
+  const loadMore = () => {
+    const next = postMore.dataset.next;
+    if (!next || postMore.classList.contains('loading')) {
+      return;
+    }
     postMore.classList.add('loading');
-    const posts = document.querySelectorAll('.isu-post');
-    const lastEl = posts[posts.length-1];
-    const maxCreatedAt = lastEl.dataset.createdAt;
-    fetch(`/posts?max_created_at=${encodeURIComponent(maxCreatedAt)}`, {
+    fetch(next, {
       method: 'GET',
     }).then(response => {
+      if (response.status === 404) {
+        return '';
+      }
       if (!response.ok) {
         throw new Error('Network response was not ok');
       }
+      const link = (response.headers.get('Link') || '').match(/<([^>]+)>;\s*rel="next"/);
+      postMore.dataset.next = link ? link[1] : '';
       return response.text();
     }).then(text => {
+      const postsEl = document.querySelector('.isu-posts');
       const parser = new DOMParser();
       const doc = parser.parseFromString(text, "text/html");
       doc.querySelectorAll('.isu-post').forEach((el) => {
         const id = el.getAttribute('id');
         if (!document.getElementById(id)) {
-          lastEl.parentElement.append(el);
+          postsEl.append(el);
         }
       });
-      timeago.render(document.querySelectorAll('time.timeago'), 'ja');
+      renderTimes(postsEl, true);
+      postMore.classList.remove('loading');
+      if (!postMore.dataset.next) {
+        postMore.remove();
+      }
+    }).catch(() => {
       postMore.classList.remove('loading');
     });
+  };
+
+  btn.addEventListener('click', (e) => {
+    e.preventDefault();
+    loadMore();
   });
+
+  // 末尾までスクロールしたら自動で続きを読み込む
+  if (window.IntersectionObserver) {
+    new IntersectionObserver((entries) => {
+      if (entries.some((entry) => entry.isIntersecting)) {
+        loadMore();
+      }
+    }, { rootMargin: '200px' }).observe(postMore);
+  }
 });
+
+// 新しい投稿とコメント数の変化をSSEで受け取ってページに反映する
+const listenTimeline = () => {
+  const postsEl = document.querySelector('.isu-posts');
+  if (!postsEl || !window.EventSource) {
+    return;
+  }
+  // 投稿フォームのあるトップページだけ新しい投稿を先頭に追加する
+  const prependPosts = !!document.querySelector('.isu-submit');
+  const tokenEl = document.querySelector('input[name="csrf_token"]');
+
+  const source = new EventSource('/stream');
+  source.addEventListener('post', (e) => {
+    if (!prependPosts) {
+      return;
+    }
+    const data = JSON.parse(e.data);
+    if (document.getElementById(`pid_${data.id}`)) {
+      return;
+    }
+    // 全ての言語で描画されて届くので、ページと同じ言語のものを使う
+    const html = (data.html_by_locale && data.html_by_locale[document.documentElement.lang]) || data.html;
+    const doc = new DOMParser().parseFromString(html, 'text/html');
+    const el = doc.querySelector('.isu-post');
+    if (!el) {
+      return;
+    }
+    if (tokenEl) {
+      el.querySelectorAll('input[name="csrf_token"]').forEach((input) => {
+        input.value = tokenEl.value;
+      });
+    }
+    postsEl.prepend(el);
+  });
+  source.addEventListener('comment', (e) => {
+    const data = JSON.parse(e.data);
+    const countEl = document.querySelector(`#pid_${data.post_id} .isu-post-comment-count b`);
+    if (countEl) {
+      countEl.textContent = data.count;
+    }
+  });
+};
@@ -6,3 +6,6 @@ UPDATE `posts` INNER JOIN `users` ON `posts`.`user_id` = `users`.`id` SET `posts
 
 -- 効果はあまりないので外してもいいかも
 ALTER TABLE `posts` ADD INDEX user_del_flg_created_at_idx (`user_del_flg`, `created_at`);
+
+-- ユーザーページのページング用
+ALTER TABLE `posts` ADD INDEX user_id_created_at_idx (`user_id`, `created_at`);
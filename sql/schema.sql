@@ -0,0 +1,185 @@
+USE isuconp;
+
+-- ログイン中のセッションの一覧。セッションの中身はmemcachedにある
+CREATE TABLE IF NOT EXISTS `user_sessions` (
+  `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `session_id` varchar(64) NOT NULL,
+  `user_id` int NOT NULL,
+  `ip` varchar(64) NOT NULL DEFAULT '',
+  `user_agent` varchar(255) NOT NULL DEFAULT '',
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `last_seen_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY `session_id_idx` (`session_id`),
+  KEY `user_id_idx` (`user_id`)
+) DEFAULT CHARSET=utf8mb4;
+
+-- ログイン失敗によるロックの記録。管理者用ページで一覧・解除する
+CREATE TABLE IF NOT EXISTS `login_lockouts` (
+  `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `kind` varchar(16) NOT NULL,
+  `target` varchar(255) NOT NULL,
+  `failures` int NOT NULL DEFAULT 0,
+  `last_ip` varchar(64) NOT NULL DEFAULT '',
+  `locked_until` datetime NOT NULL,
+  `updated_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  UNIQUE KEY `kind_target_idx` (`kind`, `target`)
+) DEFAULT CHARSET=utf8mb4;
+
+-- ユーザーごとの1日のアップロード量
+CREATE TABLE IF NOT EXISTS `user_upload_usage` (
+  `user_id` int NOT NULL,
+  `day` date NOT NULL,
+  `bytes` bigint NOT NULL DEFAULT 0,
+  PRIMARY KEY (`user_id`, `day`)
+) DEFAULT CHARSET=utf8mb4;
+
+-- 2段階認証 (TOTP) の秘密鍵。last_used_step は同じコードの再利用を防ぐため
+CREATE TABLE IF NOT EXISTS `user_totp` (
+  `user_id` int NOT NULL PRIMARY KEY,
+  `secret` varchar(64) NOT NULL,
+  `last_used_step` bigint NOT NULL DEFAULT 0,
+  `enabled_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+) DEFAULT CHARSET=utf8mb4;
+
+-- 2段階認証のリカバリーコード。SHA-256 のハッシュだけを保存する
+CREATE TABLE IF NOT EXISTS `user_recovery_codes` (
+  `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` int NOT NULL,
+  `code_hash` char(64) NOT NULL,
+  `used_at` datetime DEFAULT NULL,
+  KEY `user_id_idx` (`user_id`)
+) DEFAULT CHARSET=utf8mb4;
+
+-- パスワード再設定のためのメールアドレス
+CREATE TABLE IF NOT EXISTS `user_emails` (
+  `user_id` int NOT NULL PRIMARY KEY,
+  `email` varchar(255) NOT NULL
+) DEFAULT CHARSET=utf8mb4;
+
+-- 設定で選んだ表示言語。行がなければクッキーか Accept-Language で決める
+CREATE TABLE IF NOT EXISTS `user_locales` (
+  `user_id` int NOT NULL PRIMARY KEY,
+  `locale` varchar(16) NOT NULL
+) DEFAULT CHARSET=utf8mb4;
+
+-- パスワード再設定用のトークン。SHA-256 のハッシュだけを保存し、1回使ったら used_at を入れる
+CREATE TABLE IF NOT EXISTS `password_reset_tokens` (
+  `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` int NOT NULL,
+  `token_hash` char(64) NOT NULL,
+  `expires_at` datetime NOT NULL,
+  `used_at` datetime DEFAULT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY `token_hash_idx` (`token_hash`),
+  KEY `user_id_idx` (`user_id`)
+) DEFAULT CHARSET=utf8mb4;
+
+-- スクリプトやボット用の個人アクセストークン。SHA-256 のハッシュだけを保存する
+-- scopes は read,post,comment,admin をカンマ区切りで持つ
+CREATE TABLE IF NOT EXISTS `api_tokens` (
+  `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` int NOT NULL,
+  `name` varchar(64) NOT NULL,
+  `token_hash` char(64) NOT NULL,
+  `scopes` varchar(255) NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `last_used_at` datetime DEFAULT NULL,
+  `last_used_ip` varchar(64) DEFAULT NULL,
+  `revoked_at` datetime DEFAULT NULL,
+  UNIQUE KEY `token_hash_idx` (`token_hash`),
+  KEY `user_id_idx` (`user_id`)
+) DEFAULT CHARSET=utf8mb4;
+
+-- OpenID Connect プロバイダのアカウント (iss と sub の組) と users の対応
+CREATE TABLE IF NOT EXISTS `user_identities` (
+  `issuer` varchar(255) NOT NULL,
+  `subject` varchar(255) NOT NULL,
+  `user_id` int NOT NULL,
+  `email` varchar(255) NOT NULL DEFAULT '',
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`issuer`, `subject`),
+  KEY `user_id_idx` (`user_id`)
+) DEFAULT CHARSET=utf8mb4;
+
+-- ActivityPub でユーザーが署名に使う鍵
+CREATE TABLE IF NOT EXISTS `ap_actor_keys` (
+  `user_id` int NOT NULL PRIMARY KEY,
+  `private_key_pem` text NOT NULL,
+  `public_key_pem` text NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+) DEFAULT CHARSET=utf8mb4;
+
+-- 他のサーバーのアカウント。返信をコメントにするときに users の行 (user_id) を作る
+CREATE TABLE IF NOT EXISTS `ap_remote_actors` (
+  `actor_id` varchar(512) NOT NULL PRIMARY KEY,
+  `user_id` int NOT NULL DEFAULT 0,
+  `username` varchar(64) NOT NULL,
+  `inbox` varchar(512) NOT NULL,
+  `shared_inbox` varchar(512) NOT NULL DEFAULT '',
+  `public_key_pem` text NOT NULL,
+  `fetched_at` datetime NOT NULL
+) DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `ap_followers` (
+  `user_id` int NOT NULL,
+  `actor_id` varchar(512) NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`user_id`, `actor_id`)
+) DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `ap_likes` (
+  `post_id` int NOT NULL,
+  `actor_id` varchar(512) NOT NULL,
+  `activity_id` varchar(512) NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`post_id`, `actor_id`)
+) DEFAULT CHARSET=utf8mb4;
+
+-- 同じ返信を二重にコメントにしないため、受け取った Note の ID を残す
+CREATE TABLE IF NOT EXISTS `ap_remote_comments` (
+  `note_id` varchar(512) NOT NULL PRIMARY KEY,
+  `post_id` int NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+) DEFAULT CHARSET=utf8mb4;
+
+-- 管理者が登録したWebhook。events は購読するイベントのカンマ区切り
+CREATE TABLE IF NOT EXISTS `webhooks` (
+  `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `url` varchar(512) NOT NULL,
+  `secret` varchar(128) NOT NULL,
+  `events` varchar(255) NOT NULL,
+  `active` tinyint(1) NOT NULL DEFAULT 1,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+) DEFAULT CHARSET=utf8mb4;
+
+-- Webhookの送信履歴。送信と再送は jobs の webhook.deliver ジョブが行う
+CREATE TABLE IF NOT EXISTS `webhook_deliveries` (
+  `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `webhook_id` int NOT NULL,
+  `event` varchar(64) NOT NULL,
+  `payload` mediumtext NOT NULL,
+  `status` varchar(16) NOT NULL,
+  `attempts` int NOT NULL DEFAULT 0,
+  `last_status_code` int NOT NULL DEFAULT 0,
+  `last_error` varchar(255) NOT NULL DEFAULT '',
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `delivered_at` datetime DEFAULT NULL,
+  KEY `webhook_id_idx` (`webhook_id`)
+) DEFAULT CHARSET=utf8mb4;
+
+-- バックグラウンドジョブのキュー。成功したジョブは消し、再試行を使い切ったものは status = dead で残す
+-- unique_key は定期実行のジョブを重複させないために使う
+CREATE TABLE IF NOT EXISTS `jobs` (
+  `id` bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `kind` varchar(64) NOT NULL,
+  `payload` mediumtext NOT NULL,
+  `status` varchar(16) NOT NULL,
+  `attempts` int NOT NULL DEFAULT 0,
+  `max_attempts` int NOT NULL,
+  `unique_key` varchar(255) DEFAULT NULL,
+  `run_at` datetime NOT NULL,
+  `last_error` varchar(255) NOT NULL DEFAULT '',
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY `unique_key_idx` (`unique_key`),
+  KEY `status_run_at_idx` (`status`, `run_at`)
+) DEFAULT CHARSET=utf8mb4;